@@ -0,0 +1,36 @@
+// Command webhook-sign signs a webhook body the way the payment provider
+// does, for sending test events to a local service:
+//
+//	echo '{"id":"evt_1","type":"payment.succeeded","data":{"payment_id":"fake_..."}}' > event.json
+//	curl -X POST http://localhost:8080/api/webhooks/payments \
+//	  -H "Zl0y-Signature: $(go run ./cmd/webhook-sign < event.json)" \
+//	  --data-binary @event.json
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"zl0y-billing/internal/webhook"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	_ = godotenv.Load()
+
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		log.Fatal("WEBHOOK_SECRET must be set")
+	}
+
+	body, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatalf("Failed to read body: %v", err)
+	}
+
+	fmt.Println(webhook.NewSigner(secret).Sign(body, time.Now()))
+}
@@ -0,0 +1,20 @@
+// Package blob stores opaque payloads, such as report contents, by key.
+package blob
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned for keys with nothing stored.
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps payloads by key. Keys are slash-separated paths such as
+// "reports/<report_id>"; putting a key again replaces its payload.
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the payload; the caller closes it. ctx covers the whole read.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,79 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// GridFSStore keeps payloads in MongoDB GridFS, with the key as the file
+// name. Putting a key uploads a new revision and drops the older ones.
+type GridFSStore struct {
+	bucket *mongo.GridFSBucket
+}
+
+func NewGridFSStore(db *mongo.Database, bucketName string) *GridFSStore {
+	return &GridFSStore{
+		bucket: db.GridFSBucket(options.GridFSBucket().SetName(bucketName)),
+	}
+}
+
+func (s *GridFSStore) Put(ctx context.Context, key string, r io.Reader) error {
+	fileID, err := s.bucket.UploadFromStream(ctx, key, r)
+	if err != nil {
+		return fmt.Errorf("failed to upload blob: %w", err)
+	}
+
+	// Readers take the latest revision, so older ones can go now
+	return s.deleteRevisions(ctx, key, fileID)
+}
+
+func (s *GridFSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	stream, err := s.bucket.OpenDownloadStreamByName(ctx, key, options.GridFSName().SetRevision(-1))
+	if err != nil {
+		if errors.Is(err, mongo.ErrFileNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+
+	return stream, nil
+}
+
+func (s *GridFSStore) Delete(ctx context.Context, key string) error {
+	return s.deleteRevisions(ctx, key, nil)
+}
+
+// deleteRevisions deletes the files named key other than keep.
+func (s *GridFSStore) deleteRevisions(ctx context.Context, key string, keep interface{}) error {
+	filter := bson.M{"filename": key}
+	if keep != nil {
+		filter["_id"] = bson.M{"$ne": keep}
+	}
+
+	cursor, err := s.bucket.Find(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to find blob revisions: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var files []struct {
+		ID bson.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return fmt.Errorf("failed to decode blob revisions: %w", err)
+	}
+
+	for _, f := range files {
+		if err := s.bucket.Delete(ctx, f.ID); err != nil && !errors.Is(err, mongo.ErrFileNotFound) {
+			return fmt.Errorf("failed to delete blob revision: %w", err)
+		}
+	}
+
+	return nil
+}
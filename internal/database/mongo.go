@@ -2,6 +2,7 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -10,6 +11,9 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
+// indexNotFoundCode is the server error code for dropping a missing index
+const indexNotFoundCode = 27
+
 type MongoDB struct {
 	Client   *mongo.Client
 	Database *mongo.Database
@@ -81,13 +85,73 @@ func (m *MongoDB) createIndexes() error {
 		return fmt.Errorf("failed to create index on client_generated_id: %w", err)
 	}
 
-	// Create a compound index for efficient queries - using bson.D (ORDER MATTERS)
+	// Create a compound index for efficient queries - using bson.D (ORDER MATTERS).
+	// _id breaks created_at ties, so the report list cursors are index seeks
 	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
 		Keys: bson.D{
 			{Key: "user_id", Value: 1},
 			{Key: "created_at", Value: -1},
+			{Key: "_id", Value: -1},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create index on user_id, created_at and _id: %w", err)
+	}
+
+	// It replaces the (user_id, created_at) index
+	var commandErr mongo.CommandError
+	err = collection.Indexes().DropOne(ctx, "user_id_1_created_at_-1")
+	if err != nil && !(errors.As(err, &commandErr) && commandErr.Code == indexNotFoundCode) {
+		return fmt.Errorf("failed to drop index on user_id and created_at: %w", err)
+	}
+
+	// Create compound indexes for the report list filters, each ending in the default sort
+	for _, field := range []string{"is_purchased", "product_code", "status"} {
+		_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{
+				{Key: "user_id", Value: 1},
+				{Key: field, Value: 1},
+				{Key: "created_at", Value: -1},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create index on user_id, %s and created_at: %w", field, err)
+		}
+	}
+
+	// Create an index for sorting the report list by title
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "title", Value: 1},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create index on user_id and title: %w", err)
+	}
+
+	// Create a text index for searching a user's reports by title and target.
+	// Titles and targets mix languages, domains and emails, so words aren't stemmed
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "title", Value: "text"},
+			{Key: "target", Value: "text"},
 		},
+		Options: options.Index().SetName("reports_text").SetDefaultLanguage("none"),
 	})
+	if err != nil {
+		return fmt.Errorf("failed to create text index on title and target: %w", err)
+	}
+
+	// Create a sparse index on the fingerprint schema version to find results to upgrade
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "fingerprint.schema_version", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create index on fingerprint.schema_version: %w", err)
+	}
 
-	return err
+	return nil
 }
@@ -22,6 +22,106 @@ func NewPostgresDB(dsn string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create users table: %w", err)
 	}
 
+	// Create the ledger tables (accounts, journal entries, postings)
+	if err := createLedgerTables(db); err != nil {
+		return nil, fmt.Errorf("failed to create ledger tables: %w", err)
+	}
+
+	// Create the purchases table that persists the purchase saga state
+	if err := createPurchasesTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create purchases table: %w", err)
+	}
+
+	// Create the idempotency keys table for replaying mutating requests
+	if err := createIdempotencyKeysTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create idempotency keys table: %w", err)
+	}
+
+	// Create the top-ups table for balance top-ups through payment providers
+	if err := createTopUpsTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create topups table: %w", err)
+	}
+
+	// Create the webhook events table used to deduplicate provider webhooks
+	if err := createWebhookEventsTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create webhook events table: %w", err)
+	}
+
+	// Create the products table holding the report price catalogue
+	if err := createProductsTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create products table: %w", err)
+	}
+
+	// Create the promo code tables for discounts and top-up bonuses
+	if err := createPromoTables(db); err != nil {
+		return nil, fmt.Errorf("failed to create promo tables: %w", err)
+	}
+
+	// Create the plans and subscriptions tables for monthly report allowances
+	if err := createSubscriptionTables(db); err != nil {
+		return nil, fmt.Errorf("failed to create subscription tables: %w", err)
+	}
+
+	// Create the wallets table and the currency columns of priced tables
+	if err := createWalletsTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create wallets table: %w", err)
+	}
+
+	// Create the sessions and refresh tokens tables for staying logged in
+	if err := createSessionTables(db); err != nil {
+		return nil, fmt.Errorf("failed to create session tables: %w", err)
+	}
+
+	// Create the revoked tokens table checked on every authenticated request
+	if err := createRevokedTokensTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create revoked tokens table: %w", err)
+	}
+
+	// Create the signing keys table holding the JWT key set
+	if err := createSigningKeysTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create signing keys table: %w", err)
+	}
+
+	// Create the password reset tokens table
+	if err := createPasswordResetTokensTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create password reset tokens table: %w", err)
+	}
+
+	// Create the two-factor authentication tables
+	if err := createTwoFactorTables(db); err != nil {
+		return nil, fmt.Errorf("failed to create two-factor tables: %w", err)
+	}
+
+	// Create the login throttles table for brute-force protection
+	if err := createLoginThrottlesTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create login throttles table: %w", err)
+	}
+
+	// Add roles and account disabling to users
+	if err := createUserRoleColumns(db); err != nil {
+		return nil, fmt.Errorf("failed to add user role columns: %w", err)
+	}
+
+	// Create the API keys table for server-to-server clients
+	if err := createAPIKeysTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create API keys table: %w", err)
+	}
+
+	// Create the external identities table for OpenID Connect login
+	if err := createIdentitiesTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create identities table: %w", err)
+	}
+
+	// Add the optional, verifiable email to users
+	if err := createUserEmailColumns(db); err != nil {
+		return nil, fmt.Errorf("failed to create user email columns: %w", err)
+	}
+
+	// Create the report jobs table queueing report generation
+	if err := createReportJobsTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create report jobs table: %w", err)
+	}
+
 	return db, nil
 }
 
@@ -31,11 +131,602 @@ func createUsersTable(db *sql.DB) error {
 	    id SERIAL PRIMARY KEY,
 	    login VARCHAR(255) NOT NULL UNIQUE,
 	    password_hash VARCHAR(255) NOT NULL,
-	    balance INTEGER DEFAULT 10000, -- 100.00 in cents as a starting balance
+	    balance INTEGER DEFAULT 0, -- cached sum of the user's ledger postings, in cents
 	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_users_login ON users(login);
+
+	-- Set for suspicious accounts, e.g. after a chargeback
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS flagged_at TIMESTAMP;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS flag_reason TEXT NOT NULL DEFAULT '';
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createLedgerTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS ledger_accounts (
+	    id SERIAL PRIMARY KEY,
+	    code VARCHAR(255) NOT NULL UNIQUE, -- e.g. user:42 or system:revenue
+	    user_id INTEGER REFERENCES users(id),
+	    type VARCHAR(32) NOT NULL, -- liability, revenue, expense, asset, equity
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- One account per user and currency; user:42 is in RUB, user:42:USD in dollars
+	ALTER TABLE ledger_accounts ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+	DROP INDEX IF EXISTS idx_ledger_accounts_user_id;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_ledger_accounts_user_currency ON ledger_accounts(user_id, currency);
+
+	CREATE TABLE IF NOT EXISTS journal_entries (
+	    id SERIAL PRIMARY KEY,
+	    kind VARCHAR(32) NOT NULL, -- purchase, topup, refund, signup_bonus, ...
+	    reference VARCHAR(255) NOT NULL DEFAULT '',
+	    description TEXT NOT NULL DEFAULT '',
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_journal_entries_reference ON journal_entries(reference);
+
+	CREATE TABLE IF NOT EXISTS ledger_postings (
+	    id SERIAL PRIMARY KEY,
+	    entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+	    account_id INTEGER NOT NULL REFERENCES ledger_accounts(id),
+	    amount BIGINT NOT NULL CHECK (amount <> 0), -- positive credits the account, negative debits it
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ledger_postings_entry_id ON ledger_postings(entry_id);
+	CREATE INDEX IF NOT EXISTS idx_ledger_postings_account_id ON ledger_postings(account_id);
+
+	-- Journal entries and postings are append-only
+	CREATE OR REPLACE FUNCTION ledger_reject_change() RETURNS trigger AS $$
+	BEGIN
+	    RAISE EXCEPTION 'ledger records are immutable';
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS journal_entries_immutable ON journal_entries;
+	CREATE TRIGGER journal_entries_immutable
+	    BEFORE UPDATE OR DELETE ON journal_entries
+	    FOR EACH ROW EXECUTE FUNCTION ledger_reject_change();
+
+	DROP TRIGGER IF EXISTS ledger_postings_immutable ON ledger_postings;
+	CREATE TRIGGER ledger_postings_immutable
+	    BEFORE UPDATE OR DELETE ON ledger_postings
+	    FOR EACH ROW EXECUTE FUNCTION ledger_reject_change();
+
+	-- Every journal entry must sum to zero in each currency by the time its transaction commits
+	CREATE OR REPLACE FUNCTION ledger_check_balanced() RETURNS trigger AS $$
+	BEGIN
+	    IF EXISTS (
+	        SELECT 1
+	        FROM ledger_postings p
+	        JOIN ledger_accounts a ON a.id = p.account_id
+	        WHERE p.entry_id = NEW.entry_id
+	        GROUP BY a.currency
+	        HAVING SUM(p.amount) <> 0
+	    ) THEN
+	        RAISE EXCEPTION 'journal entry % is not balanced', NEW.entry_id;
+	    END IF;
+	    RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS ledger_postings_balanced ON ledger_postings;
+	CREATE CONSTRAINT TRIGGER ledger_postings_balanced
+	    AFTER INSERT ON ledger_postings
+	    DEFERRABLE INITIALLY DEFERRED
+	    FOR EACH ROW EXECUTE FUNCTION ledger_check_balanced();
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createPurchasesTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS purchases (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    report_id VARCHAR(255) NOT NULL,
+	    amount INTEGER NOT NULL, -- in cents
+	    state VARCHAR(32) NOT NULL DEFAULT 'pending', -- pending, charged, unlocked, compensated, failed, refunding, refunded
+	    attempts INTEGER NOT NULL DEFAULT 0,
+	    last_error TEXT NOT NULL DEFAULT '',
+	    charge_entry_id INTEGER REFERENCES journal_entries(id),
+	    compensation_entry_id INTEGER REFERENCES journal_entries(id),
+	    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Refunded part of the amount; a full refund passes through refunding
+	-- (report still unlocked) to refunded (report locked again)
+	ALTER TABLE purchases ADD COLUMN IF NOT EXISTS refunded_amount INTEGER NOT NULL DEFAULT 0;
+
+	-- At most one live purchase per report (the indexes were renamed when refunds were added)
+	DROP INDEX IF EXISTS idx_purchases_active_report;
+	DROP INDEX IF EXISTS idx_purchases_due;
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_purchases_live_report
+	    ON purchases(report_id) WHERE state IN ('pending', 'charged', 'unlocked', 'refunding');
+	CREATE INDEX IF NOT EXISTS idx_purchases_pending_due
+	    ON purchases(next_attempt_at) WHERE state IN ('pending', 'charged', 'refunding');
+	CREATE INDEX IF NOT EXISTS idx_purchases_user_id ON purchases(user_id);
+
+	CREATE TABLE IF NOT EXISTS refunds (
+	    id SERIAL PRIMARY KEY,
+	    purchase_id INTEGER NOT NULL REFERENCES purchases(id),
+	    amount INTEGER NOT NULL CHECK (amount > 0), -- in cents
+	    reason TEXT NOT NULL,
+	    source VARCHAR(32) NOT NULL, -- admin, chargeback
+	    entry_id INTEGER NOT NULL REFERENCES journal_entries(id),
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_refunds_purchase_id ON refunds(purchase_id);
+
+	-- Product the report was sold as; amount is the price charged at purchase time
+	ALTER TABLE purchases ADD COLUMN IF NOT EXISTS product_code VARCHAR(64) NOT NULL DEFAULT 'standard';
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createIdempotencyKeysTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+	    id SERIAL PRIMARY KEY,
+	    scope VARCHAR(255) NOT NULL, -- user:<id> or anonymous
+	    key VARCHAR(255) NOT NULL,
+	    request_hash VARCHAR(64) NOT NULL, -- sha256 of method, path and body
+	    status_code INTEGER, -- NULL while the first request is still running
+	    content_type VARCHAR(255) NOT NULL DEFAULT '',
+	    response_body BYTEA,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    completed_at TIMESTAMP,
+	    UNIQUE (scope, key)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createTopUpsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS topups (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    amount INTEGER NOT NULL CHECK (amount > 0), -- in cents
+	    status VARCHAR(32) NOT NULL DEFAULT 'pending', -- pending, succeeded, failed
+	    provider VARCHAR(64) NOT NULL,
+	    provider_payment_id VARCHAR(255),
+	    confirmation_url TEXT NOT NULL DEFAULT '',
+	    failure_reason TEXT NOT NULL DEFAULT '',
+	    entry_id INTEGER REFERENCES journal_entries(id),
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_topups_provider_payment ON topups(provider, provider_payment_id);
+	CREATE INDEX IF NOT EXISTS idx_topups_user_id ON topups(user_id);
+
+	-- Refunded or charged back part of the payment, in cents
+	ALTER TABLE topups ADD COLUMN IF NOT EXISTS reversed_amount INTEGER NOT NULL DEFAULT 0;
+
+	-- Applied refunds and chargebacks, one per provider event, so that a
+	-- redelivered event never takes the money back twice
+	CREATE TABLE IF NOT EXISTS topup_reversals (
+	    topup_id INTEGER NOT NULL REFERENCES topups(id),
+	    event_id VARCHAR(255) NOT NULL,
+	    amount INTEGER NOT NULL,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    PRIMARY KEY (topup_id, event_id)
+	);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createWebhookEventsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS webhook_events (
+	    event_id VARCHAR(255) PRIMARY KEY,
+	    type VARCHAR(64) NOT NULL,
+	    received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    processed_at TIMESTAMP
+	);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createProductsTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS products (
+	    code VARCHAR(64) PRIMARY KEY, -- report type, e.g. quick or deep
+	    name VARCHAR(255) NOT NULL,
+	    price INTEGER NOT NULL CHECK (price >= 0), -- in cents
+	    active BOOLEAN NOT NULL DEFAULT TRUE,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Initial catalogue; standard is what every report cost before the catalogue existed
+	INSERT INTO products (code, name, price) VALUES
+	    ('standard', 'Standard report', 500),
+	    ('quick', 'Quick fingerprint check', 300),
+	    ('deep', 'Deep analysis', 1500)
+	ON CONFLICT (code) DO NOTHING;
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createPromoTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS promo_codes (
+	    id SERIAL PRIMARY KEY,
+	    code VARCHAR(64) UNIQUE NOT NULL, -- stored upper case
+	    target VARCHAR(16) NOT NULL CHECK (target IN ('purchase', 'topup')),
+	    discount_type VARCHAR(16) NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+	    value INTEGER NOT NULL CHECK (value > 0), -- percent or cents
+	    expires_at TIMESTAMP,
+	    max_redemptions INTEGER NOT NULL DEFAULT 0, -- 0 means unlimited
+	    per_user_limit INTEGER NOT NULL DEFAULT 0, -- 0 means unlimited
+	    first_purchase_only BOOLEAN NOT NULL DEFAULT FALSE,
+	    active BOOLEAN NOT NULL DEFAULT TRUE,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Every use of a code; voided rows stay for the audit trail but don't count towards limits
+	CREATE TABLE IF NOT EXISTS promo_redemptions (
+	    id SERIAL PRIMARY KEY,
+	    promo_code_id INTEGER NOT NULL REFERENCES promo_codes(id),
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    purchase_id INTEGER REFERENCES purchases(id),
+	    topup_id INTEGER REFERENCES topups(id),
+	    amount INTEGER NOT NULL, -- discount or bonus in cents
+	    status VARCHAR(16) NOT NULL DEFAULT 'applied', -- applied, voided
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    voided_at TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_promo_redemptions_code_user ON promo_redemptions(promo_code_id, user_id);
+	CREATE INDEX IF NOT EXISTS idx_promo_redemptions_purchase_id ON promo_redemptions(purchase_id);
+	CREATE INDEX IF NOT EXISTS idx_promo_redemptions_topup_id ON promo_redemptions(topup_id);
+
+	ALTER TABLE purchases ADD COLUMN IF NOT EXISTS promo_code VARCHAR(64) NOT NULL DEFAULT '';
+	ALTER TABLE purchases ADD COLUMN IF NOT EXISTS discount_amount INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE topups ADD COLUMN IF NOT EXISTS promo_code VARCHAR(64) NOT NULL DEFAULT '';
+	ALTER TABLE topups ADD COLUMN IF NOT EXISTS bonus_amount INTEGER NOT NULL DEFAULT 0;
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createSubscriptionTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS plans (
+	    code VARCHAR(64) PRIMARY KEY,
+	    name VARCHAR(255) NOT NULL,
+	    price INTEGER NOT NULL CHECK (price > 0), -- per month, in cents
+	    report_allowance INTEGER NOT NULL CHECK (report_allowance > 0), -- reports per month
+	    active BOOLEAN NOT NULL DEFAULT TRUE,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	INSERT INTO plans (code, name, price, report_allowance) VALUES
+	    ('basic', 'Basic', 2000, 5),
+	    ('pro', 'Pro', 6000, 20)
+	ON CONFLICT (code) DO NOTHING;
+
+	CREATE TABLE IF NOT EXISTS subscriptions (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    plan_code VARCHAR(64) NOT NULL REFERENCES plans(code),
+	    status VARCHAR(32) NOT NULL DEFAULT 'active', -- active, past_due, expired
+	    price INTEGER NOT NULL, -- paid for the current period, in cents
+	    report_allowance INTEGER NOT NULL,
+	    reports_used INTEGER NOT NULL DEFAULT 0,
+	    current_period_start TIMESTAMP NOT NULL,
+	    current_period_end TIMESTAMP NOT NULL,
+	    cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+	    last_error TEXT NOT NULL DEFAULT '',
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- At most one live subscription per user
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_subscriptions_live_user
+	    ON subscriptions(user_id) WHERE status IN ('active', 'past_due');
+	CREATE INDEX IF NOT EXISTS idx_subscriptions_due
+	    ON subscriptions(current_period_end) WHERE status IN ('active', 'past_due');
+
+	-- Reports bought from the allowance are free purchases linked to the subscription
+	ALTER TABLE purchases ADD COLUMN IF NOT EXISTS subscription_id INTEGER REFERENCES subscriptions(id);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createWalletsTable(db *sql.DB) error {
+	query := `
+	-- Cached balance of each user account in the ledger; users.balance mirrors the RUB wallet
+	CREATE TABLE IF NOT EXISTS wallets (
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    currency VARCHAR(3) NOT NULL,
+	    balance BIGINT NOT NULL DEFAULT 0, -- in minor units
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    PRIMARY KEY (user_id, currency)
+	);
+
+	-- Balances from before wallets existed were all in RUB
+	INSERT INTO wallets (user_id, currency, balance)
+	SELECT id, 'RUB', balance FROM users
+	ON CONFLICT (user_id, currency) DO NOTHING;
+
+	ALTER TABLE products ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+	ALTER TABLE purchases ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+	ALTER TABLE refunds ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+	ALTER TABLE topups ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+
+	-- Currency of fixed promo values; percent codes apply in any currency
+	ALTER TABLE promo_codes ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+	ALTER TABLE promo_redemptions ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'RUB';
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createSessionTables(db *sql.DB) error {
+	query := `
+	-- One row per logged in device
+	CREATE TABLE IF NOT EXISTS sessions (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    user_agent TEXT NOT NULL DEFAULT '',
+	    ip VARCHAR(64) NOT NULL DEFAULT '',
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    expires_at TIMESTAMP NOT NULL, -- moved forward on every refresh
+	    revoked_at TIMESTAMP,
+	    revoke_reason VARCHAR(32) NOT NULL DEFAULT '' -- logout, revoked, reuse
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+	-- Every refresh token a session has had; all but the newest are used up
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+	    id SERIAL PRIMARY KEY,
+	    session_id INTEGER NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+	    token_hash VARCHAR(64) NOT NULL UNIQUE, -- sha256 of the token
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    used_at TIMESTAMP -- set when rotated; presenting it again means it leaked
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens(session_id);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createRevokedTokensTable(db *sql.DB) error {
+	query := `
+	-- Access tokens carry the version they were issued at; bumping it revokes them all
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
+
+	-- Single access tokens revoked before they expire
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+	    id SERIAL PRIMARY KEY,
+	    jti VARCHAR(64) NOT NULL UNIQUE,
+	    user_id INTEGER REFERENCES users(id),
+	    reason TEXT NOT NULL DEFAULT '',
+	    expires_at TIMESTAMP NOT NULL, -- when the token expires anyway and the row can go
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createSigningKeysTable(db *sql.DB) error {
+	query := `
+	-- Keys that sign access tokens; the newest one past not_before signs, all unexpired ones verify
+	CREATE TABLE IF NOT EXISTS signing_keys (
+	    kid VARCHAR(64) PRIMARY KEY,
+	    algorithm VARCHAR(16) NOT NULL, -- EdDSA or RS256
+	    private_key TEXT NOT NULL, -- PKCS #8 PEM
+	    not_before TIMESTAMP NOT NULL, -- published in the JWKS before it starts signing
+	    expires_at TIMESTAMP, -- set once replaced, after the last token it signed expires
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createPasswordResetTokensTable(db *sql.DB) error {
+	query := `
+	-- Single-use password reset tokens, stored as sha256 like refresh tokens
+	CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    token_hash VARCHAR(64) NOT NULL UNIQUE,
+	    expires_at TIMESTAMP NOT NULL,
+	    used_at TIMESTAMP, -- also set when a newer token replaces it
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createTwoFactorTables(db *sql.DB) error {
+	query := `
+	-- TOTP secret; 2FA is on once the user confirmed a code and totp_enabled_at is set
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT; -- codes of this step and older can't be replayed
+
+	-- Single-use recovery codes, stored as sha256
+	CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    code_hash VARCHAR(64) NOT NULL,
+	    used_at TIMESTAMP,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    UNIQUE (user_id, code_hash)
+	);
+
+	-- Logins that passed the password check and wait for a second factor
+	CREATE TABLE IF NOT EXISTS login_challenges (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    token_hash VARCHAR(64) NOT NULL UNIQUE,
+	    user_agent TEXT NOT NULL DEFAULT '',
+	    ip VARCHAR(64) NOT NULL DEFAULT '',
+	    attempts INTEGER NOT NULL DEFAULT 0,
+	    expires_at TIMESTAMP NOT NULL,
+	    completed_at TIMESTAMP,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Login as entered, so wrong codes count against it like wrong passwords
+	ALTER TABLE login_challenges ADD COLUMN IF NOT EXISTS login VARCHAR(255) NOT NULL DEFAULT '';
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createLoginThrottlesTable(db *sql.DB) error {
+	query := `
+	-- Failed logins per login and per client IP, and lockouts they caused
+	CREATE TABLE IF NOT EXISTS login_throttles (
+	    scope VARCHAR(16) NOT NULL, -- login or ip
+	    key VARCHAR(255) NOT NULL,
+	    failures INTEGER NOT NULL DEFAULT 0, -- recent failures, reset by a lockout or success
+	    last_failure_at TIMESTAMP NOT NULL,
+	    locked_until TIMESTAMP,
+	    PRIMARY KEY (scope, key)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_login_throttles_locked_until ON login_throttles(locked_until);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createUserRoleColumns(db *sql.DB) error {
+	query := `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'user'; -- user, support or admin
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP; -- disabled accounts can't log in
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_reason TEXT NOT NULL DEFAULT '';
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createAPIKeysTable(db *sql.DB) error {
+	query := `
+	-- Long-lived keys acting for a user within their scopes; only the sha256 of a key is stored
+	CREATE TABLE IF NOT EXISTS api_keys (
+	    id SERIAL PRIMARY KEY,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    name VARCHAR(100) NOT NULL,
+	    prefix VARCHAR(16) NOT NULL, -- start of the key, to tell keys apart
+	    key_hash VARCHAR(64) NOT NULL UNIQUE,
+	    scopes TEXT[] NOT NULL,
+	    expires_at TIMESTAMP,
+	    last_used_at TIMESTAMP,
+	    last_used_ip VARCHAR(64) NOT NULL DEFAULT '',
+	    revoked_at TIMESTAMP,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_api_keys_user_id ON api_keys(user_id);
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createIdentitiesTable(db *sql.DB) error {
+	query := `
+	-- Accounts at OpenID providers that log in as a user, one per provider
+	CREATE TABLE IF NOT EXISTS user_identities (
+	    provider VARCHAR(50) NOT NULL,
+	    subject VARCHAR(255) NOT NULL,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    email VARCHAR(255) NOT NULL DEFAULT '',
+	    last_login_at TIMESTAMP,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    PRIMARY KEY (provider, subject),
+	    UNIQUE (user_id, provider)
+	);
+
+	-- Logins in progress at a provider, looked up by the sha256 of the state parameter
+	CREATE TABLE IF NOT EXISTS oidc_login_states (
+	    id SERIAL PRIMARY KEY,
+	    state_hash VARCHAR(64) NOT NULL UNIQUE,
+	    provider VARCHAR(50) NOT NULL,
+	    nonce VARCHAR(64) NOT NULL,
+	    code_verifier VARCHAR(128) NOT NULL,
+	    link_user_id INTEGER REFERENCES users(id), -- set when a logged-in user links the identity
+	    expires_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_oidc_login_states_expires_at ON oidc_login_states(expires_at);
+
+	-- sha256 of the cookie set on the browser that started the login
+	ALTER TABLE oidc_login_states ADD COLUMN IF NOT EXISTS browser_hash VARCHAR(64) NOT NULL DEFAULT '';
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createUserEmailColumns(db *sql.DB) error {
+	query := `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP;
+
+	-- Only verified emails are unique, so nobody can hold an address they don't own
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_users_verified_email ON users(LOWER(email)) WHERE email_verified_at IS NOT NULL;
+`
+	_, err := db.Exec(query)
+	return err
+}
+
+func createReportJobsTable(db *sql.DB) error {
+	query := `
+	-- Reports waiting for or going through generation; the report itself lives in MongoDB
+	CREATE TABLE IF NOT EXISTS report_jobs (
+	    id SERIAL PRIMARY KEY,
+	    report_id VARCHAR(255) NOT NULL UNIQUE,
+	    user_id INTEGER NOT NULL REFERENCES users(id),
+	    product_code VARCHAR(64) NOT NULL,
+	    input JSONB NOT NULL,
+	    status VARCHAR(16) NOT NULL DEFAULT 'queued', -- queued, processing, ready, failed
+	    attempts INTEGER NOT NULL DEFAULT 0,
+	    last_error TEXT NOT NULL DEFAULT '',
+	    lease_token VARCHAR(64) NOT NULL DEFAULT '', -- held by the worker processing the job
+	    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, -- when queued: due time; when processing: lease expiry
+	    started_at TIMESTAMP,
+	    finished_at TIMESTAMP,
+	    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_report_jobs_due ON report_jobs(next_attempt_at) WHERE status IN ('queued', 'processing');
+	CREATE INDEX IF NOT EXISTS idx_report_jobs_user_id ON report_jobs(user_id);
 `
 	_, err := db.Exec(query)
 	return err
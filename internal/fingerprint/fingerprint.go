@@ -0,0 +1,123 @@
+// Package fingerprint parses and validates digital-fingerprint analysis
+// results (models.FingerprintResult).
+//
+// Every result carries its schema_version. Parse accepts any version from 1
+// to CurrentVersion and upgrades older documents step by step through the
+// upgrades below, so the rest of the service only deals with the current
+// version. To change the schema:
+//  1. change models.FingerprintResult and Validate,
+//  2. bump CurrentVersion,
+//  3. add upgrades[CurrentVersion-1], turning a document of the previous
+//     version into the new one.
+//
+// Stored results keep the document they were ingested from and are parsed
+// again on startup, see service.FingerprintService.MigrateStored.
+package fingerprint
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"zl0y-billing/internal/models"
+)
+
+// CurrentVersion is the schema version results are stored and served in.
+const CurrentVersion = 1
+
+// upgrades[n] turns a version n document, as decoded by encoding/json, into
+// a version n+1 document. schema_version is bumped by Parse.
+var upgrades = map[int]func(doc map[string]any) error{}
+
+// ValidationError lists everything wrong with a rejected result.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid fingerprint"
+}
+
+// Parse decodes a result of any supported schema version, upgrades it to
+// CurrentVersion and validates it. Unknown fields are rejected, so typos in
+// analyzer output don't go unnoticed.
+func Parse(data []byte) (*models.FingerprintResult, error) {
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil || doc == nil {
+		return nil, &ValidationError{Problems: []string{"not a JSON object"}}
+	}
+
+	version, ok := doc["schema_version"].(float64)
+	if !ok || version != math.Trunc(version) {
+		return nil, &ValidationError{Problems: []string{"schema_version: must be an integer"}}
+	}
+	if version < 1 || version > CurrentVersion {
+		return nil, &ValidationError{Problems: []string{
+			fmt.Sprintf("schema_version: %v is not supported, the current version is %d", version, CurrentVersion),
+		}}
+	}
+
+	for v := int(version); v < CurrentVersion; v++ {
+		upgrade, ok := upgrades[v]
+		if !ok {
+			return nil, fmt.Errorf("no fingerprint upgrade from version %d", v)
+		}
+		if err := upgrade(doc); err != nil {
+			return nil, &ValidationError{Problems: []string{fmt.Sprintf("upgrading from version %d: %v", v, err)}}
+		}
+		doc["schema_version"] = v + 1
+	}
+
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode upgraded fingerprint: %w", err)
+	}
+
+	var result models.FingerprintResult
+	decoder := json.NewDecoder(bytes.NewReader(upgraded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, &ValidationError{Problems: []string{err.Error()}}
+	}
+
+	normalize(&result)
+	if err := Validate(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// RiskLevel buckets a risk score.
+func RiskLevel(score int) string {
+	switch {
+	case score >= 70:
+		return models.RiskHigh
+	case score >= 30:
+		return models.RiskMedium
+	default:
+		return models.RiskLow
+	}
+}
+
+// normalize fills in derived fields and turns missing lists into empty ones,
+// so clients always get arrays.
+func normalize(r *models.FingerprintResult) {
+	r.RiskLevel = RiskLevel(r.RiskScore)
+
+	if r.Browser.Languages == nil {
+		r.Browser.Languages = []string{}
+	}
+	if r.Signals == nil {
+		r.Signals = []models.FingerprintSignal{}
+	}
+	if r.Leaks == nil {
+		r.Leaks = []models.FingerprintLeak{}
+	}
+	for i := range r.Leaks {
+		if r.Leaks[i].DataClasses == nil {
+			r.Leaks[i].DataClasses = []string{}
+		}
+	}
+}
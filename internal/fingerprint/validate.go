@@ -0,0 +1,149 @@
+package fingerprint
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const (
+	maxTextLength = 512
+	maxSignals    = 100
+	maxLeaks      = 100
+	maxLanguages  = 32
+
+	// clockSkew is how far in the future analyzed_at may be
+	clockSkew = 5 * time.Minute
+)
+
+var codePattern = regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+
+var (
+	deviceTypes      = []string{models.DeviceTypeDesktop, models.DeviceTypeMobile, models.DeviceTypeTablet, models.DeviceTypeOther}
+	severities       = []string{models.RiskLow, models.RiskMedium, models.RiskHigh}
+	signalCategories = []string{
+		models.SignalCategoryNetwork,
+		models.SignalCategoryDevice,
+		models.SignalCategoryBrowser,
+		models.SignalCategoryBehavior,
+		models.SignalCategoryIdentity,
+	}
+)
+
+// Validate checks a current version result and reports every problem found.
+func Validate(r *models.FingerprintResult) error {
+	v := &validator{}
+
+	if r.SchemaVersion != CurrentVersion {
+		v.addf("schema_version", "must be %d", CurrentVersion)
+	}
+	if r.AnalyzedAt.IsZero() {
+		v.add("analyzed_at", "is required")
+	} else if r.AnalyzedAt.After(time.Now().Add(clockSkew)) {
+		v.add("analyzed_at", "is in the future")
+	}
+
+	v.text("browser.name", r.Browser.Name)
+	v.text("browser.version", r.Browser.Version)
+	v.text("browser.user_agent", r.Browser.UserAgent)
+	v.text("browser.timezone", r.Browser.Timezone)
+	if len(r.Browser.Languages) > maxLanguages {
+		v.addf("browser.languages", "must have at most %d entries", maxLanguages)
+	}
+	for i, lang := range r.Browser.Languages {
+		if lang == "" || len(lang) > 35 {
+			v.add(fmt.Sprintf("browser.languages[%d]", i), "must be a language tag")
+		}
+	}
+
+	v.oneOf("device.type", r.Device.Type, deviceTypes)
+	v.text("device.os", r.Device.OS)
+	v.text("device.os_version", r.Device.OSVersion)
+	v.between("device.screen_width", r.Device.ScreenWidth, 0, 100_000)
+	v.between("device.screen_height", r.Device.ScreenHeight, 0, 100_000)
+	if r.Device.PixelRatio < 0 || r.Device.PixelRatio > 16 {
+		v.add("device.pixel_ratio", "must be between 0 and 16")
+	}
+	v.between("device.cpu_cores", r.Device.CPUCores, 0, 1024)
+	v.between("device.touch_points", r.Device.TouchPoints, 0, 256)
+
+	v.between("risk_score", r.RiskScore, 0, 100)
+
+	if len(r.Signals) > maxSignals {
+		v.addf("signals", "must have at most %d entries", maxSignals)
+	}
+	for i, s := range r.Signals {
+		field := fmt.Sprintf("signals[%d]", i)
+		v.code(field+".code", s.Code)
+		v.oneOf(field+".category", s.Category, signalCategories)
+		v.oneOf(field+".severity", s.Severity, severities)
+		v.text(field+".description", s.Description)
+	}
+
+	if len(r.Leaks) > maxLeaks {
+		v.addf("leaks", "must have at most %d entries", maxLeaks)
+	}
+	for i, l := range r.Leaks {
+		field := fmt.Sprintf("leaks[%d]", i)
+		if l.Source == "" {
+			v.add(field+".source", "is required")
+		}
+		v.text(field+".source", l.Source)
+		v.text(field+".identifier", l.Identifier)
+		if l.BreachedAt != nil && !r.AnalyzedAt.IsZero() && l.BreachedAt.After(r.AnalyzedAt) {
+			v.add(field+".breached_at", "is after analyzed_at")
+		}
+		if len(l.DataClasses) == 0 {
+			v.add(field+".data_classes", "must not be empty")
+		}
+		for j, class := range l.DataClasses {
+			v.code(fmt.Sprintf("%s.data_classes[%d]", field, j), class)
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) add(field, problem string) {
+	v.problems = append(v.problems, field+": "+problem)
+}
+
+func (v *validator) addf(field, format string, args ...any) {
+	v.add(field, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) text(field, value string) {
+	if len(value) > maxTextLength {
+		v.addf(field, "must be at most %d bytes", maxTextLength)
+	}
+}
+
+func (v *validator) code(field, value string) {
+	if len(value) > 64 || !codePattern.MatchString(value) {
+		v.add(field, "must be snake_case")
+	}
+}
+
+func (v *validator) between(field string, value, low, high int) {
+	if value < low || value > high {
+		v.addf(field, "must be between %d and %d", low, high)
+	}
+}
+
+func (v *validator) oneOf(field, value string, allowed []string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.addf(field, "must be one of %v", allowed)
+}
@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminHandler struct {
+	adminService      *service.AdminService
+	refundService     *service.RefundService
+	userService       *service.UserService
+	revocationService *service.RevocationService
+	throttleService   *service.LoginThrottleService
+}
+
+func NewAdminHandler(adminService *service.AdminService, refundService *service.RefundService, userService *service.UserService, revocationService *service.RevocationService, throttleService *service.LoginThrottleService) *AdminHandler {
+	return &AdminHandler{
+		adminService:      adminService,
+		refundService:     refundService,
+		userService:       userService,
+		revocationService: revocationService,
+		throttleService:   throttleService,
+	}
+}
+
+// FindUsers looks users up by a part of their login, ?login=.
+func (h *AdminHandler) FindUsers(c *gin.Context) {
+	query := c.Query("login")
+	if query == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Query parameter login is required",
+		})
+		return
+	}
+
+	response, err := h.adminService.FindUsers(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to find users",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetUser returns the user with their balances.
+func (h *AdminHandler) GetUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	response, err := h.adminService.GetUser(userID)
+	if err != nil {
+		writeAdminError(c, err, "Failed to get user")
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *AdminHandler) GetUserPurchases(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	// Parse pagination parameters
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil {
+		limit = 20
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil {
+		offset = 0
+	}
+
+	response, err := h.adminService.GetUserPurchases(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get purchases",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *AdminHandler) GetUserTransactions(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	// Parse pagination parameters
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil {
+		limit = 20
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil {
+		offset = 0
+	}
+
+	response, err := h.userService.GetUserTransactions(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get transactions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// AdjustBalance credits or debits a wallet, e.g. to compensate a user.
+func (h *AdminHandler) AdjustBalance(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	var req models.AdjustBalanceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	currency, err := money.ParseCurrency(req.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Unsupported currency",
+		})
+		return
+	}
+
+	balance, err := h.adminService.AdjustBalance(c.GetInt("user_id"), userID, money.New(req.Amount, currency), req.Reason)
+	if err != nil {
+		writeAdminError(c, err, "Failed to adjust balance")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Balance adjusted successfully",
+		"balance": balance,
+	})
+}
+
+// DisableUser keeps the user from logging in and logs them out everywhere.
+func (h *AdminHandler) DisableUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	var req models.DisableUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err := h.adminService.DisableUser(c.GetInt("user_id"), userID, req.Reason); err != nil {
+		writeAdminError(c, err, "Failed to disable user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User disabled successfully",
+	})
+}
+
+func (h *AdminHandler) EnableUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	if err := h.adminService.EnableUser(c.GetInt("user_id"), userID); err != nil {
+		writeAdminError(c, err, "Failed to enable user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User enabled successfully",
+	})
+}
+
+func (h *AdminHandler) SetRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	var req models.SetRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err := h.adminService.SetRole(c.GetInt("user_id"), userID, req.Role); err != nil {
+		writeAdminError(c, err, "Failed to set role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Role changed successfully",
+	})
+}
+
+func writeAdminError(c *gin.Context, err error, fallback string) {
+	switch err.Error() {
+	case "user not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "User not found",
+		})
+	case "invalid amount":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Amount must not be zero",
+		})
+	case "invalid role":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Role must be user, support or admin",
+		})
+	case "insufficient balance":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Adjustment would take the balance below zero",
+		})
+	case "cannot change own account":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Admins can't change their own account",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: fallback,
+		})
+	}
+}
+
+func (h *AdminHandler) RefundPurchase(c *gin.Context) {
+	purchaseID, err := strconv.Atoi(c.Param("purchase_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid purchase ID",
+		})
+		return
+	}
+
+	var req models.RefundPurchaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	purchase, refund, err := h.refundService.RefundPurchase(purchaseID, req.Amount, req.Reason, models.RefundSourceAdmin)
+	if err != nil {
+		switch err.Error() {
+		case "purchase not found":
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Purchase not found",
+			})
+		case "purchase is not refundable":
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "Only unlocked purchases can be refunded",
+			})
+		case "refund exceeds purchase amount", "invalid amount":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Refund amount exceeds what is left of the purchase",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to refund purchase",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Purchase refunded successfully",
+		"purchase": purchase,
+		"refund":   refund,
+	})
+}
+
+func (h *AdminHandler) UnflagUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	if err := h.userService.UnflagUser(userID); err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "User not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to unflag user",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "User unflagged successfully",
+	})
+}
+
+// RevokeUserTokens logs the user out of every device at once.
+func (h *AdminHandler) RevokeUserTokens(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid user ID",
+		})
+		return
+	}
+
+	// The body is optional
+	var req models.RevokeTokensRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "admin"
+	}
+
+	if err := h.revocationService.RevokeUserTokens(userID, req.Reason); err != nil {
+		if err.Error() == "user not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "User not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to revoke tokens",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "All tokens of the user have been revoked",
+	})
+}
+
+// RevokeToken revokes a single access token by its jti.
+func (h *AdminHandler) RevokeToken(c *gin.Context) {
+	var req models.RevokeTokensRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = "admin"
+	}
+
+	if err := h.revocationService.RevokeToken(c.Param("jti"), nil, req.Reason); err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to revoke token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Token has been revoked",
+	})
+}
+
+// GetLockouts lists the logins and IPs locked out after failed logins.
+func (h *AdminHandler) GetLockouts(c *gin.Context) {
+	response, err := h.throttleService.GetLockouts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get lockouts",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ClearLockout lifts the lockout of a login or IP and forgets its failed logins.
+func (h *AdminHandler) ClearLockout(c *gin.Context) {
+	if err := h.throttleService.ClearLockout(c.Param("scope"), c.Param("key")); err != nil {
+		switch err.Error() {
+		case "invalid scope":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Scope must be login or ip",
+			})
+		case "lockout not found":
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Lockout not found",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to clear lockout",
+			})
+		}
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
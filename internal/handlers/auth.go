@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"zl0y-billing/internal/models"
@@ -40,7 +43,7 @@ func (h *AuthHandler) Register(c *gin.Context) {
 	}
 
 	// Register user
-	response, err := h.authService.Register(req.Login, req.Password)
+	response, err := h.authService.Register(req.Login, req.Password, strings.TrimSpace(req.Email), c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		if strings.Contains(err.Error(), "already exists") {
 			c.JSON(http.StatusConflict, models.ErrorResponse{
@@ -48,6 +51,18 @@ func (h *AuthHandler) Register(c *gin.Context) {
 			})
 			return
 		}
+		if err.Error() == "email taken" {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "Email is already in use",
+			})
+			return
+		}
+		if err.Error() == "invalid login" {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Login must not contain @, set the email separately",
+			})
+			return
+		}
 
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to register user",
@@ -68,13 +83,304 @@ func (h *AuthHandler) Login(c *gin.Context) {
 	}
 
 	// Login user
-	response, err := h.authService.Login(req.Login, req.Password)
+	response, challenge, err := h.authService.Login(req.Login, req.Password, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
+		var blocked *service.LoginBlockedError
+		if errors.As(err, &blocked) {
+			writeLoginBlocked(c, blocked)
+			return
+		}
+
+		if err.Error() == "account disabled" {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Account is disabled",
+			})
+			return
+		}
+
 		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
 			Error: "Invalid credentials",
 		})
 		return
 	}
 
+	// With 2FA on the login continues at /api/auth/login/2fa
+	if challenge != nil {
+		c.JSON(http.StatusOK, challenge)
+		return
+	}
+
 	c.JSON(http.StatusOK, response)
 }
+
+// CompleteLogin takes the second factor for a login challenge and issues the tokens.
+func (h *AuthHandler) CompleteLogin(c *gin.Context) {
+	var req models.CompleteLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	response, err := h.authService.CompleteLogin(req.ChallengeToken, req.Code, c.ClientIP())
+	if err != nil {
+		var blocked *service.LoginBlockedError
+		if errors.As(err, &blocked) {
+			writeLoginBlocked(c, blocked)
+			return
+		}
+
+		switch err.Error() {
+		case "invalid challenge token":
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+				Error: "Invalid or expired challenge, log in again",
+			})
+		case "invalid code":
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+				Error: "Invalid code",
+			})
+		case "account disabled":
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Account is disabled",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to log in",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Refresh rotates the refresh token and issues a new access token.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req models.RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	response, err := h.authService.Refresh(req.RefreshToken)
+	if err != nil {
+		switch err.Error() {
+		case "invalid refresh token":
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+				Error: "Invalid or expired refresh token",
+			})
+		case "refresh token reused":
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+				Error: "Refresh token was already used, the session has been revoked",
+			})
+		case "account disabled":
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Account is disabled",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to refresh token",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req models.RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err := h.authService.Logout(req.RefreshToken); err != nil {
+		if err.Error() == "invalid refresh token" {
+			c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+				Error: "Invalid refresh token",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to log out",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ChangePassword sets a new password and returns tokens of a new session;
+// all other sessions are logged out.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	response, err := h.authService.ChangePassword(userID.(int), req.CurrentPassword, req.NewPassword, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		switch err.Error() {
+		case "invalid current password":
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Current password is incorrect",
+			})
+		case "user not found":
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "User not found",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to change password",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// RequestPasswordReset answers 202 whether or not the login exists, and 429
+// to logins and IPs making too many requests.
+func (h *AuthHandler) RequestPasswordReset(c *gin.Context) {
+	var req models.PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err := h.authService.RequestPasswordReset(strings.TrimSpace(req.Login), c.ClientIP()); err != nil {
+		var blocked *service.LoginBlockedError
+		if errors.As(err, &blocked) {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(blocked.RetryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, models.ErrorResponse{
+				Error: "Too many password reset requests, try again later",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to request password reset",
+		})
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req models.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err := h.authService.ResetPassword(req.Token, req.NewPassword); err != nil {
+		if err.Error() == "invalid reset token" {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid or expired reset token",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to reset password",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *AuthHandler) GetSessions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	// Tokens issued before sessions existed have none
+	sessionID := c.GetInt("session_id")
+
+	response, err := h.authService.GetSessions(userID.(int), sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get sessions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	sessionID, err := strconv.Atoi(c.Param("session_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid session ID",
+		})
+		return
+	}
+
+	if err := h.authService.RevokeSession(userID.(int), sessionID); err != nil {
+		if err.Error() == "session not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Session not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to revoke session",
+		})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// writeLoginBlocked answers a login refused by the login throttle.
+func writeLoginBlocked(c *gin.Context, blocked *service.LoginBlockedError) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(blocked.RetryAfter.Seconds()))))
+	if blocked.Reason == "account locked" {
+		c.JSON(http.StatusLocked, models.ErrorResponse{
+			Error: "Account is temporarily locked after too many failed logins",
+		})
+		return
+	}
+	c.JSON(http.StatusTooManyRequests, models.ErrorResponse{
+		Error: "Too many failed logins, try again later",
+	})
+}
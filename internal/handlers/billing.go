@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BillingHandler struct {
+	billingService *service.BillingService
+}
+
+func NewBillingHandler(billingService *service.BillingService) *BillingHandler {
+	return &BillingHandler{
+		billingService: billingService,
+	}
+}
+
+func (h *BillingHandler) CreateTopUp(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.CreateTopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	currency, err := money.ParseCurrency(req.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Unsupported currency",
+		})
+		return
+	}
+
+	topUp, err := h.billingService.CreateTopUp(userID.(int), money.New(req.Amount, currency), req.PromoCode)
+	if err != nil {
+		if writePromoError(c, err) {
+			return
+		}
+
+		switch err.Error() {
+		case "unsupported currency":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Unsupported currency",
+			})
+		case "invalid amount":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Top-up amount is out of the allowed range",
+			})
+		case "account flagged":
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Account is flagged, please contact support",
+			})
+		case "top-ups disabled":
+			c.JSON(http.StatusServiceUnavailable, models.ErrorResponse{
+				Error: "Top-ups are not available",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to create top-up",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, topUp)
+}
+
+// GetExchangeRates lists how many units of the base currency one unit of each currency is worth.
+func (h *BillingHandler) GetExchangeRates(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"base":  money.Base,
+		"rates": h.billingService.ExchangeRates().Quotes(),
+	})
+}
+
+func (h *BillingHandler) GetTopUp(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	topUpID, err := strconv.Atoi(c.Param("topup_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid top-up ID",
+		})
+		return
+	}
+
+	topUp, err := h.billingService.GetTopUp(userID.(int), topUpID)
+	if err != nil {
+		if err.Error() == "top-up not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Top-up not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get top-up",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, topUp)
+}
+
+// ProviderCallback receives payment notifications from a payment provider.
+func (h *BillingHandler) ProviderCallback(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Failed to read request body",
+		})
+		return
+	}
+
+	topUp, err := h.billingService.HandleCallback(c.Param("provider"), body, c.Request.Header)
+	if err != nil {
+		writeCallbackError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": topUp.Status,
+	})
+}
+
+func writeCallbackError(c *gin.Context, err error) {
+	switch err.Error() {
+	case "unknown provider":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Unknown payment provider",
+		})
+	case "invalid callback":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid callback",
+		})
+	case "top-up not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Top-up not found",
+		})
+	case "top-up already failed":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Top-up already failed",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to process callback",
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EmailHandler struct {
+	emailService *service.EmailService
+}
+
+func NewEmailHandler(emailService *service.EmailService) *EmailHandler {
+	return &EmailHandler{
+		emailService: emailService,
+	}
+}
+
+func (h *EmailHandler) GetEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	response, err := h.emailService.GetEmail(userID.(int))
+	if err != nil {
+		writeEmailError(c, err, "Failed to get email")
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// SetEmail changes the email and sends a verification link to the new address.
+func (h *EmailHandler) SetEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.SetEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	response, err := h.emailService.SetEmail(userID.(int), req.Email)
+	if err != nil {
+		writeEmailError(c, err, "Failed to set email")
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *EmailHandler) RemoveEmail(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	if err := h.emailService.RemoveEmail(userID.(int)); err != nil {
+		writeEmailError(c, err, "Failed to remove email")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// SendVerification sends a new verification link for the current email.
+func (h *EmailHandler) SendVerification(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	if err := h.emailService.SendVerification(userID.(int)); err != nil {
+		writeEmailError(c, err, "Failed to send verification link")
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// Verify is the verification link itself, so it is a GET.
+func (h *EmailHandler) Verify(c *gin.Context) {
+	if err := h.emailService.Verify(c.Query("token")); err != nil {
+		writeEmailError(c, err, "Failed to verify email")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Email verified successfully",
+	})
+}
+
+func writeEmailError(c *gin.Context, err error, fallback string) {
+	switch err.Error() {
+	case "email taken":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Email is already in use",
+		})
+	case "no email":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Set an email first",
+		})
+	case "email already verified":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Email is already verified",
+		})
+	case "invalid verification token":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid verification link",
+		})
+	case "verification token expired":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Verification link has expired, request a new one",
+		})
+	case "user not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "User not found",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: fallback,
+		})
+	}
+}
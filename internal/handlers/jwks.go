@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"net/http"
+
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JWKSHandler struct {
+	keyService *service.KeyService
+}
+
+func NewJWKSHandler(keyService *service.KeyService) *JWKSHandler {
+	return &JWKSHandler{
+		keyService: keyService,
+	}
+}
+
+// GetJWKS publishes the public keys access tokens are verified with. New keys
+// appear well before they sign, so verifiers may cache the set briefly.
+func (h *JWKSHandler) GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keyService.JWKS())
+}
@@ -1,21 +1,39 @@
 package handlers
 
 import (
+	"errors"
+	"io"
 	"net/http"
+	"net/url"
 
+	"zl0y-billing/internal/fingerprint"
 	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/oidc"
 	"zl0y-billing/internal/repository"
+	"zl0y-billing/internal/service"
 
 	"github.com/gin-gonic/gin"
 )
 
 type MockHandler struct {
-	reportRepo *repository.ReportRepository
+	reportRepo     *repository.ReportRepository
+	billingService *service.BillingService
+	catalogService *service.CatalogService
+	fakeProvider   *service.FakeProvider
+	mockOIDC       *oidc.MockServer
+	contentService *service.ReportContentService
+	fingerprints   *service.FingerprintService
 }
 
-func NewMockHandler(reportRepo *repository.ReportRepository) *MockHandler {
+func NewMockHandler(reportRepo *repository.ReportRepository, billingService *service.BillingService, catalogService *service.CatalogService, fakeProvider *service.FakeProvider, mockOIDC *oidc.MockServer, contentService *service.ReportContentService, fingerprints *service.FingerprintService) *MockHandler {
 	return &MockHandler{
-		reportRepo: reportRepo,
+		reportRepo:     reportRepo,
+		billingService: billingService,
+		catalogService: catalogService,
+		fakeProvider:   fakeProvider,
+		mockOIDC:       mockOIDC,
+		contentService: contentService,
+		fingerprints:   fingerprints,
 	}
 }
 
@@ -28,7 +46,21 @@ func (h *MockHandler) CreateReport(c *gin.Context) {
 		return
 	}
 
-	report, err := h.reportRepo.CreateReport(req.ClientGeneratedID)
+	if err := h.catalogService.ValidateProductCode(req.ProductCode); err != nil {
+		switch err.Error() {
+		case "product not found", "product unavailable":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Unknown product code",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to create report",
+			})
+		}
+		return
+	}
+
+	report, err := h.reportRepo.CreateReport(req.ClientGeneratedID, req.ProductCode, req.Title, req.Target)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 			Error: "Failed to create report",
@@ -42,3 +74,184 @@ func (h *MockHandler) CreateReport(c *gin.Context) {
 		"report":    report,
 	})
 }
+
+// UploadReportContent plays the report generator: it stores the report's
+// payload from the multipart "content" file, with the free "preview" text.
+// Purchased reports are refused, so what a user paid for can't change.
+func (h *MockHandler) UploadReportContent(c *gin.Context) {
+	if !h.checkNotPurchased(c, c.Param("report_id")) {
+		return
+	}
+
+	file, err := c.FormFile("content")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "content file is required",
+		})
+		return
+	}
+
+	content, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Failed to read content",
+		})
+		return
+	}
+	defer content.Close()
+
+	stored, err := h.contentService.StoreContent(c.Request.Context(), c.Param("report_id"),
+		file.Header.Get("Content-Type"), content, c.PostForm("preview"))
+	if err != nil {
+		writeReportContentError(c, err, "Failed to store report content")
+		return
+	}
+
+	c.JSON(http.StatusOK, stored)
+}
+
+// IngestFingerprint plays the analyzer: it stores the fingerprint result in
+// the request body, of any supported schema version, on the report. As with
+// content, purchased reports are refused.
+func (h *MockHandler) IngestFingerprint(c *gin.Context) {
+	if !h.checkNotPurchased(c, c.Param("report_id")) {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, service.MaxFingerprintSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Failed to read fingerprint",
+		})
+		return
+	}
+
+	result, err := h.fingerprints.Ingest(c.Param("report_id"), body)
+	if err != nil {
+		var invalid *fingerprint.ValidationError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusUnprocessableEntity, models.ValidationErrorResponse{
+				Error:    "Invalid fingerprint result",
+				Problems: invalid.Problems,
+			})
+			return
+		}
+
+		switch err.Error() {
+		case "report not found":
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Report not found",
+			})
+		case "fingerprint too large":
+			c.JSON(http.StatusRequestEntityTooLarge, models.ErrorResponse{
+				Error: "Fingerprint result is too large",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to store fingerprint",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// CompletePayment plays the fake payment provider: it sends the callback the
+// provider would send once the user paid (or failed to pay).
+func (h *MockHandler) CompletePayment(c *gin.Context) {
+	var req models.CompletePaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	body, headers := h.fakeProvider.Callback(c.Param("payment_id"), req.Status, req.Reason)
+
+	topUp, err := h.billingService.HandleCallback(h.fakeProvider.Name(), body, headers)
+	if err != nil {
+		writeCallbackError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, topUp)
+}
+
+// checkNotPurchased answers 404 or 409 and returns false unless the report
+// exists and hasn't been purchased.
+func (h *MockHandler) checkNotPurchased(c *gin.Context, reportID string) bool {
+	report, err := h.reportRepo.GetReportByID(reportID)
+	if err != nil {
+		if err.Error() == "report not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Report not found",
+			})
+			return false
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get report",
+		})
+		return false
+	}
+
+	if report.IsPurchased {
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Report is already purchased",
+		})
+		return false
+	}
+
+	return true
+}
+
+// OIDCDiscovery serves the mock OpenID provider's discovery document.
+func (h *MockHandler) OIDCDiscovery(c *gin.Context) {
+	c.JSON(http.StatusOK, h.mockOIDC.Metadata())
+}
+
+func (h *MockHandler) OIDCJWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, h.mockOIDC.JWKS())
+}
+
+// OIDCAuthorize logs in the user named by login_hint straight away and
+// redirects back to the client with a code.
+func (h *MockHandler) OIDCAuthorize(c *gin.Context) {
+	redirect, err := h.mockOIDC.Authorize(c.Request.URL.Query())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirect)
+}
+
+// OIDCToken redeems a code; errors follow the OAuth format rather than ours.
+func (h *MockHandler) OIDCToken(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+		return
+	}
+
+	clientID, _, ok := c.Request.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+	}
+
+	response, err := h.mockOIDC.Token(c.Request.PostForm, clientID)
+	if err != nil {
+		var tokenErr *oidc.MockTokenError
+		if errors.As(err, &tokenErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": tokenErr.Code})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
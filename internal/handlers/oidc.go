@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oidcBrowserCookie holds the browser secret of a login in progress, see
+// OIDCService.Start.
+const oidcBrowserCookie = "oidc_browser"
+
+type OIDCHandler struct {
+	oidcService   *service.OIDCService
+	secureCookies bool // set the cookie for HTTPS only
+}
+
+func NewOIDCHandler(oidcService *service.OIDCService, secureCookies bool) *OIDCHandler {
+	return &OIDCHandler{
+		oidcService:   oidcService,
+		secureCookies: secureCookies,
+	}
+}
+
+func (h *OIDCHandler) ListProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, h.oidcService.Providers())
+}
+
+// Start returns the provider URL to send the user to. login_hint is passed
+// on to the provider.
+func (h *OIDCHandler) Start(c *gin.Context) {
+	response, browserSecret, err := h.oidcService.Start(c.Request.Context(), c.Param("provider"), c.Query("login_hint"), nil)
+	if err != nil {
+		writeOIDCError(c, err, "Failed to start login")
+		return
+	}
+
+	h.setBrowserCookie(c, browserSecret, int(h.oidcService.StateTTL().Seconds()))
+	c.JSON(http.StatusOK, response)
+}
+
+// StartLink is Start for linking an identity to the logged-in user.
+func (h *OIDCHandler) StartLink(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	linkUserID := userID.(int)
+	response, browserSecret, err := h.oidcService.Start(c.Request.Context(), c.Param("provider"), c.Query("login_hint"), &linkUserID)
+	if err != nil {
+		writeOIDCError(c, err, "Failed to start linking")
+		return
+	}
+
+	h.setBrowserCookie(c, browserSecret, int(h.oidcService.StateTTL().Seconds()))
+	c.JSON(http.StatusOK, response)
+}
+
+// Callback is where the provider sends the user back. It issues the tokens
+// like a login, or reports the identity linked; linking needs the access
+// token of the user who started it. Either way the browser must be the one
+// that started the login.
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	if providerError := c.Query("error"); providerError != "" {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Login at the provider failed: " + providerError,
+		})
+		return
+	}
+
+	if c.Query("state") == "" || c.Query("code") == "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "state and code are required",
+		})
+		return
+	}
+
+	browserSecret, _ := c.Cookie(oidcBrowserCookie)
+	h.setBrowserCookie(c, "", -1)
+
+	// API keys can't manage the account, so they can't link identities either
+	var currentUserID *int
+	if userID, exists := c.Get("user_id"); exists {
+		if _, isAPIKey := c.Get("api_key_id"); !isAPIKey {
+			id := userID.(int)
+			currentUserID = &id
+		}
+	}
+
+	result, err := h.oidcService.Callback(c.Request.Context(), c.Param("provider"), c.Query("state"), browserSecret, c.Query("code"),
+		c.Request.UserAgent(), c.ClientIP(), currentUserID)
+	if err != nil {
+		writeOIDCError(c, err, "Failed to log in")
+		return
+	}
+
+	switch {
+	case result.Linked != nil:
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Identity linked successfully",
+			"identity": result.Linked,
+		})
+	case result.Challenge != nil:
+		// With 2FA on the login continues at /api/auth/login/2fa
+		c.JSON(http.StatusOK, result.Challenge)
+	default:
+		c.JSON(http.StatusOK, result.Auth)
+	}
+}
+
+func (h *OIDCHandler) GetIdentities(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	response, err := h.oidcService.GetIdentities(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get identities",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *OIDCHandler) Unlink(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	if err := h.oidcService.Unlink(userID.(int), c.Param("provider")); err != nil {
+		writeOIDCError(c, err, "Failed to unlink identity")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// setBrowserCookie sets the browser secret cookie for the callback, or
+// deletes it with a negative maxAge.
+func (h *OIDCHandler) setBrowserCookie(c *gin.Context, browserSecret string, maxAge int) {
+	// Lax still sends the cookie on the provider's redirect back
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcBrowserCookie, browserSecret, maxAge, "/api/auth/oidc", "", h.secureCookies, true)
+}
+
+func writeOIDCError(c *gin.Context, err error, fallback string) {
+	switch err.Error() {
+	case "unknown provider":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Unknown identity provider",
+		})
+	case "provider unavailable":
+		c.JSON(http.StatusBadGateway, models.ErrorResponse{
+			Error: "Identity provider is unavailable",
+		})
+	case "invalid state":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid or expired login, start again",
+		})
+	case "link requires login":
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Log in as the user who started linking, then start again",
+		})
+	case "provider login failed":
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "Login at the provider could not be verified",
+		})
+	case "identity already linked":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "This identity or provider is already linked",
+		})
+	case "login taken":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "An account with this login already exists",
+		})
+	case "identity not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Identity not found",
+		})
+	case "last login method":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Set a password before unlinking your only identity",
+		})
+	case "account disabled":
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error: "Account is disabled",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: fallback,
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ProductHandler struct {
+	catalogService *service.CatalogService
+}
+
+func NewProductHandler(catalogService *service.CatalogService) *ProductHandler {
+	return &ProductHandler{
+		catalogService: catalogService,
+	}
+}
+
+// ListProducts returns the report types that can be bought right now.
+func (h *ProductHandler) ListProducts(c *gin.Context) {
+	products, err := h.catalogService.ListProducts(true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get products",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"products": products,
+	})
+}
+
+// ListAllProducts also includes products that were switched off.
+func (h *ProductHandler) ListAllProducts(c *gin.Context) {
+	products, err := h.catalogService.ListProducts(false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get products",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"products": products,
+	})
+}
+
+func (h *ProductHandler) CreateProduct(c *gin.Context) {
+	var req models.CreateProductRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	currency, err := money.ParseCurrency(req.Currency)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Unsupported currency",
+		})
+		return
+	}
+
+	product, err := h.catalogService.CreateProduct(req.Code, req.Name, money.New(req.Price, currency))
+	if err != nil {
+		if err.Error() == "product already exists" {
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "Product already exists",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to create product",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, product)
+}
+
+func (h *ProductHandler) UpdateProduct(c *gin.Context) {
+	var req models.UpdateProductRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	product, err := h.catalogService.UpdateProduct(c.Param("code"), req)
+	if err != nil {
+		if err.Error() == "product not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Product not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update product",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, product)
+}
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PromoHandler struct {
+	promoService *service.PromoService
+}
+
+func NewPromoHandler(promoService *service.PromoService) *PromoHandler {
+	return &PromoHandler{
+		promoService: promoService,
+	}
+}
+
+// writePromoError answers a refused promo code and reports whether err was one.
+func writePromoError(c *gin.Context, err error) bool {
+	var message string
+	switch err.Error() {
+	case "promo code not found":
+		message = "Promo code not found"
+	case "promo code not applicable":
+		message = "Promo code can't be used here"
+	case "promo code expired":
+		message = "Promo code has expired"
+	case "promo code exhausted":
+		message = "Promo code has been used up"
+	case "promo code limit reached":
+		message = "You have already used this promo code"
+	case "promo code is for first purchase only":
+		message = "Promo code is only valid for the first purchase"
+	default:
+		return false
+	}
+
+	c.JSON(http.StatusUnprocessableEntity, models.ErrorResponse{
+		Error: message,
+	})
+	return true
+}
+
+func (h *PromoHandler) CreatePromoCode(c *gin.Context) {
+	var req models.CreatePromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	promo, err := h.promoService.CreatePromoCode(req)
+	if err != nil {
+		switch err.Error() {
+		case "invalid promo value":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Percent discount can't exceed 100",
+			})
+		case "invalid promo code":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Promo code is required",
+			})
+		case "unsupported currency":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Unsupported currency",
+			})
+		case "promo code already exists":
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "Promo code already exists",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to create promo code",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, promo)
+}
+
+func (h *PromoHandler) ListPromoCodes(c *gin.Context) {
+	promos, err := h.promoService.ListPromoCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get promo codes",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"promo_codes": promos,
+	})
+}
+
+func (h *PromoHandler) UpdatePromoCode(c *gin.Context) {
+	var req models.UpdatePromoCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	promo, err := h.promoService.UpdatePromoCode(c.Param("code"), req)
+	if err != nil {
+		if err.Error() == "promo code not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Promo code not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to update promo code",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, promo)
+}
+
+// GetRedemptions is the audit trail of a promo code, voided redemptions included.
+func (h *PromoHandler) GetRedemptions(c *gin.Context) {
+	redemptions, err := h.promoService.GetRedemptions(c.Param("code"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get redemptions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"redemptions": redemptions,
+	})
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
 
 	"zl0y-billing/internal/models"
 	"zl0y-billing/internal/service"
@@ -10,15 +13,56 @@ import (
 )
 
 type ReportHandler struct {
-	reportService *service.ReportService
+	reportService  *service.ReportService
+	contentService *service.ReportContentService
 }
 
-func NewReportHandler(reportService *service.ReportService) *ReportHandler {
+func NewReportHandler(reportService *service.ReportService, contentService *service.ReportContentService) *ReportHandler {
 	return &ReportHandler{
-		reportService: reportService,
+		reportService:  reportService,
+		contentService: contentService,
 	}
 }
 
+// GetReport returns the report with its free preview, and a download link
+// once it is purchased.
+func (h *ReportHandler) GetReport(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	response, err := h.contentService.GetReport(userID.(int), c.Param("report_id"))
+	if err != nil {
+		writeReportContentError(c, err, "Failed to get report")
+		return
+	}
+
+	// The download link is short-lived, so the response mustn't be cached
+	c.Header("Cache-Control", "private, no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+// DownloadReport streams the full report. It is reached through the signed
+// link from GetReport, which stands in for the Authorization header.
+func (h *ReportHandler) DownloadReport(c *gin.Context) {
+	report, content, err := h.contentService.OpenDownload(c.Request.Context(), c.Param("report_id"),
+		c.Query("uid"), c.Query("expires"), c.Query("signature"))
+	if err != nil {
+		writeReportContentError(c, err, "Failed to download report")
+		return
+	}
+	defer content.Close()
+
+	c.DataFromReader(http.StatusOK, report.Content.Size, report.Content.ContentType, content, map[string]string{
+		"Content-Disposition": `attachment; filename="report-` + report.ReportID + `"`,
+		"Cache-Control":       "private, no-store",
+	})
+}
+
 func (h *ReportHandler) PurchaseReport(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -36,8 +80,21 @@ func (h *ReportHandler) PurchaseReport(c *gin.Context) {
 		return
 	}
 
-	err := h.reportService.PurchaseReport(userID.(int), reportID)
+	// The body is optional
+	var req models.PurchaseReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	purchase, err := h.reportService.PurchaseReport(userID.(int), reportID, req.Currency, req.PromoCode)
 	if err != nil {
+		if writePromoError(c, err) {
+			return
+		}
+
 		switch err.Error() {
 		case "report not found":
 			c.JSON(http.StatusNotFound, models.ErrorResponse{
@@ -47,10 +104,34 @@ func (h *ReportHandler) PurchaseReport(c *gin.Context) {
 			c.JSON(http.StatusConflict, models.ErrorResponse{
 				Error: "Report already purchased",
 			})
+		case "report not ready":
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "Report is not generated yet",
+			})
+		case "unsupported currency":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Unsupported currency",
+			})
 		case "insufficient balance":
 			c.JSON(http.StatusPaymentRequired, models.ErrorResponse{
 				Error: "Insufficient balance",
 			})
+		case "account flagged":
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Account is flagged, please contact support",
+			})
+		case "email not verified":
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Verify your email before purchasing",
+			})
+		case "product unavailable":
+			c.JSON(http.StatusConflict, models.ErrorResponse{
+				Error: "This report type is not sold at the moment",
+			})
+		case "purchase compensated":
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to unlock report, the charge was refunded",
+			})
 		default:
 			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
 				Error: "Failed to purchase report",
@@ -59,7 +140,91 @@ func (h *ReportHandler) PurchaseReport(c *gin.Context) {
 		return
 	}
 
+	// The saga will finish in the background
+	if purchase.State != models.PurchaseStateUnlocked {
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":         "Report purchase is being processed",
+			"purchase":        purchase,
+			"discount_amount": purchase.DiscountAmount,
+		})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Report purchased successfully",
+		"message":         "Report purchased successfully",
+		"purchase":        purchase,
+		"discount_amount": purchase.DiscountAmount,
 	})
 }
+
+func (h *ReportHandler) GetPurchase(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	purchaseID, err := strconv.Atoi(c.Param("purchase_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid purchase ID",
+		})
+		return
+	}
+
+	purchase, err := h.reportService.GetPurchase(userID.(int), purchaseID)
+	if err != nil {
+		if err.Error() == "purchase not found" {
+			c.JSON(http.StatusNotFound, models.ErrorResponse{
+				Error: "Purchase not found",
+			})
+			return
+		}
+
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get purchase",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, purchase)
+}
+
+func writeReportContentError(c *gin.Context, err error, fallback string) {
+	switch err.Error() {
+	case "report not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Report not found",
+		})
+	case "invalid download link":
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error: "Invalid download link",
+		})
+	case "download link expired":
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error: "Download link has expired, get a new one",
+		})
+	case "report not purchased":
+		c.JSON(http.StatusPaymentRequired, models.ErrorResponse{
+			Error: "Purchase the report to download it",
+		})
+	case "report content not ready":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Report content is not ready yet",
+		})
+	case "report too large":
+		c.JSON(http.StatusRequestEntityTooLarge, models.ErrorResponse{
+			Error: "Report is too large",
+		})
+	case "preview too long":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Preview is too long",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: fallback,
+		})
+	}
+}
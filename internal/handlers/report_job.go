@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reportStatusPollInterval is how often status subscriptions look for changes.
+const reportStatusPollInterval = time.Second
+
+type ReportJobHandler struct {
+	pipeline *service.ReportPipeline
+}
+
+func NewReportJobHandler(pipeline *service.ReportPipeline) *ReportJobHandler {
+	return &ReportJobHandler{
+		pipeline: pipeline,
+	}
+}
+
+// SubmitReport queues a report for generation.
+func (h *ReportJobHandler) SubmitReport(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.SubmitReportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	job, err := h.pipeline.Submit(userID.(int), req)
+	if err != nil {
+		writeReportJobError(c, err, "Failed to submit report")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":   "Report queued for generation",
+		"report_id": job.ReportID,
+		"job":       job,
+	})
+}
+
+// GetReportStatus returns the generation job of the report, for polling.
+func (h *ReportJobHandler) GetReportStatus(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	job, err := h.pipeline.GetJob(userID.(int), c.Param("report_id"))
+	if err != nil {
+		writeReportJobError(c, err, "Failed to get report status")
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// StreamReportStatus sends the generation job as a server-sent "status"
+// event on every change, until the report is ready or failed.
+func (h *ReportJobHandler) StreamReportStatus(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	updates, err := h.pipeline.Watch(c.Request.Context(), userID.(int), c.Param("report_id"), reportStatusPollInterval)
+	if err != nil {
+		writeReportJobError(c, err, "Failed to get report status")
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // Keep proxies from buffering the stream
+	c.Stream(func(w io.Writer) bool {
+		job, ok := <-updates
+		if !ok {
+			return false
+		}
+
+		c.SSEvent("status", job)
+		return true
+	})
+}
+
+func writeReportJobError(c *gin.Context, err error, fallback string) {
+	switch err.Error() {
+	case "report not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Report not found",
+		})
+	case "input too large":
+		c.JSON(http.StatusRequestEntityTooLarge, models.ErrorResponse{
+			Error: "Analysis input is too large",
+		})
+	case "product unavailable":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Unknown product code",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: fallback,
+		})
+	}
+}
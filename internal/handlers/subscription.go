@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SubscriptionHandler struct {
+	subscriptionService *service.SubscriptionService
+}
+
+func NewSubscriptionHandler(subscriptionService *service.SubscriptionService) *SubscriptionHandler {
+	return &SubscriptionHandler{
+		subscriptionService: subscriptionService,
+	}
+}
+
+func (h *SubscriptionHandler) ListPlans(c *gin.Context) {
+	plans, err := h.subscriptionService.ListPlans()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get plans",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plans": plans,
+	})
+}
+
+func (h *SubscriptionHandler) GetSubscription(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	subscription, err := h.subscriptionService.GetSubscription(userID.(int))
+	if err != nil {
+		writeSubscriptionError(c, err, "Failed to get subscription")
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+func (h *SubscriptionHandler) Subscribe(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.SubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	subscription, err := h.subscriptionService.Subscribe(userID.(int), req.PlanCode)
+	if err != nil {
+		writeSubscriptionError(c, err, "Failed to subscribe")
+		return
+	}
+
+	c.JSON(http.StatusCreated, subscription)
+}
+
+func (h *SubscriptionHandler) ChangePlan(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.SubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	subscription, err := h.subscriptionService.ChangePlan(userID.(int), req.PlanCode)
+	if err != nil {
+		writeSubscriptionError(c, err, "Failed to change plan")
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+func (h *SubscriptionHandler) Cancel(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	subscription, err := h.subscriptionService.Cancel(userID.(int))
+	if err != nil {
+		writeSubscriptionError(c, err, "Failed to cancel subscription")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Subscription will not be renewed",
+		"subscription": subscription,
+	})
+}
+
+func writeSubscriptionError(c *gin.Context, err error, fallback string) {
+	switch err.Error() {
+	case "subscription not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "No active subscription",
+		})
+	case "plan not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "Plan not found",
+		})
+	case "subscription already exists":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Already subscribed, change the plan instead",
+		})
+	case "already on this plan":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Already on this plan",
+		})
+	case "subscription is past due":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Subscription renewal is past due, top up the balance first",
+		})
+	case "reports used exceed plan allowance":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "More reports were used this period than the plan allows, downgrade after the period ends",
+		})
+	case "insufficient balance":
+		c.JSON(http.StatusPaymentRequired, models.ErrorResponse{
+			Error: "Insufficient balance",
+		})
+	case "account flagged":
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error: "Account is flagged, please contact support",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: fallback,
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TwoFactorHandler struct {
+	twoFactorService *service.TwoFactorService
+}
+
+func NewTwoFactorHandler(twoFactorService *service.TwoFactorService) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		twoFactorService: twoFactorService,
+	}
+}
+
+// Enroll returns a new TOTP secret and its otpauth:// URI for the authenticator app.
+func (h *TwoFactorHandler) Enroll(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	response, err := h.twoFactorService.Enroll(userID.(int))
+	if err != nil {
+		writeTwoFactorError(c, err, "Failed to enroll in 2FA")
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Confirm turns 2FA on with a code from the app and returns the recovery codes.
+func (h *TwoFactorHandler) Confirm(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	response, err := h.twoFactorService.Confirm(userID.(int), req.Code)
+	if err != nil {
+		writeTwoFactorError(c, err, "Failed to confirm 2FA")
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *TwoFactorHandler) Disable(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.DisableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	if err := h.twoFactorService.Disable(userID.(int), req.Password, req.Code); err != nil {
+		writeTwoFactorError(c, err, "Failed to disable 2FA")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *TwoFactorHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	var req models.TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	response, err := h.twoFactorService.RegenerateRecoveryCodes(userID.(int), req.Code)
+	if err != nil {
+		writeTwoFactorError(c, err, "Failed to regenerate recovery codes")
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func writeTwoFactorError(c *gin.Context, err error, fallback string) {
+	switch err.Error() {
+	case "2fa already enabled":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "2FA is already enabled",
+		})
+	case "2fa not enabled":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "2FA is not enabled",
+		})
+	case "2fa not enrolled":
+		c.JSON(http.StatusConflict, models.ErrorResponse{
+			Error: "Enroll in 2FA first",
+		})
+	case "invalid code":
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid code",
+		})
+	case "invalid password":
+		c.JSON(http.StatusForbidden, models.ErrorResponse{
+			Error: "Password is incorrect",
+		})
+	case "user not found":
+		c.JSON(http.StatusNotFound, models.ErrorResponse{
+			Error: "User not found",
+		})
+	default:
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: fallback,
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"zl0y-billing/internal/models"
 	"zl0y-billing/internal/service"
@@ -74,10 +77,186 @@ func (h *UserHandler) GetReports(c *gin.Context) {
 		offset = 0
 	}
 
-	response, err := h.userService.GetUserReports(userID.(int), limit, offset)
+	page := models.ReportPage{
+		Limit:  limit,
+		Offset: offset,
+		Cursor: c.Query("cursor"),
+	}
+
+	if page.Cursor != "" && c.Query("offset") != "" {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Use either cursor or offset",
+		})
+		return
+	}
+
+	if value := c.Query("include_total"); value != "" {
+		includeTotal, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "include_total must be true or false",
+			})
+			return
+		}
+		page.IncludeTotal = &includeTotal
+	}
+
+	filter, err := parseReportFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: err.Error(),
+		})
+		return
+	}
+
+	response, err := h.userService.GetUserReports(userID.(int), filter, page)
+	if err != nil {
+		switch err.Error() {
+		case "invalid cursor":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Invalid cursor, or it was made for another sort order",
+			})
+		case "invalid status":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "status must be queued, processing, ready or failed",
+			})
+		case "invalid date range":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "from must be before to",
+			})
+		case "query too long":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "q is too long",
+			})
+		case "invalid sort":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "sort must be -created_at, created_at, title, -title or relevance",
+			})
+		case "relevance sort needs a query":
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Sorting by relevance needs a search query q",
+			})
+		default:
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to get reports",
+			})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// parseReportFilter reads the report list filters from the query string:
+// purchased, from, to (RFC 3339 times or dates; to is inclusive for dates),
+// product_code and status (comma-separated lists), q and sort.
+func parseReportFilter(c *gin.Context) (models.ReportFilter, error) {
+	filter := models.ReportFilter{
+		ProductCodes: splitList(c.Query("product_code")),
+		Statuses:     splitList(c.Query("status")),
+		Query:        c.Query("q"),
+		Sort:         c.Query("sort"),
+	}
+
+	if value := c.Query("purchased"); value != "" {
+		purchased, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("purchased must be true or false")
+		}
+		filter.Purchased = &purchased
+	}
+
+	if value := c.Query("from"); value != "" {
+		from, err := parseFilterTime(value, false)
+		if err != nil {
+			return filter, fmt.Errorf("from must be a date or an RFC 3339 time")
+		}
+		filter.From = &from
+	}
+
+	if value := c.Query("to"); value != "" {
+		to, err := parseFilterTime(value, true)
+		if err != nil {
+			return filter, fmt.Errorf("to must be a date or an RFC 3339 time")
+		}
+		filter.To = &to
+	}
+
+	return filter, nil
+}
+
+// parseFilterTime parses an RFC 3339 time or a UTC date. endOfDay moves a
+// date to the start of the next day, so that the whole day is included.
+func parseFilterTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (h *UserHandler) GetTransactions(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	// Parse pagination parameters
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil {
+		limit = 20
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil {
+		offset = 0
+	}
+
+	response, err := h.userService.GetUserTransactions(userID.(int), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to get transactions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *UserHandler) GetWallets(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: "User not authenticated",
+		})
+		return
+	}
+
+	response, err := h.userService.GetWallets(userID.(int))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
-			Error: "Failed to get reports",
+			Error: "Failed to get wallets",
 		})
 		return
 	}
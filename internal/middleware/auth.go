@@ -10,7 +10,27 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// TokenRevocations decides whether a validly signed, unexpired token was revoked.
+type TokenRevocations interface {
+	IsRevoked(userID, version int, jti string) (bool, error)
+}
+
+// TokenKeys looks up the key a token was signed with.
+type TokenKeys interface {
+	Keyfunc(token *jwt.Token) (interface{}, error)
+	ValidMethods() []string
+}
+
+// APIKeys authenticates requests made with an API key instead of an access token.
+type APIKeys interface {
+	IsAPIKey(token string) bool
+	Authenticate(key, ip string) (*models.APIKey, error)
+}
+
+// AuthMiddleware accepts either an access token or an API key as the bearer
+// token. Requests with an API key act as a plain user limited to the key's
+// scopes, see RequireScope.
+func AuthMiddleware(keys TokenKeys, revocations TokenRevocations, apiKeys APIKeys) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -33,13 +53,32 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 
 		tokenString := parts[1]
 
-		// Parse and validate the JWT token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
+		if apiKeys.IsAPIKey(tokenString) {
+			key, err := apiKeys.Authenticate(tokenString, c.ClientIP())
+			if err != nil {
+				if err.Error() == "invalid api key" {
+					c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+						Error: "Invalid or expired API key",
+					})
+				} else {
+					c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+						Error: "Failed to check API key",
+					})
+				}
+				c.Abort()
+				return
 			}
-			return []byte(jwtSecret), nil
-		})
+
+			c.Set("user_id", key.UserID)
+			c.Set("role", models.RoleUser)
+			c.Set("api_key_id", key.ID)
+			c.Set("scopes", key.Scopes)
+			c.Next()
+			return
+		}
+
+		// Parse and validate the JWT token
+		token, err := jwt.Parse(tokenString, keys.Keyfunc, jwt.WithValidMethods(keys.ValidMethods()))
 
 		if err != nil || !token.Valid {
 			c.JSON(http.StatusUnauthorized, models.ErrorResponse{
@@ -52,7 +91,38 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 		// Extract user ID from the token claims
 		if claims, ok := token.Claims.(jwt.MapClaims); ok {
 			if userID, ok := claims["user_id"].(float64); ok {
+				// Tokens issued before revocation existed have neither; they are version 0
+				jti, _ := claims["jti"].(string)
+				version, _ := claims["ver"].(float64)
+
+				revoked, err := revocations.IsRevoked(int(userID), int(version), jti)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+						Error: "Failed to check token",
+					})
+					c.Abort()
+					return
+				}
+				if revoked {
+					c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+						Error: "Token has been revoked",
+					})
+					c.Abort()
+					return
+				}
+
+				// Tokens issued before roles existed belong to plain users
+				role, _ := claims["role"].(string)
+				if role == "" {
+					role = models.RoleUser
+				}
+
 				c.Set("user_id", int(userID))
+				c.Set("role", role)
+				c.Set("token_id", jti)
+				if sessionID, ok := claims["sid"].(float64); ok {
+					c.Set("session_id", int(sessionID))
+				}
 				c.Next()
 				return
 			}
@@ -64,3 +134,16 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 		c.Abort()
 	}
 }
+
+// OptionalAuth runs auth only for requests with an Authorization header, so
+// the handler serves anonymous requests too and tells them apart by whether
+// user_id is set.
+func OptionalAuth(auth gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		auth(c)
+	}
+}
@@ -0,0 +1,145 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	maxIdempotentRequestBytes = 1 << 20
+)
+
+// responseRecorder keeps a copy of everything the handler writes.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware honours the Idempotency-Key header. The first request
+// with a key runs normally and its response is stored; a replay with the same
+// method, path and body gets the stored response, while reuse of the key for a
+// different request is rejected with 422. Requests without the header pass through.
+// Register it after AuthMiddleware: keys are scoped per user, and anonymous
+// requests pass through too, since clients that can't be told apart would
+// share their keys.
+func IdempotencyMiddleware(repo *repository.IdempotencyRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		userID, authenticated := c.Get("user_id")
+		if key == "" || !authenticated {
+			c.Next()
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Idempotency-Key is too long",
+			})
+			c.Abort()
+			return
+		}
+
+		// Read the body for the fingerprint and put it back for the handler. One
+		// byte over the limit tells a large body from one that is cut off
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxIdempotentRequestBytes+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.ErrorResponse{
+				Error: "Failed to read request body",
+			})
+			c.Abort()
+			return
+		}
+		if len(body) > maxIdempotentRequestBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, models.ErrorResponse{
+				Error: "Request body is too large",
+			})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := fmt.Sprintf("user:%d", userID.(int))
+
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + "\n" + c.Request.URL.Path + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		record, created, err := repo.Begin(scope, key, fingerprint)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+				Error: "Failed to process Idempotency-Key",
+			})
+			c.Abort()
+			return
+		}
+
+		if !created {
+			switch {
+			case record.RequestHash != fingerprint:
+				c.JSON(http.StatusUnprocessableEntity, models.ErrorResponse{
+					Error: "Idempotency-Key was already used for a different request",
+				})
+			case record.StatusCode == nil:
+				c.JSON(http.StatusConflict, models.ErrorResponse{
+					Error: "A request with this Idempotency-Key is still being processed",
+				})
+			default:
+				c.Header(IdempotentReplayedHeader, "true")
+				c.Data(*record.StatusCode, record.ContentType, record.ResponseBody)
+			}
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		// Free the key if the handler panics or fails on our side, so it can be retried
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := repo.Release(record.ID); err != nil {
+				log.Printf("Failed to release idempotency key %s: %v", key, err)
+			}
+		}()
+
+		c.Next()
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			return
+		}
+
+		if err := repo.Complete(record.ID, status, recorder.Header().Get("Content-Type"), recorder.body.Bytes()); err != nil {
+			log.Printf("Failed to store response for idempotency key %s: %v", key, err)
+			return
+		}
+		completed = true
+	}
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+
+	"zl0y-billing/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole lets through only users with one of roles. It goes after
+// AuthMiddleware, which takes the role from the access token.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !slices.Contains(roles, c.GetString("role")) {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Insufficient permissions",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
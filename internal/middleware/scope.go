@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"slices"
+
+	"zl0y-billing/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireScope lets API keys through only if they have scope. Requests with
+// an access token act with the user's full rights and always pass.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key_id"); ok && !slices.Contains(c.GetStringSlice("scopes"), scope) {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "API key lacks scope " + scope,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// SessionOnly rejects API keys, for account management that needs a logged-in user.
+func SessionOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key_id"); ok {
+			c.JSON(http.StatusForbidden, models.ErrorResponse{
+				Error: "Not available to API keys",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -1,43 +1,661 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"zl0y-billing/internal/money"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 // User represents a user in the postgresql.
+// User roles. Support staff can look users up; admins can also change them.
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
 type User struct {
-	ID           int       `json:"id" db:"id"`
-	Login        string    `json:"login" db:"login"`
-	PasswordHash string    `json:"-" db:"password_hash"`
-	Balance      int       `json:"balance" db:"balance"` // Balance in cents
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	ID           int         `json:"id" db:"id"`
+	Login        string      `json:"login" db:"login"`
+	Role         string      `json:"role" db:"role"`
+	PasswordHash string      `json:"-" db:"password_hash"`
+	Balance      money.Money `json:"balance" db:"balance"` // RUB wallet, cached from the ledger
+	FlaggedAt    *time.Time  `json:"flagged_at,omitempty" db:"flagged_at"`
+	FlagReason   string      `json:"flag_reason,omitempty" db:"flag_reason"`
+	TokenVersion int         `json:"-" db:"token_version"` // Access tokens of older versions are revoked
+	CreatedAt    time.Time   `json:"created_at" db:"created_at"`
+
+	TOTPSecret    *string    `json:"-" db:"totp_secret"`
+	TOTPEnabledAt *time.Time `json:"-" db:"totp_enabled_at"` // Nil while 2FA is off or not confirmed yet
+
+	DisabledAt     *time.Time `json:"disabled_at,omitempty" db:"disabled_at"`
+	DisabledReason string     `json:"disabled_reason,omitempty" db:"disabled_reason"`
+
+	Email           *string    `json:"email,omitempty" db:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty" db:"email_verified_at"` // Nil until the user follows the verification link
+}
+
+// APIKeyPrefix starts every API key, so keys are told apart from JWTs and
+// found by secret scanners.
+const APIKeyPrefix = "zlk_"
+
+// API key scopes. Requests made with a key reach only the endpoints of its scopes.
+const (
+	ScopeReportsRead     = "reports:read"
+	ScopeReportsCreate   = "reports:create"
+	ScopeReportsPurchase = "reports:purchase"
+	ScopeBillingRead     = "billing:read"
+	ScopeBillingWrite    = "billing:write"
+)
+
+// APIKeyScopes lists the scopes API keys can be given.
+var APIKeyScopes = []string{ScopeReportsRead, ScopeReportsCreate, ScopeReportsPurchase, ScopeBillingRead, ScopeBillingWrite}
+
+// APIKey lets a server act for a user without logging in.
+type APIKey struct {
+	ID         int        `json:"id" db:"id"`
+	UserID     int        `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	Scopes     []string   `json:"scopes" db:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip,omitempty" db:"last_used_ip"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// UserIdentity is an account at an OpenID provider that logs in as the user.
+type UserIdentity struct {
+	UserID      int        `json:"-" db:"user_id"`
+	Provider    string     `json:"provider" db:"provider"`
+	Subject     string     `json:"subject" db:"subject"`
+	Email       string     `json:"email,omitempty" db:"email"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty" db:"last_login_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// OIDCLoginState is a login in progress at an OpenID provider.
+type OIDCLoginState struct {
+	Provider     string `db:"provider"`
+	Nonce        string `db:"nonce"`
+	CodeVerifier string `db:"code_verifier"`
+	LinkUserID   *int   `db:"link_user_id"`
+}
+
+// LoginChallenge is a login waiting for the second factor.
+type LoginChallenge struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Login     string    `json:"login" db:"login"` // as entered, may be the email
+	UserAgent string    `json:"user_agent" db:"user_agent"`
+	IP        string    `json:"ip" db:"ip"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
 }
 
 // The Report represents a report in the MongoDB.
 type Report struct {
-	ID                primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ID                bson.ObjectID      `json:"id" bson:"_id,omitempty"`
 	ReportID          string             `json:"report_id" bson:"report_id"`
 	UserID            *int               `json:"user_id,omitempty" bson:"user_id,omitempty"`
 	ClientGeneratedID string             `json:"client_generated_id" bson:"client_generated_id"`
+	ProductCode       string             `json:"product_code,omitempty" bson:"product_code,omitempty"` // Report type, empty means standard
+	Title             string             `json:"title,omitempty" bson:"title,omitempty"`
+	Target            string             `json:"target,omitempty" bson:"target,omitempty"` // What was analyzed, e.g. a domain or an email
 	IsPurchased       bool               `json:"is_purchased" bson:"is_purchased"`
+	PurchaseStatus    string             `json:"purchase_status,omitempty" bson:"purchase_status,omitempty"`
+	RefundedAt        *time.Time         `json:"refunded_at,omitempty" bson:"refunded_at,omitempty"`
+	Content           *ReportContent     `json:"content,omitempty" bson:"content,omitempty"` // Nil until the payload is stored
+	Fingerprint       *FingerprintResult `json:"-" bson:"fingerprint,omitempty"`             // Sold with the report, see ReportResponse
+	FingerprintRaw    string             `json:"-" bson:"fingerprint_raw,omitempty"`         // As ingested, upgraded again when the schema changes
+	Status            string             `json:"status,omitempty" bson:"status,omitempty"`   // Generation status, empty for reports made before the pipeline
+	Error             string             `json:"error,omitempty" bson:"error,omitempty"`     // Why generation failed
 	CreatedAt         time.Time          `json:"created_at" bson:"created_at"`
 }
 
+// Report generation statuses, see ReportJob
+const (
+	ReportStatusQueued     = "queued"     // waiting for a worker
+	ReportStatusProcessing = "processing" // leased by a worker
+	ReportStatusReady      = "ready"      // content stored
+	ReportStatusFailed     = "failed"     // gave up, see the error
+)
+
+// IsReady tells whether the report has been generated. Reports without a
+// status were created ready, before the generation pipeline.
+func (r *Report) IsReady() bool {
+	return r.Status == "" || r.Status == ReportStatusReady
+}
+
+// ReportJob is a request to generate a report, worked off by the pipeline.
+// Workers lease jobs, so a job whose worker died is picked up again once the
+// lease runs out.
+type ReportJob struct {
+	ID          int             `json:"id" db:"id"`
+	ReportID    string          `json:"report_id" db:"report_id"`
+	UserID      int             `json:"user_id" db:"user_id"`
+	ProductCode string          `json:"product_code" db:"product_code"`
+	Input       json.RawMessage `json:"input" db:"input"` // Passed to the analyzer as is
+	Status      string          `json:"status" db:"status"`
+	Attempts    int             `json:"attempts" db:"attempts"` // Started attempts, including the current one
+	LastError   string          `json:"last_error,omitempty" db:"last_error"`
+	LeaseToken  string          `json:"-" db:"lease_token"` // Proves the worker still holds the lease
+	StartedAt   *time.Time      `json:"started_at,omitempty" db:"started_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty" db:"finished_at"`
+	CreatedAt   time.Time       `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at" db:"updated_at"`
+}
+
+// IsFinished tells whether the job reached a final status.
+func (j *ReportJob) IsFinished() bool {
+	return j.Status == ReportStatusReady || j.Status == ReportStatusFailed
+}
+
+// ReportContent describes a report's payload, which lives in the blob store.
+// The preview is free; the payload is delivered once the report is purchased.
+type ReportContent struct {
+	ContentType string    `json:"content_type" bson:"content_type"`
+	Size        int64     `json:"size" bson:"size"`
+	SHA256      string    `json:"sha256" bson:"sha256"`
+	Preview     string    `json:"-" bson:"preview"`
+	StoredAt    time.Time `json:"stored_at" bson:"stored_at"`
+}
+
+// ReportResponse is a report with its preview and, once purchased, a
+// short-lived link to the full content and the fingerprint analysis.
+type ReportResponse struct {
+	Report            Report             `json:"report"`
+	Preview           string             `json:"preview"`
+	DownloadURL       string             `json:"download_url,omitempty"`
+	DownloadExpiresAt *time.Time         `json:"download_expires_at,omitempty"`
+	Fingerprint       *FingerprintResult `json:"fingerprint,omitempty"`
+}
+
+// FingerprintResult is the outcome of a digital-fingerprint analysis. The
+// schema is versioned: results are upgraded to the current version on
+// ingest, and stored results are upgraded on startup after a version bump,
+// so readers only ever see the current version.
+type FingerprintResult struct {
+	SchemaVersion int                 `json:"schema_version" bson:"schema_version"`
+	AnalyzedAt    time.Time           `json:"analyzed_at" bson:"analyzed_at"`
+	Browser       FingerprintBrowser  `json:"browser" bson:"browser"`
+	Device        FingerprintDevice   `json:"device" bson:"device"`
+	RiskScore     int                 `json:"risk_score" bson:"risk_score"` // 0 (clean) to 100
+	RiskLevel     string              `json:"risk_level" bson:"risk_level"` // Derived from the risk score
+	Signals       []FingerprintSignal `json:"signals" bson:"signals"`
+	Leaks         []FingerprintLeak   `json:"leaks" bson:"leaks"`
+}
+
+// FingerprintBrowser holds the attributes the browser exposed.
+type FingerprintBrowser struct {
+	Name           string   `json:"name" bson:"name"`
+	Version        string   `json:"version" bson:"version"`
+	UserAgent      string   `json:"user_agent" bson:"user_agent"`
+	Languages      []string `json:"languages" bson:"languages"`
+	Timezone       string   `json:"timezone" bson:"timezone"` // IANA name, e.g. Europe/Moscow
+	CookiesEnabled bool     `json:"cookies_enabled" bson:"cookies_enabled"`
+	DoNotTrack     bool     `json:"do_not_track" bson:"do_not_track"`
+}
+
+// FingerprintDevice holds the attributes of the device the browser ran on.
+type FingerprintDevice struct {
+	Type         string  `json:"type" bson:"type"`
+	OS           string  `json:"os" bson:"os"`
+	OSVersion    string  `json:"os_version" bson:"os_version"`
+	ScreenWidth  int     `json:"screen_width" bson:"screen_width"`
+	ScreenHeight int     `json:"screen_height" bson:"screen_height"`
+	PixelRatio   float64 `json:"pixel_ratio" bson:"pixel_ratio"`
+	CPUCores     int     `json:"cpu_cores" bson:"cpu_cores"`
+	TouchPoints  int     `json:"touch_points" bson:"touch_points"`
+}
+
+// FingerprintSignal is a finding that contributed to the risk score.
+type FingerprintSignal struct {
+	Code        string `json:"code" bson:"code"` // snake_case, e.g. tor_exit_node
+	Category    string `json:"category" bson:"category"`
+	Severity    string `json:"severity" bson:"severity"`
+	Description string `json:"description" bson:"description"`
+}
+
+// FingerprintLeak is a data breach the fingerprinted identity turned up in.
+type FingerprintLeak struct {
+	Source      string     `json:"source" bson:"source"`
+	BreachedAt  *time.Time `json:"breached_at,omitempty" bson:"breached_at,omitempty"`
+	DataClasses []string   `json:"data_classes" bson:"data_classes"` // snake_case, e.g. email, password_hash
+	Identifier  string     `json:"identifier" bson:"identifier"`     // Masked, e.g. j***@example.com
+}
+
+// Fingerprint device types
+const (
+	DeviceTypeDesktop = "desktop"
+	DeviceTypeMobile  = "mobile"
+	DeviceTypeTablet  = "tablet"
+	DeviceTypeOther   = "other"
+)
+
+// Fingerprint risk levels and signal severities
+const (
+	RiskLow    = "low"
+	RiskMedium = "medium"
+	RiskHigh   = "high"
+)
+
+// Fingerprint signal categories
+const (
+	SignalCategoryNetwork  = "network"
+	SignalCategoryDevice   = "device"
+	SignalCategoryBrowser  = "browser"
+	SignalCategoryBehavior = "behavior"
+	SignalCategoryIdentity = "identity"
+)
+
+// ValidationErrorResponse lists what is wrong with a rejected document.
+type ValidationErrorResponse struct {
+	Error    string   `json:"error"`
+	Problems []string `json:"problems"`
+}
+
+// Report purchase statuses; reports never bought have none
+const (
+	ReportPurchaseStatusPurchased = "purchased"
+	ReportPurchaseStatusRefunded  = "refunded" // locked again after a full refund
+)
+
+// LedgerAccount is an account in the double-entry ledger.
+// User accounts carry UserID, system accounts (revenue, payments, ...) don't.
+type LedgerAccount struct {
+	ID        int            `json:"id" db:"id"`
+	Code      string         `json:"code" db:"code"`
+	UserID    *int           `json:"user_id,omitempty" db:"user_id"`
+	Type      string         `json:"type" db:"type"`
+	Currency  money.Currency `json:"currency" db:"currency"`
+	CreatedAt time.Time      `json:"created_at" db:"created_at"`
+}
+
+// JournalEntry is an immutable, balanced set of postings.
+type JournalEntry struct {
+	ID          int       `json:"id" db:"id"`
+	Kind        string    `json:"kind" db:"kind"`
+	Reference   string    `json:"reference" db:"reference"`
+	Description string    `json:"description" db:"description"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+// Transaction is a single ledger posting as seen from a user's account.
+type Transaction struct {
+	EntryID     int         `json:"entry_id" db:"entry_id"`
+	Kind        string      `json:"kind" db:"kind"`
+	Reference   string      `json:"reference" db:"reference"`
+	Description string      `json:"description" db:"description"`
+	Amount      money.Money `json:"amount" db:"amount"` // Signed, positive credits the user
+	CreatedAt   time.Time   `json:"created_at" db:"created_at"`
+}
+
+// Wallet is a user's balance in one currency, cached from the ledger.
+type Wallet struct {
+	Currency  money.Currency `json:"currency" db:"currency"`
+	Balance   money.Money    `json:"balance" db:"balance"`
+	UpdatedAt time.Time      `json:"updated_at" db:"updated_at"`
+}
+
+// RevokedToken is an access token revoked before it expired.
+type RevokedToken struct {
+	ID        int       `json:"id" db:"id"`
+	JTI       string    `json:"jti" db:"jti"`
+	UserID    *int      `json:"user_id,omitempty" db:"user_id"`
+	Reason    string    `json:"reason" db:"reason"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// Login throttle scopes: failed logins are counted per login and per client IP,
+// password reset requests separately from them.
+const (
+	ThrottleScopeLogin      = "login"
+	ThrottleScopeIP         = "ip"
+	ThrottleScopeResetLogin = "reset_login"
+	ThrottleScopeResetIP    = "reset_ip"
+)
+
+// LoginThrottle tracks failed logins for a login or IP.
+type LoginThrottle struct {
+	Scope         string     `json:"scope" db:"scope"`
+	Key           string     `json:"key" db:"key"`
+	Failures      int        `json:"failures" db:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at" db:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty" db:"locked_until"`
+}
+
+type LockoutsResponse struct {
+	Lockouts []LoginThrottle `json:"lockouts"`
+}
+
+// SigningKey is a key of the set that signs access tokens.
+type SigningKey struct {
+	KID        string     `json:"kid" db:"kid"`
+	Algorithm  string     `json:"algorithm" db:"algorithm"`
+	PrivateKey string     `json:"-" db:"private_key"` // PKCS #8 PEM
+	NotBefore  time.Time  `json:"not_before" db:"not_before"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"` // OKP keys
+	X   string `json:"x,omitempty"`   // OKP keys
+	N   string `json:"n,omitempty"`   // RSA keys
+	E   string `json:"e,omitempty"`   // RSA keys
+}
+
+// Session is a logged in device, kept alive by its refresh token.
+type Session struct {
+	ID         int       `json:"id" db:"id"`
+	UserID     int       `json:"-" db:"user_id"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	IP         string    `json:"ip" db:"ip"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at" db:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at" db:"expires_at"`
+	Current    bool      `json:"current" db:"-"` // The session of the access token making the request
+}
+
+// BalanceMismatch reports a user wallet whose cached balance differs from the ledger.
+type BalanceMismatch struct {
+	UserID        int         `json:"user_id"`
+	CachedBalance money.Money `json:"cached_balance"`
+	LedgerBalance money.Money `json:"ledger_balance"`
+}
+
+// Purchase saga states
+const (
+	PurchaseStatePending     = "pending"     // created, balance not charged yet
+	PurchaseStateCharged     = "charged"     // balance charged, report not unlocked yet
+	PurchaseStateUnlocked    = "unlocked"    // report unlocked, saga finished
+	PurchaseStateCompensated = "compensated" // unlock gave up, charge refunded
+	PurchaseStateFailed      = "failed"      // charge never happened
+	PurchaseStateRefunding   = "refunding"   // fully refunded, report not locked again yet
+	PurchaseStateRefunded    = "refunded"    // fully refunded, report locked again
+)
+
+// Refund sources
+const (
+	RefundSourceAdmin      = "admin"
+	RefundSourceChargeback = "chargeback"
+)
+
+// Purchase is the persisted state of a report purchase saga in the PostgreSQL.
+type Purchase struct {
+	ID             int         `json:"id" db:"id"`
+	UserID         int         `json:"user_id" db:"user_id"`
+	ReportID       string      `json:"report_id" db:"report_id"`
+	ProductCode    string      `json:"product_code" db:"product_code"`
+	PromoCode      string      `json:"promo_code,omitempty" db:"promo_code"`
+	DiscountAmount money.Money `json:"discount_amount" db:"discount_amount"`
+	SubscriptionID *int        `json:"subscription_id,omitempty" db:"subscription_id"` // Set when paid from the allowance
+	Amount         money.Money `json:"amount" db:"amount"`                             // Charged price, in the currency of the wallet paid from
+	RefundedAmount money.Money `json:"refunded_amount" db:"refunded_amount"`
+	State          string      `json:"state" db:"state"`
+	Attempts       int         `json:"attempts" db:"attempts"`
+	LastError      string      `json:"last_error,omitempty" db:"last_error"`
+	CreatedAt      time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at" db:"updated_at"`
+}
+
+// Refund returns (part of) a purchase's amount to the user's balance.
+type Refund struct {
+	ID         int         `json:"id" db:"id"`
+	PurchaseID int         `json:"purchase_id" db:"purchase_id"`
+	Amount     money.Money `json:"amount" db:"amount"`
+	Reason     string      `json:"reason" db:"reason"`
+	Source     string      `json:"source" db:"source"`
+	CreatedAt  time.Time   `json:"created_at" db:"created_at"`
+}
+
+// IdempotencyRecord is a stored Idempotency-Key with the response it produced.
+type IdempotencyRecord struct {
+	ID           int        `json:"id" db:"id"`
+	Scope        string     `json:"scope" db:"scope"`
+	Key          string     `json:"key" db:"key"`
+	RequestHash  string     `json:"request_hash" db:"request_hash"`
+	StatusCode   *int       `json:"status_code,omitempty" db:"status_code"` // nil while in progress
+	ContentType  string     `json:"content_type" db:"content_type"`
+	ResponseBody []byte     `json:"-" db:"response_body"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+}
+
+// Top-up statuses
+const (
+	TopUpStatusPending   = "pending"
+	TopUpStatusSucceeded = "succeeded"
+	TopUpStatusFailed    = "failed"
+	TopUpStatusExpired   = "expired"      // never paid; a late payment is still credited, without the bonus
+	TopUpStatusRefunded  = "refunded"     // fully refunded by the provider
+	TopUpStatusDisputed  = "charged_back" // reversed by a chargeback
+)
+
+// TopUp is a balance top-up paid through a payment provider.
+type TopUp struct {
+	ID                int         `json:"id" db:"id"`
+	UserID            int         `json:"user_id" db:"user_id"`
+	Amount            money.Money `json:"amount" db:"amount"`
+	ReversedAmount    money.Money `json:"reversed_amount" db:"reversed_amount"` // Refunded or charged back
+	PromoCode         string      `json:"promo_code,omitempty" db:"promo_code"`
+	BonusAmount       money.Money `json:"bonus_amount" db:"bonus_amount"` // Promo bonus credited on success
+	Status            string      `json:"status" db:"status"`
+	Provider          string      `json:"provider" db:"provider"`
+	ProviderPaymentID string      `json:"provider_payment_id,omitempty" db:"provider_payment_id"`
+	ConfirmationURL   string      `json:"confirmation_url,omitempty" db:"confirmation_url"`
+	FailureReason     string      `json:"failure_reason,omitempty" db:"failure_reason"`
+	CreatedAt         time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time   `json:"updated_at" db:"updated_at"`
+}
+
+// Product is a report type in the price catalogue.
+type Product struct {
+	Code      string      `json:"code" db:"code"`
+	Name      string      `json:"name" db:"name"`
+	Price     money.Money `json:"price" db:"price"`
+	Active    bool        `json:"active" db:"active"`
+	CreatedAt time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at" db:"updated_at"`
+}
+
+// Promo code targets and discount types
+const (
+	PromoTargetPurchase  = "purchase"
+	PromoTargetTopUp     = "topup"
+	PromoDiscountPercent = "percent"
+	PromoDiscountFixed   = "fixed"
+)
+
+// Promo redemption statuses
+const (
+	PromoRedemptionApplied = "applied"
+	PromoRedemptionVoided  = "voided" // the purchase or top-up didn't go through
+)
+
+// PromoCode gives a discount on report purchases or a bonus on top-ups.
+type PromoCode struct {
+	ID                int            `json:"id" db:"id"`
+	Code              string         `json:"code" db:"code"`
+	Target            string         `json:"target" db:"target"`
+	DiscountType      string         `json:"discount_type" db:"discount_type"`
+	Value             int            `json:"value" db:"value"`       // Percent or minor units of Currency
+	Currency          money.Currency `json:"currency" db:"currency"` // Of fixed values
+	ExpiresAt         *time.Time     `json:"expires_at,omitempty" db:"expires_at"`
+	MaxRedemptions    int            `json:"max_redemptions" db:"max_redemptions"` // 0 means unlimited
+	PerUserLimit      int            `json:"per_user_limit" db:"per_user_limit"`   // 0 means unlimited
+	FirstPurchaseOnly bool           `json:"first_purchase_only" db:"first_purchase_only"`
+	Active            bool           `json:"active" db:"active"`
+	Redemptions       int            `json:"redemptions" db:"-"` // Applied redemptions so far
+	CreatedAt         time.Time      `json:"created_at" db:"created_at"`
+	UpdatedAt         time.Time      `json:"updated_at" db:"updated_at"`
+}
+
+// PromoRedemption records one use of a promo code.
+type PromoRedemption struct {
+	ID          int         `json:"id" db:"id"`
+	PromoCodeID int         `json:"promo_code_id" db:"promo_code_id"`
+	UserID      int         `json:"user_id" db:"user_id"`
+	PurchaseID  *int        `json:"purchase_id,omitempty" db:"purchase_id"`
+	TopUpID     *int        `json:"topup_id,omitempty" db:"topup_id"`
+	Amount      money.Money `json:"amount" db:"amount"` // Discount or bonus
+	Status      string      `json:"status" db:"status"`
+	CreatedAt   time.Time   `json:"created_at" db:"created_at"`
+	VoidedAt    *time.Time  `json:"voided_at,omitempty" db:"voided_at"`
+}
+
+// Subscription statuses
+const (
+	SubscriptionStatusActive  = "active"
+	SubscriptionStatusPastDue = "past_due" // renewal failed, retried until the grace period ends
+	SubscriptionStatusExpired = "expired"
+)
+
+// Plan is a monthly subscription with an allowance of reports.
+type Plan struct {
+	Code            string      `json:"code" db:"code"`
+	Name            string      `json:"name" db:"name"`
+	Price           money.Money `json:"price" db:"price"` // Per month, always in money.Base
+	ReportAllowance int         `json:"report_allowance" db:"report_allowance"`
+	Active          bool        `json:"active" db:"active"`
+	CreatedAt       time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at" db:"updated_at"`
+}
+
+// Subscription is a user's plan with the state of the current billing period.
+type Subscription struct {
+	ID                 int         `json:"id" db:"id"`
+	UserID             int         `json:"user_id" db:"user_id"`
+	PlanCode           string      `json:"plan_code" db:"plan_code"`
+	Status             string      `json:"status" db:"status"`
+	Price              money.Money `json:"price" db:"price"` // Paid for the current period
+	ReportAllowance    int         `json:"report_allowance" db:"report_allowance"`
+	ReportsUsed        int         `json:"reports_used" db:"reports_used"`
+	CurrentPeriodStart time.Time   `json:"current_period_start" db:"current_period_start"`
+	CurrentPeriodEnd   time.Time   `json:"current_period_end" db:"current_period_end"`
+	CancelAtPeriodEnd  bool        `json:"cancel_at_period_end" db:"cancel_at_period_end"`
+	LastError          string      `json:"last_error,omitempty" db:"last_error"`
+	CreatedAt          time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time   `json:"updated_at" db:"updated_at"`
+}
+
 // Auth request/response models
 type RegisterRequest struct {
 	Login    string `json:"login" binding:"required,min=3,max=50"`
 	Password string `json:"password" binding:"required,min=6"`
+	Email    string `json:"email" binding:"omitempty,email,max=255"`
 }
 
 type LoginRequest struct {
-	Login    string `json:"login" binding:"required"`
+	Login    string `json:"login" binding:"required"` // login or verified email
 	Password string `json:"password" binding:"required"`
 }
 
 type AuthResponse struct {
-	AccessToken string `json:"access_token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // Seconds until the access token expires
+}
+
+type RevokeTokensRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login" binding:"required"` // login or verified email
+}
+
+type SetEmailRequest struct {
+	Email string `json:"email" binding:"required,email,max=255"`
+}
+
+type EmailResponse struct {
+	Email           *string    `json:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+// LoginChallengeResponse is returned by login instead of tokens when 2FA is on.
+type LoginChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int    `json:"expires_in"` // Seconds left to complete the login
+}
+
+type CompleteLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+type TwoFactorEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP or recovery code
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"min=0"` // 0 for a key that doesn't expire
+}
+
+// CreateAPIKeyResponse carries the key itself, which is never shown again.
+type CreateAPIKeyResponse struct {
+	Key    string `json:"key"`
+	APIKey APIKey `json:"api_key"`
+}
+
+type APIKeysResponse struct {
+	APIKeys []APIKey `json:"api_keys"`
+}
+
+// OIDCStartResponse tells where to send the user to log in at the provider.
+type OIDCStartResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+	ExpiresIn        int    `json:"expires_in"`
+}
+
+type OIDCProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+type IdentitiesResponse struct {
+	Identities []UserIdentity `json:"identities"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
 // User request/response models
@@ -45,16 +663,178 @@ type LinkAnonymousRequest struct {
 	ClientGeneratedID string `json:"client_generated_id" binding:"required"`
 }
 
+// ReportFilter narrows down and orders a user's reports. Zero values don't
+// filter.
+type ReportFilter struct {
+	Purchased    *bool
+	From         *time.Time // created at or after
+	To           *time.Time // created before
+	ProductCodes []string
+	Statuses     []string
+	Query        string // Words to look for in titles and targets
+	Sort         string // One of the ReportSort values, ReportSortNewest if empty
+}
+
+// Report list orders
+const (
+	ReportSortNewest    = "-created_at"
+	ReportSortOldest    = "created_at"
+	ReportSortTitle     = "title"
+	ReportSortTitleDesc = "-title"
+	ReportSortRelevance = "relevance" // best matches of the query first
+)
+
+// ReportCursor is a position in a report list sorted by creation time, just
+// past the report with the given created_at and _id.
+type ReportCursor struct {
+	CreatedAt time.Time
+	ID        bson.ObjectID
+	Backward  bool // the page before the position rather than after it
+}
+
+// ReportPage selects a page of the report list, by Offset or, when set, by
+// Cursor.
+type ReportPage struct {
+	Limit        int
+	Offset       int
+	Cursor       string
+	IncludeTotal *bool // Defaults to true in offset mode and false in cursor mode
+}
+
 type ReportsResponse struct {
-	Reports []Report `json:"reports"`
-	Total   int64    `json:"total"`
-	Limit   int      `json:"limit"`
-	Offset  int      `json:"offset"`
+	Reports    []Report `json:"reports"`
+	Total      *int64   `json:"total,omitempty"`
+	Limit      int      `json:"limit"`
+	Offset     int      `json:"offset"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+	PrevCursor string   `json:"prev_cursor,omitempty"`
+}
+
+type WalletsResponse struct {
+	Wallets []Wallet `json:"wallets"`
+}
+
+type JWKSResponse struct {
+	Keys []JWK `json:"keys"`
+}
+
+type SessionsResponse struct {
+	Sessions []Session `json:"sessions"`
+}
+
+type UsersResponse struct {
+	Users []User `json:"users"`
+}
+
+// AdminUserResponse is what support sees about a user.
+type AdminUserResponse struct {
+	User    User     `json:"user"`
+	Wallets []Wallet `json:"wallets"`
+	TwoFA   bool     `json:"two_factor_enabled"`
+}
+
+type PurchasesResponse struct {
+	Purchases []Purchase `json:"purchases"`
+	Limit     int        `json:"limit"`
+	Offset    int        `json:"offset"`
+}
+
+type TransactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+	Limit        int           `json:"limit"`
+	Offset       int           `json:"offset"`
+}
+
+// Billing request models
+type CreateTopUpRequest struct {
+	Amount    int64  `json:"amount" binding:"required,min=1"` // Amount in minor units of Currency
+	Currency  string `json:"currency"`                        // Wallet to top up, RUB by default
+	PromoCode string `json:"promo_code"`
+}
+
+// Subscription request models
+type SubscribeRequest struct {
+	PlanCode string `json:"plan_code" binding:"required"`
+}
+
+// Report request models
+type PurchaseReportRequest struct {
+	Currency  string `json:"currency"` // Wallet to pay from, RUB by default
+	PromoCode string `json:"promo_code"`
+}
+
+// SubmitReportRequest asks for a report to be generated from input.
+type SubmitReportRequest struct {
+	ClientGeneratedID string          `json:"client_generated_id"`
+	ProductCode       string          `json:"product_code"`
+	Title             string          `json:"title" binding:"max=200"`
+	Target            string          `json:"target" binding:"max=200"`
+	Input             json.RawMessage `json:"input" binding:"required"`
 }
 
 // Mock request models
 type CreateReportRequest struct {
 	ClientGeneratedID string `json:"client_generated_id" binding:"required"`
+	ProductCode       string `json:"product_code"`
+	Title             string `json:"title" binding:"max=200"`
+	Target            string `json:"target" binding:"max=200"`
+}
+
+type CompletePaymentRequest struct {
+	Status string `json:"status" binding:"required,oneof=succeeded failed"`
+	Reason string `json:"reason"`
+}
+
+// Admin request models
+type AdjustBalanceRequest struct {
+	Amount   int64  `json:"amount" binding:"required"` // Signed, in minor units of Currency; negative takes money away
+	Currency string `json:"currency"`                  // RUB by default
+	Reason   string `json:"reason" binding:"required"`
+}
+
+type DisableUserRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+type SetRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=user support admin"`
+}
+
+type RefundPurchaseRequest struct {
+	Amount int64  `json:"amount" binding:"min=0"` // In the purchase currency, 0 refunds whatever is left
+	Reason string `json:"reason" binding:"required"`
+}
+
+type CreateProductRequest struct {
+	Code     string `json:"code" binding:"required,max=64"`
+	Name     string `json:"name" binding:"required"`
+	Price    int64  `json:"price" binding:"min=0"` // In minor units of Currency
+	Currency string `json:"currency"`              // RUB by default
+}
+
+type UpdateProductRequest struct {
+	Name   *string `json:"name"`
+	Price  *int64  `json:"price" binding:"omitempty,min=0"` // In the product's currency
+	Active *bool   `json:"active"`
+}
+
+type CreatePromoCodeRequest struct {
+	Code              string     `json:"code" binding:"required,max=64"`
+	Target            string     `json:"target" binding:"required,oneof=purchase topup"`
+	DiscountType      string     `json:"discount_type" binding:"required,oneof=percent fixed"`
+	Value             int        `json:"value" binding:"required,min=1"`
+	Currency          string     `json:"currency"` // Of fixed values, RUB by default
+	ExpiresAt         *time.Time `json:"expires_at"`
+	MaxRedemptions    int        `json:"max_redemptions" binding:"min=0"`
+	PerUserLimit      int        `json:"per_user_limit" binding:"min=0"`
+	FirstPurchaseOnly bool       `json:"first_purchase_only"`
+}
+
+type UpdatePromoCodeRequest struct {
+	Active         *bool      `json:"active"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	MaxRedemptions *int       `json:"max_redemptions" binding:"omitempty,min=0"`
+	PerUserLimit   *int       `json:"per_user_limit" binding:"omitempty,min=0"`
 }
 
 // Error response model
@@ -0,0 +1,126 @@
+// Package money represents amounts of money as minor units (cents, kopecks)
+// together with their currency, and converts them between currencies.
+//
+// Rounding is never implicit: every operation that can produce a fraction of
+// a minor unit takes a RoundingMode. The service follows two rules:
+//   - amounts the user pays (prices converted to the wallet currency, prorated
+//     upgrade charges) are rounded with RoundHalfUp;
+//   - amounts we give away (discounts, bonuses, prorated credits) are rounded
+//     with RoundDown, so they never exceed what was configured.
+package money
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Currency string
+
+const (
+	RUB Currency = "RUB"
+	USD Currency = "USD"
+	EUR Currency = "EUR"
+)
+
+// Base is the currency of every amount stored before wallets had currencies.
+// Exchange rates are quoted against it and subscriptions are billed in it.
+const Base = RUB
+
+// minorUnits is how many minor units make up one unit of each currency.
+var minorUnits = map[Currency]int64{
+	RUB: 100,
+	USD: 100,
+	EUR: 100,
+}
+
+// ParseCurrency validates a currency code; an empty code means Base.
+func ParseCurrency(code string) (Currency, error) {
+	if code == "" {
+		return Base, nil
+	}
+
+	c := Currency(strings.ToUpper(strings.TrimSpace(code)))
+	if !c.Valid() {
+		return "", fmt.Errorf("unsupported currency")
+	}
+
+	return c, nil
+}
+
+func (c Currency) Valid() bool {
+	_, ok := minorUnits[c]
+	return ok
+}
+
+// Money is an amount in minor units of its currency.
+type Money struct {
+	Amount   int64    `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+func New(amount int64, currency Currency) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Add and Sub panic when the currencies differ: mixing currencies without an
+// explicit conversion is a programming error.
+func (m Money) Add(other Money) Money {
+	m.mustMatch(other)
+	return Money{Amount: m.Amount + other.Amount, Currency: m.Currency}
+}
+
+func (m Money) Sub(other Money) Money {
+	m.mustMatch(other)
+	return Money{Amount: m.Amount - other.Amount, Currency: m.Currency}
+}
+
+func (m Money) LessThan(other Money) bool {
+	m.mustMatch(other)
+	return m.Amount < other.Amount
+}
+
+func (m Money) Min(other Money) Money {
+	if other.LessThan(m) {
+		return other
+	}
+	return m
+}
+
+// Scale multiplies the amount by num/den, e.g. a percentage or the part of a
+// billing period, rounding the result to minor units with mode.
+func (m Money) Scale(num, den int64, mode RoundingMode) Money {
+	return Money{Amount: divide(m.Amount*num, den, mode), Currency: m.Currency}
+}
+
+func (m Money) String() string {
+	units := minorUnits[m.Currency]
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount/units, amount%units, m.Currency)
+}
+
+func (m Money) mustMatch(other Money) {
+	if m.Currency != other.Currency {
+		panic(fmt.Sprintf("money: currency mismatch %s and %s", m.Currency, other.Currency))
+	}
+}
@@ -0,0 +1,165 @@
+package money
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDivide(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		halfUp   int64
+		down     int64
+		up       int64
+	}{
+		{num: 10, den: 5, halfUp: 2, down: 2, up: 2},
+		{num: 0, den: 7, halfUp: 0, down: 0, up: 0},
+		{num: 11, den: 10, halfUp: 1, down: 1, up: 2},    // 1.1
+		{num: 14, den: 10, halfUp: 1, down: 1, up: 2},    // 1.4
+		{num: 15, den: 10, halfUp: 2, down: 1, up: 2},    // 1.5
+		{num: 25, den: 10, halfUp: 3, down: 2, up: 3},    // 2.5
+		{num: 19, den: 10, halfUp: 2, down: 1, up: 2},    // 1.9
+		{num: 1, den: 2, halfUp: 1, down: 0, up: 1},      // 0.5
+		{num: 1, den: 3, halfUp: 0, down: 0, up: 1},      // 0.333...
+		{num: 2, den: 3, halfUp: 1, down: 0, up: 1},      // 0.666...
+		{num: 499, den: 1000, halfUp: 0, down: 0, up: 1}, // 0.499
+		{num: -11, den: 10, halfUp: -1, down: -1, up: -2},
+		{num: -15, den: 10, halfUp: -2, down: -1, up: -2},
+		{num: -25, den: 10, halfUp: -3, down: -2, up: -3},
+		{num: -19, den: 10, halfUp: -2, down: -1, up: -2},
+		{num: -1, den: 2, halfUp: -1, down: 0, up: -1},
+		{num: -1, den: 3, halfUp: 0, down: 0, up: -1},
+	}
+
+	for _, tt := range tests {
+		for _, c := range []struct {
+			name string
+			mode RoundingMode
+			want int64
+		}{
+			{"RoundHalfUp", RoundHalfUp, tt.halfUp},
+			{"RoundDown", RoundDown, tt.down},
+			{"RoundUp", RoundUp, tt.up},
+		} {
+			t.Run(fmt.Sprintf("%d/%d %s", tt.num, tt.den, c.name), func(t *testing.T) {
+				if got := divide(tt.num, tt.den, c.mode); got != c.want {
+					t.Errorf("divide(%d, %d) = %d, want %d", tt.num, tt.den, got, c.want)
+				}
+			})
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   int64
+		num, den int64
+		mode     RoundingMode
+		want     int64
+	}{
+		{"whole percentage", 1000, 15, 100, RoundDown, 150},
+		{"percentage down", 999, 15, 100, RoundDown, 149},      // 149.85
+		{"percentage half up", 999, 15, 100, RoundHalfUp, 150}, // 149.85
+		{"half cent up", 5, 1, 10, RoundHalfUp, 1},             // 0.5
+		{"half cent down", 5, 1, 10, RoundDown, 0},             // 0.5
+		{"third of a period", 2000, 1, 3, RoundHalfUp, 667},    // 666.67
+		{"third of a period down", 2000, 1, 3, RoundDown, 666}, // 666.67
+		{"negative", -999, 15, 100, RoundHalfUp, -150},         // -149.85
+		{"negative down", -999, 15, 100, RoundDown, -149},      // -149.85
+		{"zero", 0, 15, 100, RoundUp, 0},
+		{"more than whole", 100, 3, 2, RoundDown, 150},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := New(tt.amount, USD).Scale(tt.num, tt.den, tt.mode)
+			if got != New(tt.want, USD) {
+				t.Errorf("Scale(%d, %d) of %d = %v, want %d USD", tt.num, tt.den, tt.amount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a, b := New(1050, RUB), New(275, RUB)
+
+	if got := a.Add(b); got != New(1325, RUB) {
+		t.Errorf("Add = %v", got)
+	}
+	if got := b.Sub(a); got != New(-775, RUB) {
+		t.Errorf("Sub = %v", got)
+	}
+	if !b.LessThan(a) || a.LessThan(b) {
+		t.Errorf("LessThan is wrong for %v and %v", a, b)
+	}
+	if got := a.Min(b); got != b {
+		t.Errorf("Min = %v", got)
+	}
+	if got := a.Neg(); got != New(-1050, RUB) {
+		t.Errorf("Neg = %v", got)
+	}
+}
+
+func TestCurrencyMismatchPanics(t *testing.T) {
+	rub, usd := New(100, RUB), New(100, USD)
+
+	tests := []struct {
+		name string
+		op   func()
+	}{
+		{"Add", func() { rub.Add(usd) }},
+		{"Sub", func() { rub.Sub(usd) }},
+		{"LessThan", func() { rub.LessThan(usd) }},
+		{"Min", func() { rub.Min(usd) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s of RUB and USD didn't panic", tt.name)
+				}
+			}()
+			tt.op()
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{New(12345, RUB), "123.45 RUB"},
+		{New(5, USD), "0.05 USD"},
+		{New(-150, EUR), "-1.50 EUR"},
+		{New(0, RUB), "0.00 RUB"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.money.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestParseCurrency(t *testing.T) {
+	tests := []struct {
+		code    string
+		want    Currency
+		wantErr bool
+	}{
+		{code: "", want: Base},
+		{code: "usd", want: USD},
+		{code: " EUR ", want: EUR},
+		{code: "GBP", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseCurrency(tt.code)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseCurrency(%q) = %q, %v", tt.code, got, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Rates are exchange rates against Base: how many units of Base one unit of
+// a currency is worth. Rates are exact decimals, so conversions round once.
+type Rates struct {
+	rates map[Currency]*big.Rat
+}
+
+// ParseRates reads rates like "USD=92.50,EUR=100.10". Base is always 1.
+func ParseRates(spec string) (*Rates, error) {
+	r := &Rates{rates: map[Currency]*big.Rat{Base: big.NewRat(1, 1)}}
+
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		code, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid exchange rate %q", pair)
+		}
+
+		currency, err := ParseCurrency(code)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exchange rate %q: %w", pair, err)
+		}
+
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q", pair)
+		}
+
+		if currency == Base && rate.Cmp(big.NewRat(1, 1)) != 0 {
+			return nil, fmt.Errorf("rate of the base currency %s must be 1", Base)
+		}
+		r.rates[currency] = rate
+	}
+
+	return r, nil
+}
+
+// Convert converts m to currency to, rounding to minor units with mode.
+func (r *Rates) Convert(m Money, to Currency, mode RoundingMode) (Money, error) {
+	if m.Currency == to {
+		return m, nil
+	}
+
+	from, ok := r.rates[m.Currency]
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", m.Currency)
+	}
+	target, ok := r.rates[to]
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate for %s", to)
+	}
+
+	// minor(from) / units(from) * rate(from) / rate(to) * units(to)
+	value := new(big.Rat).SetFrac64(m.Amount, minorUnits[m.Currency])
+	value.Mul(value, from)
+	value.Quo(value, target)
+	value.Mul(value, new(big.Rat).SetInt64(minorUnits[to]))
+
+	return Money{Amount: roundRat(value, mode), Currency: to}, nil
+}
+
+// Quotes lists every known rate against Base as a decimal string.
+func (r *Rates) Quotes() map[Currency]string {
+	quotes := make(map[Currency]string, len(r.rates))
+	for currency, rate := range r.rates {
+		quotes[currency] = strings.TrimRight(strings.TrimRight(rate.FloatString(6), "0"), ".")
+	}
+
+	return quotes
+}
@@ -0,0 +1,98 @@
+package money
+
+import "testing"
+
+func TestParseRates(t *testing.T) {
+	tests := []struct {
+		spec    string
+		wantErr bool
+	}{
+		{spec: ""},
+		{spec: "USD=90.00,EUR=98.00"},
+		{spec: " USD = 92.5 , , EUR=100.10"},
+		{spec: "RUB=1,USD=90"},
+		{spec: "USD", wantErr: true},
+		{spec: "USD=abc", wantErr: true},
+		{spec: "USD=0", wantErr: true},
+		{spec: "USD=-1", wantErr: true},
+		{spec: "GBP=110", wantErr: true},
+		{spec: "RUB=2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseRates(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRates(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	rates, err := ParseRates("USD=90.00,EUR=98.50")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		from Money
+		to   Currency
+		mode RoundingMode
+		want Money
+	}{
+		{"same currency", New(1234, USD), USD, RoundDown, New(1234, USD)},
+		{"to base", New(1000, USD), RUB, RoundHalfUp, New(90000, RUB)},
+		{"from base exact", New(90000, RUB), USD, RoundHalfUp, New(1000, USD)},
+		{"from base half up", New(500, RUB), USD, RoundHalfUp, New(6, USD)}, // 5.555...
+		{"from base down", New(500, RUB), USD, RoundDown, New(5, USD)},
+		{"from base up", New(100, RUB), USD, RoundUp, New(2, USD)},     // 1.11
+		{"half boundary", New(45, RUB), USD, RoundHalfUp, New(1, USD)}, // 0.5
+		{"half boundary down", New(45, RUB), USD, RoundDown, New(0, USD)},
+		{"between currencies", New(1000, EUR), USD, RoundHalfUp, New(1094, USD)}, // 1094.44
+		{"between currencies down", New(1000, EUR), USD, RoundDown, New(1094, USD)},
+		{"between currencies up", New(1000, EUR), USD, RoundUp, New(1095, USD)},
+		{"negative", New(-500, RUB), USD, RoundHalfUp, New(-6, USD)},
+		{"negative down", New(-500, RUB), USD, RoundDown, New(-5, USD)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rates.Convert(tt.from, tt.to, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Convert(%v, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertUnknownRate(t *testing.T) {
+	rates, err := ParseRates("USD=90")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rates.Convert(New(100, EUR), RUB, RoundHalfUp); err == nil {
+		t.Error("converting from a currency without a rate didn't fail")
+	}
+	if _, err := rates.Convert(New(100, RUB), EUR, RoundHalfUp); err == nil {
+		t.Error("converting to a currency without a rate didn't fail")
+	}
+}
+
+func TestQuotes(t *testing.T) {
+	rates, err := ParseRates("USD=92.50,EUR=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quotes := rates.Quotes()
+	want := map[Currency]string{RUB: "1", USD: "92.5", EUR: "100"}
+	for currency, quote := range want {
+		if quotes[currency] != quote {
+			t.Errorf("quote of %s = %q, want %q", currency, quotes[currency], quote)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package money
+
+import "math/big"
+
+// RoundingMode decides what happens to a fraction of a minor unit.
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds to the nearest minor unit, halves away from zero:
+	// 1.5 -> 2, 2.5 -> 3, -1.5 -> -2.
+	RoundHalfUp RoundingMode = iota
+	// RoundDown drops the fraction (towards zero): 1.9 -> 1, -1.9 -> -1.
+	RoundDown
+	// RoundUp rounds any fraction away from zero: 1.1 -> 2, -1.1 -> -2.
+	RoundUp
+)
+
+// divide returns num/den rounded with mode. den must be positive.
+func divide(num, den int64, mode RoundingMode) int64 {
+	return roundRat(new(big.Rat).SetFrac64(num, den), mode)
+}
+
+// roundRat rounds r to an integer with mode.
+func roundRat(r *big.Rat, mode RoundingMode) int64 {
+	num, den := r.Num(), r.Denom()
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Sign() == 0 {
+		return quo.Int64()
+	}
+
+	// Away from zero is the direction of the dividend's sign
+	away := int64(num.Sign())
+
+	switch mode {
+	case RoundUp:
+		return quo.Int64() + away
+	case RoundHalfUp:
+		// |rem| * 2 >= den means the fraction is at least a half
+		twice := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2))
+		if twice.Cmp(den) >= 0 {
+			return quo.Int64() + away
+		}
+	}
+
+	return quo.Int64()
+}
@@ -0,0 +1,239 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	mockCodeTTL    = time.Minute
+	mockIDTokenTTL = 5 * time.Minute
+)
+
+// MockServer is an OpenID provider for local testing. It logs in whoever
+// the authorization request names in login_hint, without asking anything.
+type MockServer struct {
+	issuer string
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	identity      Identity
+	expiresAt     time.Time
+}
+
+// MockTokenError is an OAuth error response of the mock token endpoint.
+type MockTokenError struct {
+	Code string
+}
+
+func (e *MockTokenError) Error() string {
+	return e.Code
+}
+
+func NewMockServer(issuer string) (*MockServer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+
+	return &MockServer{
+		issuer: issuer,
+		key:    key,
+		kid:    hex.EncodeToString(kid),
+		codes:  map[string]mockGrant{},
+	}, nil
+}
+
+func (m *MockServer) Metadata() *Metadata {
+	return &Metadata{
+		Issuer:                        m.issuer,
+		AuthorizationEndpoint:         m.issuer + "/authorize",
+		TokenEndpoint:                 m.issuer + "/token",
+		JWKSURI:                       m.issuer + "/jwks",
+		ResponseTypesSupported:        []string{"code"},
+		SubjectTypesSupported:         []string{"public"},
+		IDTokenSigningAlgValues:       []string{"RS256"},
+		CodeChallengeMethodsSupported: []string{"S256"},
+	}
+}
+
+// JWKS returns the key set ID tokens are signed with.
+func (m *MockServer) JWKS() interface{} {
+	return map[string]interface{}{
+		"keys": []jsonWebKey{{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: "RS256",
+			Kid: m.kid,
+			N:   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	}
+}
+
+// Authorize handles an authorization request and returns the redirect back
+// to the client. The user is login_hint, an email; sub may be given to test
+// other identities. The email is only verified with email_verified=true. Requests that can't be redirected
+// back safely return an error instead.
+func (m *MockServer) Authorize(params url.Values) (string, error) {
+	redirectURI := params.Get("redirect_uri")
+	if params.Get("client_id") == "" || redirectURI == "" {
+		return "", fmt.Errorf("client_id and redirect_uri are required")
+	}
+	redirect, err := url.Parse(redirectURI)
+	if err != nil || !redirect.IsAbs() {
+		return "", fmt.Errorf("invalid redirect_uri")
+	}
+
+	reply := redirect.Query()
+	reply.Set("state", params.Get("state"))
+
+	email := params.Get("login_hint")
+	switch {
+	case params.Get("response_type") != "code":
+		reply.Set("error", "unsupported_response_type")
+	case params.Get("code_challenge") == "" || params.Get("code_challenge_method") != "S256":
+		reply.Set("error", "invalid_request")
+		reply.Set("error_description", "PKCE with S256 is required")
+	case !strings.Contains(" "+params.Get("scope")+" ", " openid "):
+		reply.Set("error", "invalid_scope")
+	case email == "":
+		reply.Set("error", "login_required")
+		reply.Set("error_description", "login_hint names the user to log in")
+	default:
+		subject := params.Get("sub")
+		if subject == "" {
+			sum := sha256.Sum256([]byte(strings.ToLower(email)))
+			subject = hex.EncodeToString(sum[:8])
+		}
+
+		code, err := randomString()
+		if err != nil {
+			return "", err
+		}
+
+		m.mu.Lock()
+		m.removeExpired()
+		m.codes[code] = mockGrant{
+			clientID:      params.Get("client_id"),
+			redirectURI:   redirectURI,
+			codeChallenge: params.Get("code_challenge"),
+			nonce:         params.Get("nonce"),
+			identity: Identity{
+				Subject:       subject,
+				Email:         email,
+				EmailVerified: params.Get("email_verified") == "true",
+				Name:          strings.SplitN(email, "@", 2)[0],
+			},
+			expiresAt: time.Now().Add(mockCodeTTL),
+		}
+		m.mu.Unlock()
+
+		reply.Set("code", code)
+	}
+
+	redirect.RawQuery = reply.Encode()
+	return redirect.String(), nil
+}
+
+// Token redeems an authorization code for an ID token. Client secrets
+// aren't checked; the PKCE verifier and redirect URI are.
+func (m *MockServer) Token(params url.Values, clientID string) (map[string]interface{}, error) {
+	if params.Get("grant_type") != "authorization_code" {
+		return nil, &MockTokenError{Code: "unsupported_grant_type"}
+	}
+	if clientID == "" {
+		clientID = params.Get("client_id")
+	}
+
+	m.mu.Lock()
+	grant, ok := m.codes[params.Get("code")]
+	delete(m.codes, params.Get("code"))
+	m.mu.Unlock()
+
+	if !ok || time.Now().After(grant.expiresAt) || grant.clientID != clientID || grant.redirectURI != params.Get("redirect_uri") {
+		return nil, &MockTokenError{Code: "invalid_grant"}
+	}
+	if subtle.ConstantTimeCompare([]byte(Challenge(params.Get("code_verifier"))), []byte(grant.codeChallenge)) != 1 {
+		return nil, &MockTokenError{Code: "invalid_grant"}
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            m.issuer,
+		"sub":            grant.identity.Subject,
+		"aud":            grant.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(mockIDTokenTTL).Unix(),
+		"auth_time":      now.Unix(),
+		"email":          grant.identity.Email,
+		"email_verified": grant.identity.EmailVerified,
+		"name":           grant.identity.Name,
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(mockIDTokenTTL.Seconds()),
+		"id_token":     idToken,
+	}, nil
+}
+
+func (m *MockServer) removeExpired() {
+	now := time.Now()
+	for code, grant := range m.codes {
+		if now.After(grant.expiresAt) {
+			delete(m.codes, code)
+		}
+	}
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+
+	"github.com/lib/pq"
+)
+
+const apiKeyColumns = `id, user_id, name, prefix, scopes, expires_at, last_used_at, last_used_ip, created_at`
+
+// lastUsedPrecision limits last-used updates to one per key per minute.
+const lastUsedPrecision = time.Minute
+
+type APIKeyRepository struct {
+	db *sql.DB
+}
+
+func NewAPIKeyRepository(db *sql.DB) *APIKeyRepository {
+	return &APIKeyRepository{db: db}
+}
+
+func scanAPIKey(row rowScanner) (*models.APIKey, error) {
+	var k models.APIKey
+	err := row.Scan(
+		&k.ID,
+		&k.UserID,
+		&k.Name,
+		&k.Prefix,
+		pq.Array(&k.Scopes),
+		&k.ExpiresAt,
+		&k.LastUsedAt,
+		&k.LastUsedIP,
+		&k.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// CreateAPIKey stores a key, unless the user already has maxKeys active ones.
+// A zero ttl means the key doesn't expire.
+func (r *APIKeyRepository) CreateAPIKey(userID int, name, prefix, keyHash string, scopes []string, ttl time.Duration, maxKeys int) (*models.APIKey, error) {
+	var key *models.APIKey
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		// Serialise key creation per user so the limit holds
+		if _, err := tx.Exec(`SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		var active int
+		err := tx.QueryRow(`
+			SELECT COUNT(*) FROM api_keys
+			WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		`, userID).Scan(&active)
+		if err != nil {
+			return fmt.Errorf("failed to count API keys: %w", err)
+		}
+		if active >= maxKeys {
+			return fmt.Errorf("too many api keys")
+		}
+
+		var expiresIn *float64
+		if ttl > 0 {
+			seconds := ttl.Seconds()
+			expiresIn = &seconds
+		}
+
+		key, err = scanAPIKey(tx.QueryRow(`
+			INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5, NOW() + $6 * INTERVAL '1 second')
+			RETURNING `+apiKeyColumns, userID, name, prefix, keyHash, pq.Array(scopes), expiresIn))
+		if err != nil {
+			return fmt.Errorf("failed to create API key: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetActiveAPIKeys lists the user's keys that aren't revoked or expired, newest first.
+func (r *APIKeyRepository) GetActiveAPIKeys(userID int) ([]models.APIKey, error) {
+	query := `
+		SELECT ` + apiKeyColumns + `
+		FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		ORDER BY created_at DESC, id DESC
+	`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API key: %w", err)
+		}
+		keys = append(keys, *k)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes one of the user's keys.
+func (r *APIKeyRepository) RevokeAPIKey(userID, keyID int) error {
+	result, err := r.db.Exec(`
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, keyID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("api key not found")
+	}
+
+	return nil
+}
+
+// RevokeUserAPIKeys revokes every key of the user, returning how many.
+func (r *APIKeyRepository) RevokeUserAPIKeys(userID int) (int64, error) {
+	result, err := r.db.Exec(`
+		UPDATE api_keys SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke API keys: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// UseAPIKey looks up a usable key by its hash and records that it was used
+// from ip. Keys of disabled users aren't usable.
+func (r *APIKeyRepository) UseAPIKey(keyHash, ip string) (*models.APIKey, error) {
+	key, err := scanAPIKey(r.db.QueryRow(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys k
+		WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		  AND EXISTS (SELECT 1 FROM users u WHERE u.id = k.user_id AND u.disabled_at IS NULL)
+	`, keyHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid api key")
+		}
+		return nil, fmt.Errorf("failed to get API key: %w", err)
+	}
+
+	_, err = r.db.Exec(`
+		UPDATE api_keys SET last_used_at = NOW(), last_used_ip = $2
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - $3 * INTERVAL '1 second' OR last_used_ip <> $2)
+	`, key.ID, ip, lastUsedPrecision.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to record API key use: %w", err)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const idempotencyColumns = `id, scope, key, request_hash, status_code, content_type, response_body, created_at, completed_at`
+
+type IdempotencyRepository struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func NewIdempotencyRepository(db *sql.DB, ttl time.Duration) *IdempotencyRepository {
+	return &IdempotencyRepository{db: db, ttl: ttl}
+}
+
+func scanIdempotencyRecord(row rowScanner) (*models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	err := row.Scan(
+		&record.ID,
+		&record.Scope,
+		&record.Key,
+		&record.RequestHash,
+		&record.StatusCode,
+		&record.ContentType,
+		&record.ResponseBody,
+		&record.CreatedAt,
+		&record.CompletedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+// Begin reserves the key for a new request. When the key is already taken it
+// returns the existing record and false instead.
+func (r *IdempotencyRepository) Begin(scope, key, requestHash string) (*models.IdempotencyRecord, bool, error) {
+	// Expired keys may be reused
+	_, err := r.db.Exec(`
+		DELETE FROM idempotency_keys
+		WHERE scope = $1 AND key = $2 AND created_at < NOW() - $3 * INTERVAL '1 second'
+	`, scope, key, r.ttl.Seconds())
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to expire idempotency key: %w", err)
+	}
+
+	record, err := scanIdempotencyRecord(r.db.QueryRow(`
+		INSERT INTO idempotency_keys (scope, key, request_hash)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (scope, key) DO NOTHING
+		RETURNING `+idempotencyColumns, scope, key, requestHash))
+	if err == nil {
+		return record, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+
+	record, err = scanIdempotencyRecord(r.db.QueryRow(`
+		SELECT `+idempotencyColumns+`
+		FROM idempotency_keys
+		WHERE scope = $1 AND key = $2
+	`, scope, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Deleted in between; let the client retry
+			return nil, false, fmt.Errorf("idempotency key is being released")
+		}
+		return nil, false, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+
+	return record, false, nil
+}
+
+// Complete stores the response that replays of the key will receive.
+func (r *IdempotencyRepository) Complete(id, statusCode int, contentType string, body []byte) error {
+	_, err := r.db.Exec(`
+		UPDATE idempotency_keys
+		SET status_code = $2, content_type = $3, response_body = $4, completed_at = NOW()
+		WHERE id = $1
+	`, id, statusCode, contentType, body)
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// Release forgets the key so that the request can be retried with it.
+func (r *IdempotencyRepository) Release(id int) error {
+	if _, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE id = $1`, id); err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteExpired removes keys older than the TTL.
+func (r *IdempotencyRepository) DeleteExpired() (int64, error) {
+	result, err := r.db.Exec(`
+		DELETE FROM idempotency_keys
+		WHERE created_at < NOW() - $1 * INTERVAL '1 second'
+	`, r.ttl.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+
+	return result.RowsAffected()
+}
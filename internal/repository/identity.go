@@ -0,0 +1,225 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const identityColumns = `user_id, provider, subject, email, last_login_at, created_at`
+
+type IdentityRepository struct {
+	db *sql.DB
+}
+
+func NewIdentityRepository(db *sql.DB) *IdentityRepository {
+	return &IdentityRepository{db: db}
+}
+
+func scanIdentity(row rowScanner) (*models.UserIdentity, error) {
+	var identity models.UserIdentity
+	err := row.Scan(
+		&identity.UserID,
+		&identity.Provider,
+		&identity.Subject,
+		&identity.Email,
+		&identity.LastLoginAt,
+		&identity.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// CreateLoginState records a login started at provider. linkUserID is set
+// when the identity is to be linked to a logged-in user.
+func (r *IdentityRepository) CreateLoginState(stateHash, browserHash, provider, nonce, codeVerifier string, linkUserID *int, ttl time.Duration) error {
+	_, err := r.db.Exec(`
+		INSERT INTO oidc_login_states (state_hash, browser_hash, provider, nonce, code_verifier, link_user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW() + $7 * INTERVAL '1 second')
+	`, stateHash, browserHash, provider, nonce, codeVerifier, linkUserID, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to create login state: %w", err)
+	}
+
+	return nil
+}
+
+// TakeLoginState consumes the login state for the provider's callback; each
+// state can be used once, and only by the browser that started the login.
+func (r *IdentityRepository) TakeLoginState(stateHash, browserHash, provider string) (*models.OIDCLoginState, error) {
+	var state models.OIDCLoginState
+	var expired bool
+	err := r.db.QueryRow(`
+		DELETE FROM oidc_login_states
+		WHERE state_hash = $1 AND provider = $2 AND browser_hash = $3
+		RETURNING provider, nonce, code_verifier, link_user_id, expires_at <= NOW()
+	`, stateHash, provider, browserHash).Scan(&state.Provider, &state.Nonce, &state.CodeVerifier, &state.LinkUserID, &expired)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid state")
+		}
+		return nil, fmt.Errorf("failed to get login state: %w", err)
+	}
+	if expired {
+		return nil, fmt.Errorf("invalid state")
+	}
+
+	return &state, nil
+}
+
+// UseIdentity records a login with the identity, keeping the email the
+// provider reported last.
+func (r *IdentityRepository) UseIdentity(provider, subject, email string) (*models.UserIdentity, error) {
+	identity, err := scanIdentity(r.db.QueryRow(`
+		UPDATE user_identities SET last_login_at = NOW(), email = $3
+		WHERE provider = $1 AND subject = $2
+		RETURNING `+identityColumns, provider, subject, email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("identity not found")
+		}
+		return nil, fmt.Errorf("failed to use identity: %w", err)
+	}
+
+	return identity, nil
+}
+
+// LinkIdentity links the identity to the user. An identity logs in as one
+// user only, and a user has one identity per provider.
+func (r *IdentityRepository) LinkIdentity(userID int, provider, subject, email string) (*models.UserIdentity, error) {
+	identity, err := scanIdentity(r.db.QueryRow(`
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		RETURNING `+identityColumns, userID, provider, subject, email))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, fmt.Errorf("identity already linked")
+		}
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+
+	return identity, nil
+}
+
+// CreateUserWithIdentity creates a user without a password who logs in with
+// the identity. The email the provider verified becomes the user's verified
+// email; other emails aren't kept on the user.
+func (r *IdentityRepository) CreateUserWithIdentity(login, provider, subject, email string, emailVerified bool) (*models.User, error) {
+	var userEmail *string
+	if emailVerified && email != "" {
+		userEmail = &email
+	}
+
+	var user *models.User
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var err error
+		user, err = createUserTx(tx, login, "", userEmail, userEmail != nil)
+		if err != nil {
+			if isEmailTaken(err) {
+				return fmt.Errorf("email taken")
+			}
+			if isUniqueViolation(err) {
+				return fmt.Errorf("login taken")
+			}
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+			VALUES ($1, $2, $3, $4, NOW())
+		`, user.ID, provider, subject, email)
+		if err != nil {
+			if isUniqueViolation(err) {
+				return fmt.Errorf("identity already linked")
+			}
+			return fmt.Errorf("failed to link identity: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (r *IdentityRepository) GetUserIdentities(userID int) ([]models.UserIdentity, error) {
+	query := `
+		SELECT ` + identityColumns + `
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at, provider
+	`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []models.UserIdentity{}
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan identity: %w", err)
+		}
+		identities = append(identities, *identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// UnlinkIdentity removes the user's identity at provider, unless the user
+// has no password and it is their last way to log in.
+func (r *IdentityRepository) UnlinkIdentity(userID int, provider string) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		var passwordHash string
+		err := tx.QueryRow(`SELECT password_hash FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&passwordHash)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("user not found")
+			}
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		var others int
+		err = tx.QueryRow(`
+			SELECT COUNT(*) FROM user_identities WHERE user_id = $1 AND provider <> $2
+		`, userID, provider).Scan(&others)
+		if err != nil {
+			return fmt.Errorf("failed to count identities: %w", err)
+		}
+
+		result, err := tx.Exec(`DELETE FROM user_identities WHERE user_id = $1 AND provider = $2`, userID, provider)
+		if err != nil {
+			return fmt.Errorf("failed to unlink identity: %w", err)
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return fmt.Errorf("identity not found")
+		}
+
+		if passwordHash == "" && others == 0 {
+			return fmt.Errorf("last login method")
+		}
+
+		return nil
+	})
+}
+
+// DeleteExpired removes logins that were started but never completed.
+func (r *IdentityRepository) DeleteExpired() (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM oidc_login_states WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired login states: %w", err)
+	}
+
+	return result.RowsAffected()
+}
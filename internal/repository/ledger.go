@@ -0,0 +1,435 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+)
+
+// Journal entry kinds
+const (
+	EntryKindSignupBonus    = "signup_bonus"
+	EntryKindPurchase       = "purchase"
+	EntryKindTopUp          = "topup"
+	EntryKindRefund         = "refund"
+	EntryKindTopUpRefund    = "topup_refund"
+	EntryKindChargeback     = "chargeback"
+	EntryKindAdjustment     = "adjustment"
+	EntryKindOpeningBalance = "opening_balance"
+	EntryKindPromoBonus     = "promo_bonus"
+	EntryKindSubscription   = "subscription"
+)
+
+// System ledger accounts, the counterparties of user postings
+const (
+	AccountSignupBonus    = "system:signup_bonus"
+	AccountRevenue        = "system:revenue"
+	AccountPayments       = "system:payments"
+	AccountAdjustments    = "system:adjustments"
+	AccountOpeningBalance = "system:opening_balance"
+	AccountPromotions     = "system:promotions"
+)
+
+var systemAccountTypes = map[string]string{
+	AccountSignupBonus:    "expense",
+	AccountRevenue:        "revenue",
+	AccountPayments:       "asset",
+	AccountAdjustments:    "expense",
+	AccountOpeningBalance: "equity",
+	AccountPromotions:     "expense",
+}
+
+// posting is a single leg of a journal entry. Exactly one of account and
+// userID is set: userID selects the user's own account in the posting's currency.
+type posting struct {
+	account string
+	userID  int
+	amount  money.Money
+}
+
+type LedgerRepository struct {
+	db *sql.DB
+}
+
+func NewLedgerRepository(db *sql.DB) *LedgerRepository {
+	return &LedgerRepository{db: db}
+}
+
+func userAccountCode(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// accountCode names the account of a posting. Accounts in money.Base keep
+// the codes they had before currencies, others get the currency appended,
+// e.g. user:42:USD or system:revenue:EUR.
+func accountCode(p posting) string {
+	code := p.account
+	if p.userID != 0 {
+		code = userAccountCode(p.userID)
+	}
+
+	if p.amount.Currency != money.Base {
+		code += ":" + string(p.amount.Currency)
+	}
+
+	return code
+}
+
+// accountIDTx returns the ledger account id for a posting, creating the account on first use.
+func accountIDTx(tx *sql.Tx, p posting) (int, error) {
+	code, accountType := accountCode(p), systemAccountTypes[p.account]
+	var userID *int
+	if p.userID != 0 {
+		accountType, userID = "liability", &p.userID
+	}
+	if accountType == "" {
+		return 0, fmt.Errorf("unknown ledger account %s", code)
+	}
+
+	query := `
+		INSERT INTO ledger_accounts (code, user_id, type, currency)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (code) DO UPDATE SET code = EXCLUDED.code
+		RETURNING id
+	`
+
+	var id int
+	if err := tx.QueryRow(query, code, userID, accountType, p.amount.Currency).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to get ledger account %s: %w", code, err)
+	}
+
+	return id, nil
+}
+
+// postEntryTx writes a journal entry balanced in every currency and keeps the
+// wallets (and users.balance for money.Base) in sync for every user account
+// it touches. Unless allowOverdraft is set, a posting that would take a
+// wallet below zero fails with "insufficient balance".
+func postEntryTx(tx *sql.Tx, kind, reference, description string, postings []posting, allowOverdraft bool) (int, error) {
+	if len(postings) < 2 {
+		return 0, fmt.Errorf("journal entry needs at least two postings")
+	}
+
+	sums := make(map[money.Currency]int64)
+	for _, p := range postings {
+		if p.amount.IsZero() {
+			return 0, fmt.Errorf("journal entry has a zero posting")
+		}
+		if !p.amount.Currency.Valid() {
+			return 0, fmt.Errorf("journal entry has an unsupported currency %q", p.amount.Currency)
+		}
+		sums[p.amount.Currency] += p.amount.Amount
+	}
+	for _, sum := range sums {
+		if sum != 0 {
+			return 0, fmt.Errorf("journal entry is not balanced")
+		}
+	}
+
+	var entryID int
+	err := tx.QueryRow(`
+		INSERT INTO journal_entries (kind, reference, description)
+		VALUES ($1, $2, $3)
+		RETURNING id
+	`, kind, reference, description).Scan(&entryID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	for _, p := range postings {
+		accountID, err := accountIDTx(tx, p)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO ledger_postings (entry_id, account_id, amount)
+			VALUES ($1, $2, $3)
+		`, entryID, accountID, p.amount.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create posting: %w", err)
+		}
+
+		if p.userID == 0 {
+			continue
+		}
+
+		if err := updateWalletTx(tx, p.userID, p.amount, allowOverdraft); err != nil {
+			return 0, err
+		}
+	}
+
+	return entryID, nil
+}
+
+// updateWalletTx adds amount to the user's cached wallet balance; the row
+// lock serialises concurrent postings.
+func updateWalletTx(tx *sql.Tx, userID int, amount money.Money, allowOverdraft bool) error {
+	_, err := tx.Exec(`
+		INSERT INTO wallets (user_id, currency, balance)
+		VALUES ($1, $2, 0)
+		ON CONFLICT (user_id, currency) DO NOTHING
+	`, userID, amount.Currency)
+	if err != nil {
+		return fmt.Errorf("failed to create wallet: %w", err)
+	}
+
+	var newBalance int64
+	err = tx.QueryRow(`
+		UPDATE wallets
+		SET balance = balance + $3, updated_at = NOW()
+		WHERE user_id = $1 AND currency = $2 AND ($4 OR $3 > 0 OR balance + $3 >= 0)
+		RETURNING balance
+	`, userID, amount.Currency, amount.Amount, allowOverdraft).Scan(&newBalance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("insufficient balance")
+		}
+		return fmt.Errorf("failed to update cached balance: %w", err)
+	}
+
+	// users.balance mirrors the base wallet for older readers
+	if amount.Currency == money.Base {
+		if _, err := tx.Exec(`UPDATE users SET balance = $2 WHERE id = $1`, userID, newBalance); err != nil {
+			return fmt.Errorf("failed to update cached balance: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// creditUserTx moves amount from a system account to the user's wallet in the same currency.
+func creditUserTx(tx *sql.Tx, userID int, amount money.Money, kind, from, reference, description string) (int, error) {
+	return postEntryTx(tx, kind, reference, description, []posting{
+		{account: from, amount: amount.Neg()},
+		{userID: userID, amount: amount},
+	}, false)
+}
+
+// debitUserTx moves amount from the user's wallet in the same currency to a system account.
+func debitUserTx(tx *sql.Tx, userID int, amount money.Money, kind, to, reference, description string, allowOverdraft bool) (int, error) {
+	return postEntryTx(tx, kind, reference, description, []posting{
+		{userID: userID, amount: amount.Neg()},
+		{account: to, amount: amount},
+	}, allowOverdraft)
+}
+
+// withTx runs fn inside a transaction, committing on success.
+func withTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func (r *LedgerRepository) GetUserTransactions(userID, limit, offset int) ([]models.Transaction, error) {
+	query := `
+		SELECT e.id, e.kind, e.reference, e.description, p.amount, a.currency, e.created_at
+		FROM ledger_postings p
+		JOIN ledger_accounts a ON a.id = p.account_id
+		JOIN journal_entries e ON e.id = p.entry_id
+		WHERE a.user_id = $1
+		ORDER BY e.id DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := r.db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transactions: %w", err)
+	}
+	defer rows.Close()
+
+	transactions := []models.Transaction{}
+	for rows.Next() {
+		var t models.Transaction
+		if err := rows.Scan(&t.EntryID, &t.Kind, &t.Reference, &t.Description, &t.Amount.Amount, &t.Amount.Currency, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %w", err)
+		}
+		transactions = append(transactions, t)
+	}
+
+	return transactions, rows.Err()
+}
+
+// GetUserLedgerBalance sums the user's postings in currency, ignoring the cached wallet.
+func (r *LedgerRepository) GetUserLedgerBalance(userID int, currency money.Currency) (money.Money, error) {
+	query := `
+		SELECT COALESCE(SUM(p.amount), 0)
+		FROM ledger_postings p
+		JOIN ledger_accounts a ON a.id = p.account_id
+		WHERE a.user_id = $1 AND a.currency = $2
+	`
+
+	balance := money.New(0, currency)
+	if err := r.db.QueryRow(query, userID, currency).Scan(&balance.Amount); err != nil {
+		return money.Money{}, fmt.Errorf("failed to compute ledger balance: %w", err)
+	}
+
+	return balance, nil
+}
+
+// RecomputeUserBalance overwrites the user's cached wallets and users.balance with the ledger sums.
+func (r *LedgerRepository) RecomputeUserBalance(userID int) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			INSERT INTO wallets (user_id, currency, balance)
+			SELECT a.user_id, a.currency, 0 FROM ledger_accounts a WHERE a.user_id = $1
+			ON CONFLICT (user_id, currency) DO NOTHING
+		`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to create wallets: %w", err)
+		}
+
+		_, err = tx.Exec(`
+			UPDATE wallets w
+			SET balance = COALESCE((
+			    SELECT SUM(p.amount)
+			    FROM ledger_postings p
+			    JOIN ledger_accounts a ON a.id = p.account_id
+			    WHERE a.user_id = w.user_id AND a.currency = w.currency
+			), 0), updated_at = NOW()
+			WHERE w.user_id = $1
+		`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to recompute wallets: %w", err)
+		}
+
+		result, err := tx.Exec(`
+			UPDATE users u
+			SET balance = COALESCE((SELECT balance FROM wallets WHERE user_id = u.id AND currency = $2), 0)
+			WHERE u.id = $1
+		`, userID, money.Base)
+		if err != nil {
+			return fmt.Errorf("failed to recompute balance: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("user not found")
+		}
+
+		return nil
+	})
+}
+
+// FindBalanceMismatches lists user wallets, and users.balance as the base
+// wallet, whose cached balance disagrees with the ledger.
+func (r *LedgerRepository) FindBalanceMismatches() ([]models.BalanceMismatch, error) {
+	query := `
+		WITH ledger AS (
+		    SELECT a.user_id, a.currency, SUM(p.amount) AS balance
+		    FROM ledger_accounts a
+		    JOIN ledger_postings p ON p.account_id = a.id
+		    WHERE a.user_id IS NOT NULL
+		    GROUP BY a.user_id, a.currency
+		),
+		cached AS (
+		    SELECT user_id, currency, balance FROM wallets
+		    UNION ALL
+		    SELECT id, $1, balance FROM users
+		)
+		SELECT c.user_id, c.currency, c.balance, COALESCE(l.balance, 0)
+		FROM cached c
+		LEFT JOIN ledger l ON l.user_id = c.user_id AND l.currency = c.currency
+		WHERE c.balance <> COALESCE(l.balance, 0)
+		UNION
+		SELECT l.user_id, l.currency, 0, l.balance
+		FROM ledger l
+		WHERE NOT EXISTS (SELECT 1 FROM wallets w WHERE w.user_id = l.user_id AND w.currency = l.currency)
+		ORDER BY 1, 2
+	`
+
+	rows, err := r.db.Query(query, money.Base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconcile balances: %w", err)
+	}
+	defer rows.Close()
+
+	var mismatches []models.BalanceMismatch
+	for rows.Next() {
+		var m models.BalanceMismatch
+		var currency money.Currency
+		if err := rows.Scan(&m.UserID, &currency, &m.CachedBalance.Amount, &m.LedgerBalance.Amount); err != nil {
+			return nil, fmt.Errorf("failed to scan mismatch: %w", err)
+		}
+		m.CachedBalance.Currency, m.LedgerBalance.Currency = currency, currency
+		mismatches = append(mismatches, m)
+	}
+
+	return mismatches, rows.Err()
+}
+
+// BackfillOpeningBalances posts an opening balance entry for users created
+// before the ledger existed, so their ledger sum matches the stored balance.
+// Those balances predate currencies and are all in money.Base.
+func (r *LedgerRepository) BackfillOpeningBalances() (int, error) {
+	query := `
+		SELECT u.id, u.balance
+		FROM users u
+		WHERE u.balance <> 0
+		  AND NOT EXISTS (SELECT 1 FROM ledger_accounts a WHERE a.user_id = u.id)
+	`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find users without ledger accounts: %w", err)
+	}
+
+	type opening struct {
+		userID  int
+		balance money.Money
+	}
+	var openings []opening
+	for rows.Next() {
+		o := opening{balance: money.New(0, money.Base)}
+		if err := rows.Scan(&o.userID, &o.balance.Amount); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan user: %w", err)
+		}
+		openings = append(openings, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, o := range openings {
+		err := withTx(r.db, func(tx *sql.Tx) error {
+			// Reset the caches first; posting the opening entry brings them back
+			if _, err := tx.Exec(`UPDATE users SET balance = 0 WHERE id = $1`, o.userID); err != nil {
+				return fmt.Errorf("failed to reset cached balance: %w", err)
+			}
+			if _, err := tx.Exec(`UPDATE wallets SET balance = 0 WHERE user_id = $1 AND currency = $2`, o.userID, money.Base); err != nil {
+				return fmt.Errorf("failed to reset cached balance: %w", err)
+			}
+
+			_, err := postEntryTx(tx, EntryKindOpeningBalance, userAccountCode(o.userID), "Balance before ledger migration", []posting{
+				{account: AccountOpeningBalance, amount: o.balance.Neg()},
+				{userID: o.userID, amount: o.balance},
+			}, true)
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to backfill user %d: %w", o.userID, err)
+		}
+	}
+
+	return len(openings), nil
+}
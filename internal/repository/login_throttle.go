@@ -0,0 +1,166 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const loginThrottleColumns = `scope, key, failures, last_failure_at, locked_until`
+
+// ThrottleState is how a login or IP stands, timed by the database clock.
+type ThrottleState struct {
+	Failures         int           // Failures within the window
+	SinceLastFailure time.Duration // Meaningless without failures
+	LockedFor        time.Duration // Zero unless locked out
+}
+
+type LoginThrottleRepository struct {
+	db *sql.DB
+}
+
+func NewLoginThrottleRepository(db *sql.DB) *LoginThrottleRepository {
+	return &LoginThrottleRepository{db: db}
+}
+
+func scanLoginThrottle(row rowScanner) (*models.LoginThrottle, error) {
+	var t models.LoginThrottle
+	err := row.Scan(
+		&t.Scope,
+		&t.Key,
+		&t.Failures,
+		&t.LastFailureAt,
+		&t.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// GetState returns the state of a login or IP. Failures older than window
+// don't count.
+func (r *LoginThrottleRepository) GetState(scope, key string, window time.Duration) (*ThrottleState, error) {
+	var failures int
+	var sinceLast, lockedFor float64
+	err := r.db.QueryRow(`
+		SELECT
+		    CASE WHEN last_failure_at > NOW() - $3 * INTERVAL '1 second' THEN failures ELSE 0 END,
+		    EXTRACT(EPOCH FROM NOW() - last_failure_at),
+		    COALESCE(GREATEST(EXTRACT(EPOCH FROM locked_until - NOW()), 0), 0)
+		FROM login_throttles
+		WHERE scope = $1 AND key = $2
+	`, scope, key, window.Seconds()).Scan(&failures, &sinceLast, &lockedFor)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &ThrottleState{}, nil
+		}
+		return nil, fmt.Errorf("failed to get login throttle: %w", err)
+	}
+
+	return &ThrottleState{
+		Failures:         failures,
+		SinceLastFailure: time.Duration(sinceLast * float64(time.Second)),
+		LockedFor:        time.Duration(lockedFor * float64(time.Second)),
+	}, nil
+}
+
+// RecordFailure counts a failed login, starting over if the last one is
+// older than window. Reaching maxFailures locks the login or IP out for
+// lockout and resets the count. It returns whether this failure locked it.
+func (r *LoginThrottleRepository) RecordFailure(scope, key string, window time.Duration, maxFailures int, lockout time.Duration) (bool, error) {
+	locked := false
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var failures int
+		err := tx.QueryRow(`
+			INSERT INTO login_throttles (scope, key, failures, last_failure_at)
+			VALUES ($1, $2, 1, NOW())
+			ON CONFLICT (scope, key) DO UPDATE SET
+			    failures = CASE
+			        WHEN login_throttles.last_failure_at > NOW() - $3 * INTERVAL '1 second'
+			        THEN login_throttles.failures + 1
+			        ELSE 1
+			    END,
+			    last_failure_at = NOW()
+			RETURNING failures
+		`, scope, key, window.Seconds()).Scan(&failures)
+		if err != nil {
+			return fmt.Errorf("failed to record login failure: %w", err)
+		}
+
+		if failures < maxFailures {
+			return nil
+		}
+
+		_, err = tx.Exec(`
+			UPDATE login_throttles
+			SET failures = 0, locked_until = NOW() + $3 * INTERVAL '1 second'
+			WHERE scope = $1 AND key = $2
+		`, scope, key, lockout.Seconds())
+		if err != nil {
+			return fmt.Errorf("failed to lock out: %w", err)
+		}
+
+		locked = true
+		return nil
+	})
+
+	return locked, err
+}
+
+// Reset forgets the failures and lockout of a login or IP. It returns false
+// if there was nothing to forget.
+func (r *LoginThrottleRepository) Reset(scope, key string) (bool, error) {
+	result, err := r.db.Exec(`DELETE FROM login_throttles WHERE scope = $1 AND key = $2`, scope, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to reset login throttle: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// GetLockouts lists the logins and IPs locked out now, latest first.
+func (r *LoginThrottleRepository) GetLockouts() ([]models.LoginThrottle, error) {
+	query := `
+		SELECT ` + loginThrottleColumns + `
+		FROM login_throttles
+		WHERE locked_until > NOW()
+		ORDER BY locked_until DESC
+	`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lockouts: %w", err)
+	}
+	defer rows.Close()
+
+	throttles := []models.LoginThrottle{}
+	for rows.Next() {
+		t, err := scanLoginThrottle(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan lockout: %w", err)
+		}
+		throttles = append(throttles, *t)
+	}
+
+	return throttles, rows.Err()
+}
+
+// DeleteStale removes entries without a lockout or failures within window.
+func (r *LoginThrottleRepository) DeleteStale(window time.Duration) (int64, error) {
+	result, err := r.db.Exec(`
+		DELETE FROM login_throttles
+		WHERE (locked_until IS NULL OR locked_until <= NOW())
+		  AND last_failure_at <= NOW() - $1 * INTERVAL '1 second'
+	`, window.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete stale login throttles: %w", err)
+	}
+
+	return result.RowsAffected()
+}
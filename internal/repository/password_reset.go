@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type PasswordResetRepository struct {
+	db *sql.DB
+}
+
+func NewPasswordResetRepository(db *sql.DB) *PasswordResetRepository {
+	return &PasswordResetRepository{db: db}
+}
+
+// CreateResetToken stores a reset token valid for ttl. Tokens the user was
+// sent before stop working, so only the latest email counts. If the user was
+// sent a token that still works less than cooldown ago, nothing changes and
+// it fails with "reset recently requested", so repeated requests can't keep
+// replacing the link the user is about to open.
+func (r *PasswordResetRepository) CreateResetToken(userID int, tokenHash string, ttl, cooldown time.Duration) (time.Time, error) {
+	var expiresAt time.Time
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		// Lock the user so parallel requests see each other's tokens
+		if _, err := tx.Exec(`SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+			return fmt.Errorf("failed to lock user: %w", err)
+		}
+
+		var recent bool
+		err := tx.QueryRow(`
+			SELECT EXISTS (
+			    SELECT 1 FROM password_reset_tokens
+			    WHERE user_id = $1 AND used_at IS NULL AND expires_at > NOW()
+			      AND created_at > NOW() - $2 * INTERVAL '1 second'
+			)
+		`, userID, cooldown.Seconds()).Scan(&recent)
+		if err != nil {
+			return fmt.Errorf("failed to check reset tokens: %w", err)
+		}
+		if recent {
+			return fmt.Errorf("reset recently requested")
+		}
+
+		_, err = tx.Exec(`
+			UPDATE password_reset_tokens
+			SET used_at = NOW()
+			WHERE user_id = $1 AND used_at IS NULL
+		`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to replace reset tokens: %w", err)
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+			VALUES ($1, $2, NOW() + $3 * INTERVAL '1 second')
+			RETURNING expires_at
+		`, userID, tokenHash, ttl.Seconds()).Scan(&expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to store reset token: %w", err)
+		}
+
+		return nil
+	})
+
+	return expiresAt, err
+}
+
+// ResetPassword uses up the reset token and sets the password of its user,
+// returning the user ID.
+func (r *PasswordResetRepository) ResetPassword(tokenHash, passwordHash string) (int, error) {
+	var userID int
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var tokenID int
+		var valid bool
+		err := tx.QueryRow(`
+			SELECT id, user_id, used_at IS NULL AND expires_at > NOW()
+			FROM password_reset_tokens
+			WHERE token_hash = $1
+			FOR UPDATE
+		`, tokenHash).Scan(&tokenID, &userID, &valid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("invalid reset token")
+			}
+			return fmt.Errorf("failed to get reset token: %w", err)
+		}
+
+		if !valid {
+			return fmt.Errorf("invalid reset token")
+		}
+
+		if _, err := tx.Exec(`UPDATE password_reset_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+			return fmt.Errorf("failed to use reset token: %w", err)
+		}
+
+		if _, err := tx.Exec(`UPDATE users SET password_hash = $2 WHERE id = $1`, userID, passwordHash); err != nil {
+			return fmt.Errorf("failed to update password: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// DeleteExpired removes reset tokens that can't be used any more.
+func (r *PasswordResetRepository) DeleteExpired() (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM password_reset_tokens WHERE expires_at <= NOW() OR used_at IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired reset tokens: %w", err)
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+)
+
+const productColumns = `code, name, currency, price, active, created_at, updated_at`
+
+type ProductRepository struct {
+	db *sql.DB
+}
+
+func NewProductRepository(db *sql.DB) *ProductRepository {
+	return &ProductRepository{db: db}
+}
+
+func scanProduct(row rowScanner) (*models.Product, error) {
+	var p models.Product
+	err := row.Scan(
+		&p.Code,
+		&p.Name,
+		&p.Price.Currency,
+		&p.Price.Amount,
+		&p.Active,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (r *ProductRepository) GetProductByCode(code string) (*models.Product, error) {
+	p, err := scanProduct(r.db.QueryRow(`SELECT `+productColumns+` FROM products WHERE code = $1`, code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("product not found")
+		}
+		return nil, fmt.Errorf("failed to get product: %w", err)
+	}
+
+	return p, nil
+}
+
+func (r *ProductRepository) ListProducts(activeOnly bool) ([]models.Product, error) {
+	query := `
+		SELECT ` + productColumns + `
+		FROM products
+		WHERE active OR NOT $1
+		ORDER BY price, code
+	`
+
+	rows, err := r.db.Query(query, activeOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list products: %w", err)
+	}
+	defer rows.Close()
+
+	products := []models.Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan product: %w", err)
+		}
+		products = append(products, *p)
+	}
+
+	return products, rows.Err()
+}
+
+func (r *ProductRepository) CreateProduct(code, name string, price money.Money) (*models.Product, error) {
+	query := `
+		INSERT INTO products (code, name, currency, price)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + productColumns
+
+	p, err := scanProduct(r.db.QueryRow(query, code, name, price.Currency, price.Amount))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, fmt.Errorf("product already exists")
+		}
+		return nil, fmt.Errorf("failed to create product: %w", err)
+	}
+
+	return p, nil
+}
+
+// UpdateProduct changes the given fields; nil fields are left as they are.
+// price is in minor units of the product's currency.
+func (r *ProductRepository) UpdateProduct(code string, name *string, price *int64, active *bool) (*models.Product, error) {
+	query := `
+		UPDATE products
+		SET name = COALESCE($2, name),
+		    price = COALESCE($3, price),
+		    active = COALESCE($4, active),
+		    updated_at = NOW()
+		WHERE code = $1
+		RETURNING ` + productColumns
+
+	p, err := scanProduct(r.db.QueryRow(query, code, name, price, active))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("product not found")
+		}
+		return nil, fmt.Errorf("failed to update product: %w", err)
+	}
+
+	return p, nil
+}
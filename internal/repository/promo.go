@@ -0,0 +1,297 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+)
+
+const promoCodeColumns = `id, code, target, discount_type, value, currency, expires_at, max_redemptions, per_user_limit, first_purchase_only, active,
+	(SELECT COUNT(*) FROM promo_redemptions r WHERE r.promo_code_id = promo_codes.id AND r.status = 'applied'),
+	created_at, updated_at`
+
+const promoRedemptionColumns = `id, promo_code_id, user_id, purchase_id, topup_id, currency, amount, status, created_at, voided_at`
+
+type PromoRepository struct {
+	db *sql.DB
+}
+
+func NewPromoRepository(db *sql.DB) *PromoRepository {
+	return &PromoRepository{db: db}
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// NormalizePromoCode makes codes case-insensitive.
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func scanPromoCode(row rowScanner) (*models.PromoCode, error) {
+	var p models.PromoCode
+	err := row.Scan(
+		&p.ID,
+		&p.Code,
+		&p.Target,
+		&p.DiscountType,
+		&p.Value,
+		&p.Currency,
+		&p.ExpiresAt,
+		&p.MaxRedemptions,
+		&p.PerUserLimit,
+		&p.FirstPurchaseOnly,
+		&p.Active,
+		&p.Redemptions,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func scanPromoRedemption(row rowScanner) (*models.PromoRedemption, error) {
+	var r models.PromoRedemption
+	err := row.Scan(
+		&r.ID,
+		&r.PromoCodeID,
+		&r.UserID,
+		&r.PurchaseID,
+		&r.TopUpID,
+		&r.Amount.Currency,
+		&r.Amount.Amount,
+		&r.Status,
+		&r.CreatedAt,
+		&r.VoidedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// promoValue is the discount (capped at amount) or bonus the promo gives on amount.
+// Fixed values only apply in the promo's own currency. Either way the value is
+// given away, so percentages round down.
+func promoValue(p *models.PromoCode, amount money.Money) (money.Money, error) {
+	var value money.Money
+	if p.DiscountType == models.PromoDiscountPercent {
+		value = amount.Scale(int64(p.Value), 100, money.RoundDown)
+	} else {
+		if p.Currency != amount.Currency {
+			return money.Money{}, fmt.Errorf("promo code not applicable")
+		}
+		value = money.New(int64(p.Value), p.Currency)
+	}
+
+	if p.Target == models.PromoTargetPurchase {
+		value = value.Min(amount)
+	}
+
+	return value, nil
+}
+
+// checkPromoCode loads a promo code and checks every rule for this user.
+// With lock set it must run in a transaction: the promo row lock serialises
+// redemptions, so the limits can't be overrun by concurrent requests.
+func checkPromoCode(q queryRower, code string, userID int, target string, lock bool) (*models.PromoCode, error) {
+	query := `SELECT ` + promoCodeColumns + ` FROM promo_codes WHERE code = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+
+	p, err := scanPromoCode(q.QueryRow(query, NormalizePromoCode(code)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("promo code not found")
+		}
+		return nil, fmt.Errorf("failed to get promo code: %w", err)
+	}
+
+	if !p.Active {
+		return nil, fmt.Errorf("promo code not found")
+	}
+	if p.Target != target {
+		return nil, fmt.Errorf("promo code not applicable")
+	}
+	if p.ExpiresAt != nil && !p.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("promo code expired")
+	}
+	if p.MaxRedemptions > 0 && p.Redemptions >= p.MaxRedemptions {
+		return nil, fmt.Errorf("promo code exhausted")
+	}
+
+	if p.PerUserLimit > 0 {
+		var used int
+		err := q.QueryRow(`
+			SELECT COUNT(*) FROM promo_redemptions
+			WHERE promo_code_id = $1 AND user_id = $2 AND status = 'applied'
+		`, p.ID, userID).Scan(&used)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count redemptions: %w", err)
+		}
+		if used >= p.PerUserLimit {
+			return nil, fmt.Errorf("promo code limit reached")
+		}
+	}
+
+	if p.FirstPurchaseOnly {
+		// Purchases and top-ups that never went through don't count
+		query := `SELECT EXISTS (SELECT 1 FROM purchases WHERE user_id = $1 AND state NOT IN ('failed', 'compensated'))`
+		if target == models.PromoTargetTopUp {
+			query = `SELECT EXISTS (SELECT 1 FROM topups WHERE user_id = $1 AND status NOT IN ('failed', 'expired'))`
+		}
+
+		var exists bool
+		if err := q.QueryRow(query, userID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to check previous purchases: %w", err)
+		}
+		if exists {
+			return nil, fmt.Errorf("promo code is for first purchase only")
+		}
+	}
+
+	return p, nil
+}
+
+// redeemPromoCodeTx records a redemption for a purchase or top-up created in the same transaction.
+func redeemPromoCodeTx(tx *sql.Tx, promoID, userID int, purchaseID, topUpID *int, amount money.Money) error {
+	_, err := tx.Exec(`
+		INSERT INTO promo_redemptions (promo_code_id, user_id, purchase_id, topup_id, currency, amount)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, promoID, userID, purchaseID, topUpID, amount.Currency, amount.Amount)
+	if err != nil {
+		return fmt.Errorf("failed to record promo redemption: %w", err)
+	}
+
+	return nil
+}
+
+// voidPromoRedemptionsTx gives back the promo code of a purchase or top-up that didn't go through.
+func voidPromoRedemptionsTx(tx *sql.Tx, column string, id int) error {
+	_, err := tx.Exec(`
+		UPDATE promo_redemptions
+		SET status = 'voided', voided_at = NOW()
+		WHERE `+column+` = $1 AND status = 'applied'
+	`, id)
+	if err != nil {
+		return fmt.Errorf("failed to void promo redemption: %w", err)
+	}
+
+	return nil
+}
+
+// QuotePromoCode returns the discount or bonus code would give on amount
+// right now, without redeeming it.
+func (r *PromoRepository) QuotePromoCode(code string, userID int, target string, amount money.Money) (*models.PromoCode, money.Money, error) {
+	p, err := checkPromoCode(r.db, code, userID, target, false)
+	if err != nil {
+		return nil, money.Money{}, err
+	}
+
+	value, err := promoValue(p, amount)
+	if err != nil {
+		return nil, money.Money{}, err
+	}
+
+	return p, value, nil
+}
+
+// CreatePromoCode stores a promo code; fixed values are in currency.
+func (r *PromoRepository) CreatePromoCode(req models.CreatePromoCodeRequest, currency money.Currency) (*models.PromoCode, error) {
+	query := `
+		INSERT INTO promo_codes (code, target, discount_type, value, currency, expires_at, max_redemptions, per_user_limit, first_purchase_only)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING ` + promoCodeColumns
+
+	p, err := scanPromoCode(r.db.QueryRow(query, NormalizePromoCode(req.Code), req.Target, req.DiscountType, req.Value,
+		currency, req.ExpiresAt, req.MaxRedemptions, req.PerUserLimit, req.FirstPurchaseOnly))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, fmt.Errorf("promo code already exists")
+		}
+		return nil, fmt.Errorf("failed to create promo code: %w", err)
+	}
+
+	return p, nil
+}
+
+func (r *PromoRepository) ListPromoCodes() ([]models.PromoCode, error) {
+	rows, err := r.db.Query(`SELECT ` + promoCodeColumns + ` FROM promo_codes ORDER BY id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list promo codes: %w", err)
+	}
+	defer rows.Close()
+
+	promos := []models.PromoCode{}
+	for rows.Next() {
+		p, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan promo code: %w", err)
+		}
+		promos = append(promos, *p)
+	}
+
+	return promos, rows.Err()
+}
+
+// UpdatePromoCode changes the given fields; nil fields are left as they are.
+func (r *PromoRepository) UpdatePromoCode(code string, req models.UpdatePromoCodeRequest) (*models.PromoCode, error) {
+	query := `
+		UPDATE promo_codes
+		SET active = COALESCE($2, active),
+		    expires_at = COALESCE($3, expires_at),
+		    max_redemptions = COALESCE($4, max_redemptions),
+		    per_user_limit = COALESCE($5, per_user_limit),
+		    updated_at = NOW()
+		WHERE code = $1
+		RETURNING ` + promoCodeColumns
+
+	p, err := scanPromoCode(r.db.QueryRow(query, NormalizePromoCode(code), req.Active, req.ExpiresAt, req.MaxRedemptions, req.PerUserLimit))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("promo code not found")
+		}
+		return nil, fmt.Errorf("failed to update promo code: %w", err)
+	}
+
+	return p, nil
+}
+
+// GetRedemptions lists every use of a promo code, voided ones included, newest first.
+func (r *PromoRepository) GetRedemptions(code string) ([]models.PromoRedemption, error) {
+	query := `
+		SELECT ` + promoRedemptionColumns + `
+		FROM promo_redemptions
+		WHERE promo_code_id = (SELECT id FROM promo_codes WHERE code = $1)
+		ORDER BY id DESC
+	`
+
+	rows, err := r.db.Query(query, NormalizePromoCode(code))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get redemptions: %w", err)
+	}
+	defer rows.Close()
+
+	redemptions := []models.PromoRedemption{}
+	for rows.Next() {
+		redemption, err := scanPromoRedemption(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan redemption: %w", err)
+		}
+		redemptions = append(redemptions, *redemption)
+	}
+
+	return redemptions, rows.Err()
+}
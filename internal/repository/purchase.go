@@ -0,0 +1,559 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+
+	"github.com/lib/pq"
+)
+
+const purchaseColumns = `id, user_id, report_id, product_code, promo_code, discount_amount, subscription_id, currency, amount, refunded_amount, state, attempts, last_error, created_at, updated_at`
+
+type PurchaseRepository struct {
+	db *sql.DB
+}
+
+func NewPurchaseRepository(db *sql.DB) *PurchaseRepository {
+	return &PurchaseRepository{db: db}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPurchase(row rowScanner) (*models.Purchase, error) {
+	var p models.Purchase
+	var currency money.Currency
+	err := row.Scan(
+		&p.ID,
+		&p.UserID,
+		&p.ReportID,
+		&p.ProductCode,
+		&p.PromoCode,
+		&p.DiscountAmount.Amount,
+		&p.SubscriptionID,
+		&currency,
+		&p.Amount.Amount,
+		&p.RefundedAmount.Amount,
+		&p.State,
+		&p.Attempts,
+		&p.LastError,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	p.DiscountAmount.Currency = currency
+	p.Amount.Currency = currency
+	p.RefundedAmount.Currency = currency
+
+	return &p, nil
+}
+
+func purchaseReference(purchaseID int) string {
+	return "purchase:" + strconv.Itoa(purchaseID)
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// CreatePurchase persists a pending purchase at price, the product's price
+// in the currency of the wallet it is paid from, less the discount of
+// promoCode if one is given. The promo code is redeemed in the same transaction. The lease keeps the background worker away
+// while the request that created it drives the saga inline.
+func (r *PurchaseRepository) CreatePurchase(userID int, reportID, productCode string, price money.Money, promoCode string, lease time.Duration) (*models.Purchase, error) {
+	var purchase *models.Purchase
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var promo *models.PromoCode
+		discount := money.New(0, price.Currency)
+		if promoCode != "" {
+			var err error
+			promo, err = checkPromoCode(tx, promoCode, userID, models.PromoTargetPurchase, true)
+			if err != nil {
+				return err
+			}
+			discount, err = promoValue(promo, price)
+			if err != nil {
+				return err
+			}
+			promoCode = promo.Code
+		}
+
+		query := `
+			INSERT INTO purchases (user_id, report_id, product_code, promo_code, discount_amount, currency, amount, state, next_attempt_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, 'pending', NOW() + $8 * INTERVAL '1 second')
+			RETURNING ` + purchaseColumns
+
+		p, err := scanPurchase(tx.QueryRow(query, userID, reportID, productCode, promoCode, discount.Amount,
+			price.Currency, price.Sub(discount).Amount, lease.Seconds()))
+		if err != nil {
+			if isUniqueViolation(err) {
+				return fmt.Errorf("report already purchased")
+			}
+			return fmt.Errorf("failed to create purchase: %w", err)
+		}
+
+		if promo != nil {
+			if err := redeemPromoCodeTx(tx, promo.ID, userID, &p.ID, nil, discount); err != nil {
+				return err
+			}
+		}
+
+		purchase = p
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return purchase, nil
+}
+
+// CreateSubscriptionPurchase persists a free pending purchase paid from the
+// user's subscription allowance, using up one report of the current period.
+// It fails with "no allowance left" when there is no active subscription or
+// its allowance is used up, and the purchase should be paid from the balance.
+// The purchase is recorded in currency, the wallet it would have been paid from.
+func (r *PurchaseRepository) CreateSubscriptionPurchase(userID int, reportID, productCode string, currency money.Currency, lease time.Duration) (*models.Purchase, error) {
+	var purchase *models.Purchase
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var subscriptionID int
+		err := tx.QueryRow(`
+			SELECT id FROM subscriptions
+			WHERE user_id = $1 AND status = 'active' AND current_period_end > NOW()
+			  AND reports_used < report_allowance
+			FOR UPDATE
+		`, userID).Scan(&subscriptionID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("no allowance left")
+			}
+			return fmt.Errorf("failed to lock subscription: %w", err)
+		}
+
+		query := `
+			INSERT INTO purchases (user_id, report_id, product_code, subscription_id, currency, amount, state, next_attempt_at)
+			VALUES ($1, $2, $3, $4, $5, 0, 'pending', NOW() + $6 * INTERVAL '1 second')
+			RETURNING ` + purchaseColumns
+
+		p, err := scanPurchase(tx.QueryRow(query, userID, reportID, productCode, subscriptionID, currency, lease.Seconds()))
+		if err != nil {
+			if isUniqueViolation(err) {
+				return fmt.Errorf("report already purchased")
+			}
+			return fmt.Errorf("failed to create purchase: %w", err)
+		}
+
+		_, err = tx.Exec(`
+			UPDATE subscriptions
+			SET reports_used = reports_used + 1, updated_at = NOW()
+			WHERE id = $1
+		`, subscriptionID)
+		if err != nil {
+			return fmt.Errorf("failed to use subscription allowance: %w", err)
+		}
+
+		purchase = p
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return purchase, nil
+}
+
+func (r *PurchaseRepository) GetPurchaseByID(id int) (*models.Purchase, error) {
+	query := `SELECT ` + purchaseColumns + ` FROM purchases WHERE id = $1`
+
+	p, err := scanPurchase(r.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("purchase not found")
+		}
+		return nil, fmt.Errorf("failed to get purchase: %w", err)
+	}
+
+	return p, nil
+}
+
+// ChargePurchase debits the user and moves the purchase to charged in one
+// Postgres transaction, so the charge and the saga state can't diverge.
+func (r *PurchaseRepository) ChargePurchase(id int) (*models.Purchase, error) {
+	var purchase *models.Purchase
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		p, err := scanPurchase(tx.QueryRow(`SELECT `+purchaseColumns+` FROM purchases WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("purchase not found")
+			}
+			return fmt.Errorf("failed to lock purchase: %w", err)
+		}
+
+		// Someone else already moved it on
+		if p.State != models.PurchaseStatePending {
+			purchase = p
+			return nil
+		}
+
+		// A purchase discounted to zero has nothing to post
+		var entryID *int
+		if p.Amount.IsPositive() {
+			id, err := debitUserTx(tx, p.UserID, p.Amount, EntryKindPurchase, AccountRevenue,
+				purchaseReference(p.ID), "Report purchase "+p.ReportID, false)
+			if err != nil {
+				return err
+			}
+			entryID = &id
+		}
+
+		purchase, err = scanPurchase(tx.QueryRow(`
+			UPDATE purchases
+			SET state = 'charged', charge_entry_id = $2, last_error = '', updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+purchaseColumns, p.ID, entryID))
+		if err != nil {
+			return fmt.Errorf("failed to mark purchase as charged: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return purchase, nil
+}
+
+// MarkPurchaseUnlocked finishes the saga once the report is unlocked in Mongo.
+func (r *PurchaseRepository) MarkPurchaseUnlocked(id int) (*models.Purchase, error) {
+	return r.transition(id, models.PurchaseStateCharged, models.PurchaseStateUnlocked, "")
+}
+
+// MarkPurchaseFailed ends a purchase that was never charged.
+func (r *PurchaseRepository) MarkPurchaseFailed(id int, reason string) (*models.Purchase, error) {
+	return r.transition(id, models.PurchaseStatePending, models.PurchaseStateFailed, reason)
+}
+
+func (r *PurchaseRepository) transition(id int, from, to, lastError string) (*models.Purchase, error) {
+	query := `
+		UPDATE purchases
+		SET state = $3, last_error = $4, updated_at = NOW()
+		WHERE id = $1 AND state = $2
+		RETURNING ` + purchaseColumns
+
+	var purchase *models.Purchase
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		p, err := scanPurchase(tx.QueryRow(query, id, from, to, lastError))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("failed to move purchase to %s: %w", to, err)
+		}
+		purchase = p
+
+		// A purchase that was never charged gives its promo code and allowance back
+		if to == models.PurchaseStateFailed {
+			if err := voidPromoRedemptionsTx(tx, "purchase_id", p.ID); err != nil {
+				return err
+			}
+			return returnSubscriptionAllowanceTx(tx, p)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Someone else already moved it on
+	if purchase == nil {
+		return r.GetPurchaseByID(id)
+	}
+
+	return purchase, nil
+}
+
+// CompensatePurchase refunds a charged purchase whose report could not be unlocked.
+func (r *PurchaseRepository) CompensatePurchase(id int, reason string) (*models.Purchase, error) {
+	var purchase *models.Purchase
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		p, err := scanPurchase(tx.QueryRow(`SELECT `+purchaseColumns+` FROM purchases WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("purchase not found")
+			}
+			return fmt.Errorf("failed to lock purchase: %w", err)
+		}
+
+		if p.State != models.PurchaseStateCharged {
+			purchase = p
+			return nil
+		}
+
+		var entryID *int
+		if p.Amount.IsPositive() {
+			id, err := creditUserTx(tx, p.UserID, p.Amount, EntryKindRefund, AccountRevenue,
+				purchaseReference(p.ID), "Purchase compensation: "+reason)
+			if err != nil {
+				return err
+			}
+			entryID = &id
+		}
+
+		purchase, err = scanPurchase(tx.QueryRow(`
+			UPDATE purchases
+			SET state = 'compensated', compensation_entry_id = $2, last_error = $3, updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+purchaseColumns, p.ID, entryID, reason))
+		if err != nil {
+			return fmt.Errorf("failed to mark purchase as compensated: %w", err)
+		}
+
+		// The user got nothing, so the promo code can be used again
+		if err := voidPromoRedemptionsTx(tx, "purchase_id", p.ID); err != nil {
+			return err
+		}
+
+		// Same for the report taken from the allowance
+		return returnSubscriptionAllowanceTx(tx, p)
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to compensate purchase: %w", err)
+	}
+
+	return purchase, nil
+}
+
+// returnSubscriptionAllowanceTx gives back the report a purchase took from the
+// subscription allowance, unless the period has moved on since.
+func returnSubscriptionAllowanceTx(tx *sql.Tx, p *models.Purchase) error {
+	if p.SubscriptionID == nil {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+		UPDATE subscriptions
+		SET reports_used = GREATEST(reports_used - 1, 0), updated_at = NOW()
+		WHERE id = $1 AND current_period_start <= $2
+	`, *p.SubscriptionID, p.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to return subscription allowance: %w", err)
+	}
+
+	return nil
+}
+
+// RecordPurchaseFailure counts a failed step and schedules the next attempt.
+func (r *PurchaseRepository) RecordPurchaseFailure(id int, reason string, retryIn time.Duration) (*models.Purchase, error) {
+	query := `
+		UPDATE purchases
+		SET attempts = attempts + 1,
+		    last_error = $2,
+		    next_attempt_at = NOW() + $3 * INTERVAL '1 second',
+		    updated_at = NOW()
+		WHERE id = $1
+		RETURNING ` + purchaseColumns
+
+	p, err := scanPurchase(r.db.QueryRow(query, id, reason, retryIn.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to record purchase failure: %w", err)
+	}
+
+	return p, nil
+}
+
+// ClaimDuePurchases leases unfinished purchases whose next attempt is due.
+// SKIP LOCKED lets several instances run the worker without double work.
+func (r *PurchaseRepository) ClaimDuePurchases(limit int, lease time.Duration) ([]models.Purchase, error) {
+	query := `
+		UPDATE purchases
+		SET next_attempt_at = NOW() + $2 * INTERVAL '1 second', updated_at = NOW()
+		WHERE id IN (
+		    SELECT id FROM purchases
+		    WHERE state IN ('pending', 'charged', 'refunding') AND next_attempt_at <= NOW()
+		    ORDER BY next_attempt_at
+		    LIMIT $1
+		    FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + purchaseColumns
+
+	rows, err := r.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim purchases: %w", err)
+	}
+	defer rows.Close()
+
+	var purchases []models.Purchase
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan purchase: %w", err)
+		}
+		purchases = append(purchases, *p)
+	}
+
+	return purchases, rows.Err()
+}
+
+// RefundPurchase credits amount (0 means whatever is left) of an unlocked
+// purchase back to the user and records the refund. A full refund moves the
+// purchase to refunding until the report is locked again.
+// amount is in minor units of the purchase currency.
+func (r *PurchaseRepository) RefundPurchase(id int, amount int64, reason, source string) (*models.Purchase, *models.Refund, error) {
+	var purchase *models.Purchase
+	var refund *models.Refund
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		p, err := scanPurchase(tx.QueryRow(`SELECT `+purchaseColumns+` FROM purchases WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("purchase not found")
+			}
+			return fmt.Errorf("failed to lock purchase: %w", err)
+		}
+
+		if p.State != models.PurchaseStateUnlocked {
+			return fmt.Errorf("purchase is not refundable")
+		}
+
+		remaining := p.Amount.Sub(p.RefundedAmount)
+		refundAmount := money.New(amount, p.Amount.Currency)
+		if amount == 0 {
+			refundAmount = remaining
+		}
+		if remaining.LessThan(refundAmount) {
+			return fmt.Errorf("refund exceeds purchase amount")
+		}
+
+		// Nothing left to pay back, e.g. a free purchase; only the report is locked again
+		if refundAmount.IsPositive() {
+			entryID, err := creditUserTx(tx, p.UserID, refundAmount, EntryKindRefund, AccountRevenue,
+				purchaseReference(p.ID), "Purchase refund: "+reason)
+			if err != nil {
+				return err
+			}
+
+			refund = &models.Refund{}
+			err = tx.QueryRow(`
+				INSERT INTO refunds (purchase_id, currency, amount, reason, source, entry_id)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id, purchase_id, currency, amount, reason, source, created_at
+			`, p.ID, refundAmount.Currency, refundAmount.Amount, reason, source, entryID).Scan(
+				&refund.ID,
+				&refund.PurchaseID,
+				&refund.Amount.Currency,
+				&refund.Amount.Amount,
+				&refund.Reason,
+				&refund.Source,
+				&refund.CreatedAt,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to record refund: %w", err)
+			}
+		}
+
+		// A full refund also gives back the report taken from the allowance
+		state := p.State
+		if refundAmount == remaining {
+			state = models.PurchaseStateRefunding
+
+			if err := returnSubscriptionAllowanceTx(tx, p); err != nil {
+				return err
+			}
+		}
+
+		purchase, err = scanPurchase(tx.QueryRow(`
+			UPDATE purchases
+			SET refunded_amount = refunded_amount + $2, state = $3, attempts = 0, last_error = '',
+			    next_attempt_at = NOW() + INTERVAL '30 seconds', updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+purchaseColumns, p.ID, refundAmount.Amount, state))
+		if err != nil {
+			return fmt.Errorf("failed to update purchase: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return purchase, refund, nil
+}
+
+// MarkPurchaseRefunded finishes a full refund once the report is locked again.
+func (r *PurchaseRepository) MarkPurchaseRefunded(id int) (*models.Purchase, error) {
+	return r.transition(id, models.PurchaseStateRefunding, models.PurchaseStateRefunded, "")
+}
+
+// GetUserPurchases lists the user's purchases, newest first.
+func (r *PurchaseRepository) GetUserPurchases(userID, limit, offset int) ([]models.Purchase, error) {
+	query := `
+		SELECT ` + purchaseColumns + `
+		FROM purchases
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := r.db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get purchases: %w", err)
+	}
+	defer rows.Close()
+
+	purchases := []models.Purchase{}
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan purchase: %w", err)
+		}
+		purchases = append(purchases, *p)
+	}
+
+	return purchases, rows.Err()
+}
+
+// GetRefundablePurchases lists the user's unlocked purchases paid in currency, newest first.
+func (r *PurchaseRepository) GetRefundablePurchases(userID int, currency money.Currency) ([]models.Purchase, error) {
+	query := `
+		SELECT ` + purchaseColumns + `
+		FROM purchases
+		WHERE user_id = $1 AND currency = $2 AND state = 'unlocked' AND refunded_amount < amount
+		ORDER BY created_at DESC, id DESC
+	`
+
+	rows, err := r.db.Query(query, userID, currency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get purchases: %w", err)
+	}
+	defer rows.Close()
+
+	var purchases []models.Purchase
+	for rows.Next() {
+		p, err := scanPurchase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan purchase: %w", err)
+		}
+		purchases = append(purchases, *p)
+	}
+
+	return purchases, rows.Err()
+}
@@ -9,7 +9,6 @@ import (
 	"zl0y-billing/internal/database"
 	"zl0y-billing/internal/models"
 
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
@@ -27,14 +26,17 @@ func NewReportRepository(db *database.MongoDB) *ReportRepository {
 	}
 }
 
-func (r *ReportRepository) CreateReport(clientGeneratedID string) (*models.Report, error) {
+func (r *ReportRepository) CreateReport(clientGeneratedID, productCode, title, target string) (*models.Report, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	report := &models.Report{
-		ID:                primitive.NewObjectID(),
-		ReportID:          primitive.NewObjectID().Hex(), // Generate a unique report ID
+		ID:                bson.NewObjectID(),
+		ReportID:          bson.NewObjectID().Hex(), // Generate a unique report ID
 		ClientGeneratedID: clientGeneratedID,
+		ProductCode:       productCode,
+		Title:             title,
+		Target:            target,
 		IsPurchased:       false,
 		CreatedAt:         time.Now(),
 	}
@@ -47,6 +49,68 @@ func (r *ReportRepository) CreateReport(clientGeneratedID string) (*models.Repor
 	return report, nil
 }
 
+// CreateQueuedReport creates a report of userID that is still to be
+// generated by the report pipeline.
+func (r *ReportRepository) CreateQueuedReport(userID int, clientGeneratedID, productCode, title, target string) (*models.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report := &models.Report{
+		ID:                bson.NewObjectID(),
+		ReportID:          bson.NewObjectID().Hex(),
+		UserID:            &userID,
+		ClientGeneratedID: clientGeneratedID,
+		ProductCode:       productCode,
+		Title:             title,
+		Target:            target,
+		Status:            models.ReportStatusQueued,
+		CreatedAt:         time.Now(),
+	}
+
+	_, err := r.collection.InsertOne(ctx, report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create report: %w", err)
+	}
+
+	return report, nil
+}
+
+// SetReportStatus records how far the report's generation got; reason is
+// kept for failed reports only.
+func (r *ReportRepository) SetReportStatus(reportID, status, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"report_id": reportID}
+	update := bson.M{"$set": bson.M{"status": status}, "$unset": bson.M{"error": ""}}
+	if status == models.ReportStatusFailed {
+		update = bson.M{"$set": bson.M{"status": status, "error": reason}}
+	}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to set report status: %w", err)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("report not found")
+	}
+
+	return nil
+}
+
+// DeleteReport removes a report that never got queued.
+func (r *ReportRepository) DeleteReport(reportID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := r.collection.DeleteOne(ctx, bson.M{"report_id": reportID}); err != nil {
+		return fmt.Errorf("failed to delete report: %w", err)
+	}
+
+	return nil
+}
+
 func (r *ReportRepository) LinkAnonymousReport(clientGeneratedID string, userID int) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -71,36 +135,141 @@ func (r *ReportRepository) LinkAnonymousReport(clientGeneratedID string, userID
 	return int(result.ModifiedCount), nil
 }
 
-func (r *ReportRepository) GetReportsByUserID(userID int, limit, offset int) ([]models.Report, int64, error) {
+// GetReportsByUserID returns a page of the user's reports matching filter.
+// An empty product code in the filter matches reports created without one.
+func (r *ReportRepository) GetReportsByUserID(userID int, reportFilter models.ReportFilter, limit, offset int) ([]models.Report, error) {
+	opts := options.Find().
+		SetSort(reportsSort(reportFilter.Sort)).
+		SetLimit(int64(limit)).
+		SetSkip(int64(offset))
+
+	return r.findReports(reportsFilter(userID, reportFilter), opts)
+}
+
+// GetReportsByUserIDAfter returns up to limit of the user's reports matching
+// filter that come after the cursor, or right before it for a backward
+// cursor, in which case they are returned nearest first. Only the creation
+// time sorts are supported. Unlike skipping, this stays cheap deep into the
+// list and doesn't shift when new reports are added.
+func (r *ReportRepository) GetReportsByUserIDAfter(userID int, reportFilter models.ReportFilter, after models.ReportCursor, limit int) ([]models.Report, error) {
+	descending := reportFilter.Sort != models.ReportSortOldest
+	if after.Backward {
+		descending = !descending
+	}
+
+	op, sort := "$gt", models.ReportSortOldest
+	if descending {
+		op, sort = "$lt", models.ReportSortNewest
+	}
+
+	filter := reportsFilter(userID, reportFilter)
+	filter["$and"] = bson.A{bson.M{"$or": bson.A{
+		bson.M{"created_at": bson.M{op: after.CreatedAt}},
+		bson.M{"created_at": after.CreatedAt, "_id": bson.M{op: after.ID}},
+	}}}
+
+	opts := options.Find().
+		SetSort(reportsSort(sort)).
+		SetLimit(int64(limit))
+
+	return r.findReports(filter, opts)
+}
+
+// CountReportsByUserID counts the user's reports matching filter.
+func (r *ReportRepository) CountReportsByUserID(userID int, reportFilter models.ReportFilter) (int64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	filter := bson.M{"user_id": userID}
-
-	// Get total count
-	total, err := r.collection.CountDocuments(ctx, filter)
+	total, err := r.collection.CountDocuments(ctx, reportsFilter(userID, reportFilter))
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to count reports: %w", err)
+		return 0, fmt.Errorf("failed to count reports: %w", err)
 	}
 
-	// Find reports with pagination
-	opts := options.Find().
-		SetSort(bson.D{{"created_at", -1}}).
-		SetLimit(int64(limit)).
-		SetSkip(int64(offset))
+	return total, nil
+}
+
+func (r *ReportRepository) findReports(filter bson.M, opts *options.FindOptionsBuilder) ([]models.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
 	cursor, err := r.collection.Find(ctx, filter, opts)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to find reports: %w", err)
+		return nil, fmt.Errorf("failed to find reports: %w", err)
 	}
 	defer cursor.Close(ctx)
 
 	var reports []models.Report
 	if err := cursor.All(ctx, &reports); err != nil {
-		return nil, 0, fmt.Errorf("failed to decode reports: %w", err)
+		return nil, fmt.Errorf("failed to decode reports: %w", err)
 	}
 
-	return reports, total, nil
+	return reports, nil
+}
+
+func reportsFilter(userID int, f models.ReportFilter) bson.M {
+	filter := bson.M{"user_id": userID}
+
+	if f.Purchased != nil {
+		filter["is_purchased"] = *f.Purchased
+	}
+
+	if f.From != nil || f.To != nil {
+		createdAt := bson.M{}
+		if f.From != nil {
+			createdAt["$gte"] = *f.From
+		}
+		if f.To != nil {
+			createdAt["$lt"] = *f.To
+		}
+		filter["created_at"] = createdAt
+	}
+
+	// null also matches reports without the field
+	if len(f.ProductCodes) > 0 {
+		codes := bson.A{}
+		for _, code := range f.ProductCodes {
+			if code == "" {
+				codes = append(codes, nil)
+			} else {
+				codes = append(codes, code)
+			}
+		}
+		filter["product_code"] = bson.M{"$in": codes}
+	}
+
+	// Reports made before the generation pipeline have no status and are ready
+	if len(f.Statuses) > 0 {
+		statuses := bson.A{}
+		for _, status := range f.Statuses {
+			statuses = append(statuses, status)
+			if status == models.ReportStatusReady {
+				statuses = append(statuses, nil)
+			}
+		}
+		filter["status"] = bson.M{"$in": statuses}
+	}
+
+	if f.Query != "" {
+		filter["$text"] = bson.M{"$search": f.Query}
+	}
+
+	return filter
+}
+
+// reportsSort orders reports; ties are broken by _id, so pages are stable.
+func reportsSort(sort string) bson.D {
+	switch sort {
+	case models.ReportSortOldest:
+		return bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}
+	case models.ReportSortTitle:
+		return bson.D{{Key: "title", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	case models.ReportSortTitleDesc:
+		return bson.D{{Key: "title", Value: -1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	case models.ReportSortRelevance:
+		return bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	default:
+		return bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}
+	}
 }
 
 func (r *ReportRepository) GetReportByID(reportID string) (*models.Report, error) {
@@ -121,25 +290,194 @@ func (r *ReportRepository) GetReportByID(reportID string) (*models.Report, error
 	return &report, nil
 }
 
+// MarkReportAsPurchased unlocks the report. It is idempotent so the purchase
+// saga can safely retry it.
 func (r *ReportRepository) MarkReportAsPurchased(reportID string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	filter := bson.M{"report_id": reportID}
-	update := bson.M{"$set": bson.M{"is_purchased": true}}
+	update := bson.M{
+		"$set":   bson.M{"is_purchased": true, "purchase_status": models.ReportPurchaseStatusPurchased},
+		"$unset": bson.M{"refunded_at": ""},
+	}
 
 	result, err := r.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
 		return fmt.Errorf("failed to mark report as purchased: %w", err)
 	}
 
-	if result.ModifiedCount == 0 {
-		return fmt.Errorf("report not found or already purchased")
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("report not found")
+	}
+
+	return nil
+}
+
+// MarkReportAsUnpurchased locks the report again.
+func (r *ReportRepository) MarkReportAsUnpurchased(reportID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"report_id": reportID}
+	update := bson.M{
+		"$set":   bson.M{"is_purchased": false},
+		"$unset": bson.M{"purchase_status": ""},
+	}
+
+	if _, err := r.collection.UpdateOne(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to mark report as unpurchased: %w", err)
+	}
+
+	return nil
+}
+
+// MarkReportAsRefunded locks the report again after a full refund.
+func (r *ReportRepository) MarkReportAsRefunded(reportID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"report_id": reportID}
+	update := bson.M{"$set": bson.M{
+		"is_purchased":    false,
+		"purchase_status": models.ReportPurchaseStatusRefunded,
+		"refunded_at":     time.Now(),
+	}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to mark report as refunded: %w", err)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("report not found")
+	}
+
+	return nil
+}
+
+// SetReportContent records the report's stored payload.
+func (r *ReportRepository) SetReportContent(reportID string, content models.ReportContent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"report_id": reportID}
+	update := bson.M{"$set": bson.M{"content": content}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to set report content: %w", err)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("report not found")
+	}
+
+	return nil
+}
+
+// SetReportFingerprint stores the report's fingerprint analysis along with
+// the document it was parsed from.
+func (r *ReportRepository) SetReportFingerprint(reportID string, fingerprint *models.FingerprintResult, raw string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"report_id": reportID}
+	update := bson.M{"$set": bson.M{"fingerprint": fingerprint, "fingerprint_raw": raw}}
+
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed to set report fingerprint: %w", err)
+	}
+
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("report not found")
 	}
 
 	return nil
 }
 
+// GetOutdatedFingerprints returns up to limit reports after afterReportID,
+// in report_id order, whose fingerprint is older than version. Only the
+// report ID and the ingested document are loaded, since the stored result
+// may not decode any more.
+func (r *ReportRepository) GetOutdatedFingerprints(version int, afterReportID string, limit int) ([]models.Report, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"report_id":                  bson.M{"$gt": afterReportID},
+		"fingerprint.schema_version": bson.M{"$lt": version},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "report_id", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"report_id": 1, "fingerprint_raw": 1})
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find outdated fingerprints: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var reports []models.Report
+	if err := cursor.All(ctx, &reports); err != nil {
+		return nil, fmt.Errorf("failed to decode reports: %w", err)
+	}
+
+	return reports, nil
+}
+
+// ConvertBinaryIDs rewrites reports whose _id was stored as 12 bytes of
+// binary data, as the v2 driver encoded the v1 ObjectID type, so that the
+// _id is a real ObjectID again. The _id can't be updated in place and
+// report_id is unique, so each report is deleted before it is inserted back;
+// a failed insert puts the original document back. It returns the number of
+// converted reports.
+func (r *ReportRepository) ConvertBinaryIDs() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cursor, err := r.collection.Find(ctx, bson.M{"_id": bson.M{"$type": "binData"}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find reports with binary ids: %w", err)
+	}
+	var docs []bson.D
+	if err := cursor.All(ctx, &docs); err != nil {
+		return 0, fmt.Errorf("failed to decode reports: %w", err)
+	}
+
+	converted := 0
+	for _, doc := range docs {
+		if len(doc) == 0 || doc[0].Key != "_id" {
+			continue
+		}
+		raw, ok := doc[0].Value.(bson.Binary)
+		if !ok || len(raw.Data) != 12 {
+			continue
+		}
+		var id bson.ObjectID
+		copy(id[:], raw.Data)
+
+		updated := make(bson.D, len(doc))
+		copy(updated, doc)
+		updated[0] = bson.E{Key: "_id", Value: id}
+
+		if _, err := r.collection.DeleteOne(ctx, bson.M{"_id": raw}); err != nil {
+			return converted, fmt.Errorf("failed to delete report %s: %w", id.Hex(), err)
+		}
+		if _, err := r.collection.InsertOne(ctx, updated); err != nil {
+			if _, restoreErr := r.collection.InsertOne(ctx, doc); restoreErr != nil {
+				return converted, fmt.Errorf("failed to restore report %s: %w", id.Hex(), restoreErr)
+			}
+			return converted, fmt.Errorf("failed to insert report %s: %w", id.Hex(), err)
+		}
+		converted++
+	}
+
+	return converted, nil
+}
+
 func (r *ReportRepository) GetReportsByClientID(clientGeneratedID string) ([]models.Report, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -0,0 +1,181 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const reportJobColumns = `id, report_id, user_id, product_code, input, status, attempts, last_error, lease_token, started_at, finished_at, created_at, updated_at`
+
+type ReportJobRepository struct {
+	db *sql.DB
+}
+
+func NewReportJobRepository(db *sql.DB) *ReportJobRepository {
+	return &ReportJobRepository{db: db}
+}
+
+func scanReportJob(row rowScanner) (*models.ReportJob, error) {
+	var j models.ReportJob
+	var input []byte
+	err := row.Scan(
+		&j.ID,
+		&j.ReportID,
+		&j.UserID,
+		&j.ProductCode,
+		&input,
+		&j.Status,
+		&j.Attempts,
+		&j.LastError,
+		&j.LeaseToken,
+		&j.StartedAt,
+		&j.FinishedAt,
+		&j.CreatedAt,
+		&j.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	j.Input = input
+
+	return &j, nil
+}
+
+// CreateReportJob queues the generation of a report.
+func (r *ReportJobRepository) CreateReportJob(userID int, reportID, productCode string, input []byte) (*models.ReportJob, error) {
+	query := `
+		INSERT INTO report_jobs (user_id, report_id, product_code, input)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + reportJobColumns
+
+	// As a string, since lib/pq would send []byte as bytea
+	j, err := scanReportJob(r.db.QueryRow(query, userID, reportID, productCode, string(input)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create report job: %w", err)
+	}
+
+	return j, nil
+}
+
+func (r *ReportJobRepository) GetReportJob(reportID string) (*models.ReportJob, error) {
+	query := `SELECT ` + reportJobColumns + ` FROM report_jobs WHERE report_id = $1`
+
+	j, err := scanReportJob(r.db.QueryRow(query, reportID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("report job not found")
+		}
+		return nil, fmt.Errorf("failed to get report job: %w", err)
+	}
+
+	return j, nil
+}
+
+// ClaimDueJobs leases queued jobs whose next attempt is due, and processing
+// jobs whose lease ran out because their worker died. Every claim starts an
+// attempt and hands out a new lease token. SKIP LOCKED lets several instances
+// run workers without double work.
+func (r *ReportJobRepository) ClaimDueJobs(limit int, lease time.Duration) ([]models.ReportJob, error) {
+	query := `
+		UPDATE report_jobs
+		SET status = 'processing',
+		    attempts = attempts + 1,
+		    lease_token = gen_random_uuid()::text,
+		    next_attempt_at = NOW() + $2 * INTERVAL '1 second',
+		    started_at = COALESCE(started_at, NOW()),
+		    updated_at = NOW()
+		WHERE id IN (
+		    SELECT id FROM report_jobs
+		    WHERE status IN ('queued', 'processing') AND next_attempt_at <= NOW()
+		    ORDER BY next_attempt_at
+		    LIMIT $1
+		    FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + reportJobColumns
+
+	rows, err := r.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim report jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []models.ReportJob
+	for rows.Next() {
+		j, err := scanReportJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan report job: %w", err)
+		}
+		jobs = append(jobs, *j)
+	}
+
+	return jobs, rows.Err()
+}
+
+// ExtendLease keeps a long-running job away from other workers.
+func (r *ReportJobRepository) ExtendLease(id int, leaseToken string, lease time.Duration) error {
+	query := `
+		UPDATE report_jobs
+		SET next_attempt_at = NOW() + $3 * INTERVAL '1 second', updated_at = NOW()
+		WHERE id = $1 AND lease_token = $2 AND status = 'processing'`
+
+	return r.execLeased(query, "extend report job lease", id, leaseToken, lease.Seconds())
+}
+
+// CompleteJob marks a job ready once its report is stored.
+func (r *ReportJobRepository) CompleteJob(id int, leaseToken string) error {
+	query := `
+		UPDATE report_jobs
+		SET status = 'ready', last_error = '', lease_token = '', finished_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND lease_token = $2 AND status = 'processing'`
+
+	return r.execLeased(query, "complete report job", id, leaseToken)
+}
+
+// RetryJob puts a job whose attempt failed back in the queue.
+func (r *ReportJobRepository) RetryJob(id int, leaseToken, reason string, retryIn time.Duration) error {
+	query := `
+		UPDATE report_jobs
+		SET status = 'queued',
+		    last_error = $3,
+		    lease_token = '',
+		    next_attempt_at = NOW() + $4 * INTERVAL '1 second',
+		    updated_at = NOW()
+		WHERE id = $1 AND lease_token = $2 AND status = 'processing'`
+
+	return r.execLeased(query, "retry report job", id, leaseToken, reason, retryIn.Seconds())
+}
+
+// FailJob gives up on a job.
+func (r *ReportJobRepository) FailJob(id int, leaseToken, reason string) error {
+	query := `
+		UPDATE report_jobs
+		SET status = 'failed', last_error = $3, lease_token = '', finished_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND lease_token = $2 AND status = 'processing'`
+
+	return r.execLeased(query, "fail report job", id, leaseToken, reason)
+}
+
+// execLeased runs an update that only applies while the lease is held.
+func (r *ReportJobRepository) execLeased(query, action string, id int, leaseToken string, args ...any) error {
+	result, err := r.db.Exec(query, append([]any{id, leaseToken}, args...)...)
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", action, err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to %s: %w", action, err)
+	}
+
+	// The lease ran out and another worker took the job over
+	if rows == 0 {
+		return fmt.Errorf("lease lost")
+	}
+
+	return nil
+}
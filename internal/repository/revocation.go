@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const revokedTokenColumns = `id, jti, user_id, reason, expires_at, created_at`
+
+type RevocationRepository struct {
+	db *sql.DB
+}
+
+func NewRevocationRepository(db *sql.DB) *RevocationRepository {
+	return &RevocationRepository{db: db}
+}
+
+func scanRevokedToken(row rowScanner) (*models.RevokedToken, error) {
+	var t models.RevokedToken
+	err := row.Scan(
+		&t.ID,
+		&t.JTI,
+		&t.UserID,
+		&t.Reason,
+		&t.ExpiresAt,
+		&t.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// RevokeToken revokes one access token until expiresAt. Revoking it again is a no-op.
+func (r *RevocationRepository) RevokeToken(jti string, userID *int, reason string, expiresAt time.Time) error {
+	_, err := r.db.Exec(`
+		INSERT INTO revoked_tokens (jti, user_id, reason, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (jti) DO NOTHING
+	`, jti, userID, reason, expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	return nil
+}
+
+// GetRevokedTokensSince lists unexpired revocations created at or after since, oldest first.
+func (r *RevocationRepository) GetRevokedTokensSince(since time.Time) ([]models.RevokedToken, error) {
+	query := `
+		SELECT ` + revokedTokenColumns + `
+		FROM revoked_tokens
+		WHERE created_at >= $1 AND expires_at > NOW()
+		ORDER BY created_at, id
+	`
+
+	rows, err := r.db.Query(query, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revoked tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []models.RevokedToken{}
+	for rows.Next() {
+		t, err := scanRevokedToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan revoked token: %w", err)
+		}
+		tokens = append(tokens, *t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// DeleteExpired removes revocations of tokens that have expired anyway.
+func (r *RevocationRepository) DeleteExpired() (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired revocations: %w", err)
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,226 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const sessionColumns = `id, user_id, user_agent, ip, created_at, last_used_at, expires_at`
+
+type SessionRepository struct {
+	db *sql.DB
+}
+
+func NewSessionRepository(db *sql.DB) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+func scanSession(row rowScanner) (*models.Session, error) {
+	var s models.Session
+	err := row.Scan(
+		&s.ID,
+		&s.UserID,
+		&s.UserAgent,
+		&s.IP,
+		&s.CreatedAt,
+		&s.LastUsedAt,
+		&s.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// CreateSession starts a session with its first refresh token.
+func (r *SessionRepository) CreateSession(userID int, tokenHash, userAgent, ip string, ttl time.Duration) (*models.Session, error) {
+	var session *models.Session
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		s, err := scanSession(tx.QueryRow(`
+			INSERT INTO sessions (user_id, user_agent, ip, expires_at)
+			VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')
+			RETURNING `+sessionColumns, userID, userAgent, ip, ttl.Seconds()))
+		if err != nil {
+			return fmt.Errorf("failed to create session: %w", err)
+		}
+
+		if _, err := tx.Exec(`INSERT INTO refresh_tokens (session_id, token_hash) VALUES ($1, $2)`, s.ID, tokenHash); err != nil {
+			return fmt.Errorf("failed to store refresh token: %w", err)
+		}
+
+		session = s
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// RotateRefreshToken uses up the refresh token and replaces it with newHash,
+// extending the session by ttl. A token that was already used up means it
+// leaked: the whole session is revoked and "refresh token reused" returned.
+func (r *SessionRepository) RotateRefreshToken(tokenHash, newHash string, ttl time.Duration) (*models.Session, error) {
+	var session *models.Session
+	reused := false
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var tokenID int
+		var usedAt *time.Time
+		var revoked bool
+		err := tx.QueryRow(`
+			SELECT t.id, t.used_at, s.revoked_at IS NOT NULL OR s.expires_at <= NOW()
+			FROM refresh_tokens t
+			JOIN sessions s ON s.id = t.session_id
+			WHERE t.token_hash = $1
+			FOR UPDATE OF t, s
+		`, tokenHash).Scan(&tokenID, &usedAt, &revoked)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("invalid refresh token")
+			}
+			return fmt.Errorf("failed to get refresh token: %w", err)
+		}
+
+		if revoked {
+			return fmt.Errorf("invalid refresh token")
+		}
+
+		if usedAt != nil {
+			// Committed below, so the revocation sticks although the request fails
+			reused = true
+			_, err := tx.Exec(`
+				UPDATE sessions
+				SET revoked_at = NOW(), revoke_reason = 'reuse'
+				WHERE id = (SELECT session_id FROM refresh_tokens WHERE id = $1)
+			`, tokenID)
+			if err != nil {
+				return fmt.Errorf("failed to revoke session: %w", err)
+			}
+			return nil
+		}
+
+		if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+			return fmt.Errorf("failed to use refresh token: %w", err)
+		}
+
+		s, err := scanSession(tx.QueryRow(`
+			UPDATE sessions
+			SET last_used_at = NOW(), expires_at = NOW() + $2 * INTERVAL '1 second'
+			WHERE id = (SELECT session_id FROM refresh_tokens WHERE id = $1)
+			RETURNING `+sessionColumns, tokenID, ttl.Seconds()))
+		if err != nil {
+			return fmt.Errorf("failed to extend session: %w", err)
+		}
+
+		if _, err := tx.Exec(`INSERT INTO refresh_tokens (session_id, token_hash) VALUES ($1, $2)`, s.ID, newHash); err != nil {
+			return fmt.Errorf("failed to store refresh token: %w", err)
+		}
+
+		session = s
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		return nil, fmt.Errorf("refresh token reused")
+	}
+
+	return session, nil
+}
+
+// RevokeSessionByToken ends the session the refresh token belongs to.
+func (r *SessionRepository) RevokeSessionByToken(tokenHash, reason string) error {
+	result, err := r.db.Exec(`
+		UPDATE sessions
+		SET revoked_at = NOW(), revoke_reason = $2
+		WHERE id = (SELECT session_id FROM refresh_tokens WHERE token_hash = $1)
+		  AND revoked_at IS NULL
+	`, tokenHash, reason)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("invalid refresh token")
+	}
+
+	return nil
+}
+
+// RevokeSession ends one of the user's sessions.
+func (r *SessionRepository) RevokeSession(userID, sessionID int, reason string) error {
+	result, err := r.db.Exec(`
+		UPDATE sessions
+		SET revoked_at = NOW(), revoke_reason = $3
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL AND expires_at > NOW()
+	`, sessionID, userID, reason)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("session not found")
+	}
+
+	return nil
+}
+
+// RevokeUserSessions ends every session of the user.
+func (r *SessionRepository) RevokeUserSessions(userID int, reason string) (int64, error) {
+	result, err := r.db.Exec(`
+		UPDATE sessions
+		SET revoked_at = NOW(), revoke_reason = $2
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID, reason)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// GetActiveSessions lists the user's sessions that can still be refreshed, most recently used first.
+func (r *SessionRepository) GetActiveSessions(userID int) ([]models.Session, error) {
+	query := `
+		SELECT ` + sessionColumns + `
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC, id DESC
+	`
+
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, *s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// DeleteExpired removes sessions that ended, together with their refresh tokens.
+func (r *SessionRepository) DeleteExpired() (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM sessions WHERE expires_at <= NOW() OR revoked_at IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+
+	return result.RowsAffected()
+}
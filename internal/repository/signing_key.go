@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const signingKeyColumns = `kid, algorithm, private_key, not_before, expires_at, created_at`
+
+type SigningKeyRepository struct {
+	db *sql.DB
+}
+
+func NewSigningKeyRepository(db *sql.DB) *SigningKeyRepository {
+	return &SigningKeyRepository{db: db}
+}
+
+func scanSigningKey(row rowScanner) (*models.SigningKey, error) {
+	var k models.SigningKey
+	err := row.Scan(
+		&k.KID,
+		&k.Algorithm,
+		&k.PrivateKey,
+		&k.NotBefore,
+		&k.ExpiresAt,
+		&k.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// GetUnexpiredKeys lists the keys tokens may still be signed with, oldest first.
+func (r *SigningKeyRepository) GetUnexpiredKeys() ([]models.SigningKey, error) {
+	query := `
+		SELECT ` + signingKeyColumns + `
+		FROM signing_keys
+		WHERE expires_at IS NULL OR expires_at > NOW()
+		ORDER BY not_before, created_at
+	`
+
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.SigningKey{}
+	for rows.Next() {
+		k, err := scanSigningKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		keys = append(keys, *k)
+	}
+
+	return keys, rows.Err()
+}
+
+// AddKey adds the next key of the set, signing from delay on, unless another
+// instance got there first, i.e. a key newer than latest (zero for none)
+// already exists. The keys it replaces expire retireAfter after it takes over.
+func (r *SigningKeyRepository) AddKey(key models.SigningKey, latest time.Time, delay, retireAfter time.Duration) (bool, error) {
+	added := false
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		// Serialise rotations of all instances
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('signing_keys'))`); err != nil {
+			return fmt.Errorf("failed to lock signing keys: %w", err)
+		}
+
+		var newer bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM signing_keys WHERE not_before > $1)`, latest).Scan(&newer)
+		if err != nil {
+			return fmt.Errorf("failed to check signing keys: %w", err)
+		}
+		if newer {
+			return nil
+		}
+
+		_, err = tx.Exec(`
+			UPDATE signing_keys
+			SET expires_at = NOW() + $1 * INTERVAL '1 second'
+			WHERE expires_at IS NULL OR expires_at > NOW() + $1 * INTERVAL '1 second'
+		`, (delay + retireAfter).Seconds())
+		if err != nil {
+			return fmt.Errorf("failed to retire signing keys: %w", err)
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO signing_keys (kid, algorithm, private_key, not_before)
+			VALUES ($1, $2, $3, NOW() + $4 * INTERVAL '1 second')
+		`, key.KID, key.Algorithm, key.PrivateKey, delay.Seconds())
+		if err != nil {
+			return fmt.Errorf("failed to store signing key: %w", err)
+		}
+
+		added = true
+		return nil
+	})
+
+	return added, err
+}
@@ -0,0 +1,422 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+)
+
+const planColumns = `code, name, price, report_allowance, active, created_at, updated_at`
+
+const subscriptionColumns = `id, user_id, plan_code, status, price, report_allowance, reports_used,
+	current_period_start, current_period_end, cancel_at_period_end, last_error, created_at, updated_at`
+
+type SubscriptionRepository struct {
+	db *sql.DB
+}
+
+func NewSubscriptionRepository(db *sql.DB) *SubscriptionRepository {
+	return &SubscriptionRepository{db: db}
+}
+
+func scanPlan(row rowScanner) (*models.Plan, error) {
+	var p models.Plan
+	err := row.Scan(
+		&p.Code,
+		&p.Name,
+		&p.Price.Amount,
+		&p.ReportAllowance,
+		&p.Active,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plans are billed from the base currency wallet
+	p.Price.Currency = money.Base
+
+	return &p, nil
+}
+
+func scanSubscription(row rowScanner) (*models.Subscription, error) {
+	var s models.Subscription
+	err := row.Scan(
+		&s.ID,
+		&s.UserID,
+		&s.PlanCode,
+		&s.Status,
+		&s.Price.Amount,
+		&s.ReportAllowance,
+		&s.ReportsUsed,
+		&s.CurrentPeriodStart,
+		&s.CurrentPeriodEnd,
+		&s.CancelAtPeriodEnd,
+		&s.LastError,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Price.Currency = money.Base
+
+	return &s, nil
+}
+
+func subscriptionReference(subscriptionID int) string {
+	return "subscription:" + strconv.Itoa(subscriptionID)
+}
+
+func getActivePlanTx(tx *sql.Tx, code string) (*models.Plan, error) {
+	p, err := scanPlan(tx.QueryRow(`SELECT `+planColumns+` FROM plans WHERE code = $1`, code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("plan not found")
+		}
+		return nil, fmt.Errorf("failed to get plan: %w", err)
+	}
+
+	if !p.Active {
+		return nil, fmt.Errorf("plan not found")
+	}
+
+	return p, nil
+}
+
+// lockLiveSubscriptionTx locks the user's active or past due subscription.
+func lockLiveSubscriptionTx(tx *sql.Tx, userID int) (*models.Subscription, error) {
+	query := `
+		SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE user_id = $1 AND status IN ('active', 'past_due')
+		FOR UPDATE
+	`
+
+	s, err := scanSubscription(tx.QueryRow(query, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("subscription not found")
+		}
+		return nil, fmt.Errorf("failed to lock subscription: %w", err)
+	}
+
+	return s, nil
+}
+
+func (r *SubscriptionRepository) ListPlans() ([]models.Plan, error) {
+	rows, err := r.db.Query(`SELECT ` + planColumns + ` FROM plans WHERE active ORDER BY price, code`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list plans: %w", err)
+	}
+	defer rows.Close()
+
+	plans := []models.Plan{}
+	for rows.Next() {
+		p, err := scanPlan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan plan: %w", err)
+		}
+		plans = append(plans, *p)
+	}
+
+	return plans, rows.Err()
+}
+
+// GetLiveSubscription returns the user's active or past due subscription.
+func (r *SubscriptionRepository) GetLiveSubscription(userID int) (*models.Subscription, error) {
+	query := `
+		SELECT ` + subscriptionColumns + `
+		FROM subscriptions
+		WHERE user_id = $1 AND status IN ('active', 'past_due')
+	`
+
+	s, err := scanSubscription(r.db.QueryRow(query, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("subscription not found")
+		}
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	return s, nil
+}
+
+// CreateSubscription charges the first month of the plan and starts the
+// subscription in one transaction.
+func (r *SubscriptionRepository) CreateSubscription(userID int, planCode string) (*models.Subscription, error) {
+	var subscription *models.Subscription
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		plan, err := getActivePlanTx(tx, planCode)
+		if err != nil {
+			return err
+		}
+
+		s, err := scanSubscription(tx.QueryRow(`
+			INSERT INTO subscriptions (user_id, plan_code, price, report_allowance, current_period_start, current_period_end)
+			VALUES ($1, $2, $3, $4, NOW(), NOW() + INTERVAL '1 month')
+			RETURNING `+subscriptionColumns, userID, plan.Code, plan.Price.Amount, plan.ReportAllowance))
+		if err != nil {
+			if isUniqueViolation(err) {
+				return fmt.Errorf("subscription already exists")
+			}
+			return fmt.Errorf("failed to create subscription: %w", err)
+		}
+
+		_, err = debitUserTx(tx, userID, plan.Price, EntryKindSubscription, AccountRevenue,
+			subscriptionReference(s.ID), "Subscription "+plan.Name, false)
+		if err != nil {
+			return err
+		}
+
+		subscription = s
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// ChangePlan switches the subscription to another plan for the rest of the
+// current period. The price difference is prorated by the time left: an
+// upgrade charges it, a downgrade credits it back. Reports already used
+// count against the new allowance, so a plan they don't fit in is refused;
+// otherwise an upgrade could be used up and then downgraded for a refund.
+func (r *SubscriptionRepository) ChangePlan(userID int, planCode string) (*models.Subscription, error) {
+	var subscription *models.Subscription
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		s, err := lockLiveSubscriptionTx(tx, userID)
+		if err != nil {
+			return err
+		}
+
+		if s.Status != models.SubscriptionStatusActive {
+			return fmt.Errorf("subscription is past due")
+		}
+		if s.PlanCode == planCode {
+			return fmt.Errorf("already on this plan")
+		}
+
+		plan, err := getActivePlanTx(tx, planCode)
+		if err != nil {
+			return err
+		}
+
+		if s.ReportsUsed > plan.ReportAllowance {
+			return fmt.Errorf("reports used exceed plan allowance")
+		}
+
+		// The user pays an upgrade rounded half up and gets a downgrade back rounded down
+		now := time.Now()
+		diff := plan.Price.Sub(s.Price)
+		reference := subscriptionReference(s.ID)
+		description := "Plan change to " + plan.Name
+		switch {
+		case diff.IsPositive():
+			if charge := prorate(diff, s.CurrentPeriodStart, s.CurrentPeriodEnd, now, money.RoundHalfUp); charge.IsPositive() {
+				_, err = debitUserTx(tx, userID, charge, EntryKindSubscription, AccountRevenue, reference, description, false)
+			}
+		case diff.IsNegative():
+			if credit := prorate(diff.Neg(), s.CurrentPeriodStart, s.CurrentPeriodEnd, now, money.RoundDown); credit.IsPositive() {
+				_, err = creditUserTx(tx, userID, credit, EntryKindSubscription, AccountRevenue, reference, description)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		subscription, err = scanSubscription(tx.QueryRow(`
+			UPDATE subscriptions
+			SET plan_code = $2, price = $3, report_allowance = $4, updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+subscriptionColumns, s.ID, plan.Code, plan.Price.Amount, plan.ReportAllowance))
+		if err != nil {
+			return fmt.Errorf("failed to change plan: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// prorate scales a monthly amount down to the part of the period left at now.
+func prorate(amount money.Money, periodStart, periodEnd, now time.Time, mode money.RoundingMode) money.Money {
+	total := periodEnd.Sub(periodStart)
+	left := periodEnd.Sub(now)
+	if total <= 0 || left <= 0 {
+		return money.New(0, amount.Currency)
+	}
+	left = min(left, total)
+
+	return amount.Scale(int64(left/time.Second), int64(total/time.Second), mode)
+}
+
+// SetCancelAtPeriodEnd stops (or resumes) renewal of the subscription.
+func (r *SubscriptionRepository) SetCancelAtPeriodEnd(userID int, cancel bool) (*models.Subscription, error) {
+	query := `
+		UPDATE subscriptions
+		SET cancel_at_period_end = $2, updated_at = NOW()
+		WHERE user_id = $1 AND status IN ('active', 'past_due')
+		RETURNING ` + subscriptionColumns
+
+	s, err := scanSubscription(r.db.QueryRow(query, userID, cancel))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("subscription not found")
+		}
+		return nil, fmt.Errorf("failed to update subscription: %w", err)
+	}
+
+	return s, nil
+}
+
+// GetDueSubscriptionIDs lists live subscriptions whose period has ended, by
+// id after afterID. Past due subscriptions stay due, so callers page through
+// by id to try each of them once per pass.
+func (r *SubscriptionRepository) GetDueSubscriptionIDs(afterID, limit int) ([]int, error) {
+	query := `
+		SELECT id FROM subscriptions
+		WHERE status IN ('active', 'past_due') AND current_period_end <= NOW() AND id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+
+	rows, err := r.db.Query(query, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// RenewSubscription processes a subscription whose period has ended: it is
+// charged for the next month at the plan's current price and its allowance
+// is reset, or it expires when cancelled or its plan was discontinued. When
+// the balance is short the subscription is past due until gracePeriod after
+// the period end, then it expires. The row lock makes a concurrent second
+// renewal see the new period and do nothing.
+func (r *SubscriptionRepository) RenewSubscription(id int, gracePeriod time.Duration) (*models.Subscription, error) {
+	var subscription *models.Subscription
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		s, err := scanSubscription(tx.QueryRow(`SELECT `+subscriptionColumns+` FROM subscriptions WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("subscription not found")
+			}
+			return fmt.Errorf("failed to lock subscription: %w", err)
+		}
+
+		// Someone else already renewed it
+		if s.Status == models.SubscriptionStatusExpired || s.CurrentPeriodEnd.After(time.Now()) {
+			subscription = s
+			return nil
+		}
+
+		if s.CancelAtPeriodEnd {
+			subscription, err = expireSubscriptionTx(tx, s.ID, "cancelled")
+			return err
+		}
+
+		plan, err := getActivePlanTx(tx, s.PlanCode)
+		if err != nil {
+			if err.Error() == "plan not found" {
+				subscription, err = expireSubscriptionTx(tx, s.ID, "plan discontinued")
+			}
+			return err
+		}
+
+		// A savepoint keeps the transaction usable when the charge is refused
+		if _, err := tx.Exec(`SAVEPOINT renewal`); err != nil {
+			return fmt.Errorf("failed to create savepoint: %w", err)
+		}
+
+		_, err = debitUserTx(tx, s.UserID, plan.Price, EntryKindSubscription, AccountRevenue,
+			subscriptionReference(s.ID), "Subscription renewal "+plan.Name, false)
+		if err != nil {
+			if err.Error() != "insufficient balance" {
+				return err
+			}
+			if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT renewal`); err != nil {
+				return fmt.Errorf("failed to roll back to savepoint: %w", err)
+			}
+
+			if time.Since(s.CurrentPeriodEnd) >= gracePeriod {
+				subscription, err = expireSubscriptionTx(tx, s.ID, "insufficient balance")
+				return err
+			}
+
+			subscription, err = scanSubscription(tx.QueryRow(`
+				UPDATE subscriptions
+				SET status = 'past_due', last_error = 'insufficient balance', updated_at = NOW()
+				WHERE id = $1
+				RETURNING `+subscriptionColumns, s.ID))
+			if err != nil {
+				return fmt.Errorf("failed to mark subscription as past due: %w", err)
+			}
+			return nil
+		}
+
+		// An overdue renewal starts a fresh month instead of paying for the lapsed time
+		subscription, err = scanSubscription(tx.QueryRow(`
+			UPDATE subscriptions
+			SET status = 'active',
+			    price = $2,
+			    report_allowance = $3,
+			    reports_used = 0,
+			    current_period_start = CASE WHEN status = 'past_due' THEN NOW() ELSE current_period_end END,
+			    current_period_end = CASE WHEN status = 'past_due' THEN NOW() ELSE current_period_end END + INTERVAL '1 month',
+			    last_error = '',
+			    updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+subscriptionColumns, s.ID, plan.Price.Amount, plan.ReportAllowance))
+		if err != nil {
+			return fmt.Errorf("failed to renew subscription: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+func expireSubscriptionTx(tx *sql.Tx, id int, reason string) (*models.Subscription, error) {
+	s, err := scanSubscription(tx.QueryRow(`
+		UPDATE subscriptions
+		SET status = 'expired', last_error = $2, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+subscriptionColumns, id, reason))
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire subscription: %w", err)
+	}
+
+	return s, nil
+}
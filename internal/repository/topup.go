@@ -0,0 +1,381 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+)
+
+const topUpColumns = `id, user_id, currency, amount, reversed_amount, promo_code, bonus_amount, status, provider, COALESCE(provider_payment_id, ''), confirmation_url, failure_reason, created_at, updated_at`
+
+type TopUpRepository struct {
+	db *sql.DB
+}
+
+func NewTopUpRepository(db *sql.DB) *TopUpRepository {
+	return &TopUpRepository{db: db}
+}
+
+func scanTopUp(row rowScanner) (*models.TopUp, error) {
+	var t models.TopUp
+	var currency money.Currency
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&currency,
+		&t.Amount.Amount,
+		&t.ReversedAmount.Amount,
+		&t.PromoCode,
+		&t.BonusAmount.Amount,
+		&t.Status,
+		&t.Provider,
+		&t.ProviderPaymentID,
+		&t.ConfirmationURL,
+		&t.FailureReason,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Amount.Currency = currency
+	t.ReversedAmount.Currency = currency
+	t.BonusAmount.Currency = currency
+
+	return &t, nil
+}
+
+func topUpReference(topUpID int) string {
+	return "topup:" + strconv.Itoa(topUpID)
+}
+
+// CreateTopUp creates a pending top-up. A promo code is redeemed right away;
+// its bonus is credited together with the top-up once the payment succeeds.
+// The top-up goes to the wallet in the currency of amount.
+func (r *TopUpRepository) CreateTopUp(userID int, amount money.Money, provider, promoCode string) (*models.TopUp, error) {
+	var topUp *models.TopUp
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var promo *models.PromoCode
+		bonus := money.New(0, amount.Currency)
+		if promoCode != "" {
+			var err error
+			promo, err = checkPromoCode(tx, promoCode, userID, models.PromoTargetTopUp, true)
+			if err != nil {
+				return err
+			}
+			bonus, err = promoValue(promo, amount)
+			if err != nil {
+				return err
+			}
+			promoCode = promo.Code
+		}
+
+		query := `
+			INSERT INTO topups (user_id, currency, amount, provider, promo_code, bonus_amount)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING ` + topUpColumns
+
+		t, err := scanTopUp(tx.QueryRow(query, userID, amount.Currency, amount.Amount, provider, promoCode, bonus.Amount))
+		if err != nil {
+			return fmt.Errorf("failed to create top-up: %w", err)
+		}
+
+		if promo != nil {
+			if err := redeemPromoCodeTx(tx, promo.ID, userID, nil, &t.ID, bonus); err != nil {
+				return err
+			}
+		}
+
+		topUp = t
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return topUp, nil
+}
+
+// SetProviderPayment links the top-up to the payment created at the provider.
+func (r *TopUpRepository) SetProviderPayment(id int, paymentID, confirmationURL string) (*models.TopUp, error) {
+	query := `
+		UPDATE topups
+		SET provider_payment_id = $2, confirmation_url = $3, updated_at = NOW()
+		WHERE id = $1
+		RETURNING ` + topUpColumns
+
+	t, err := scanTopUp(r.db.QueryRow(query, id, paymentID, confirmationURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set provider payment: %w", err)
+	}
+
+	return t, nil
+}
+
+func (r *TopUpRepository) GetTopUpByID(id int) (*models.TopUp, error) {
+	t, err := scanTopUp(r.db.QueryRow(`SELECT `+topUpColumns+` FROM topups WHERE id = $1`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("top-up not found")
+		}
+		return nil, fmt.Errorf("failed to get top-up: %w", err)
+	}
+
+	return t, nil
+}
+
+func lockTopUpByPaymentTx(tx *sql.Tx, provider, paymentID string) (*models.TopUp, error) {
+	query := `
+		SELECT ` + topUpColumns + `
+		FROM topups
+		WHERE provider = $1 AND provider_payment_id = $2
+		FOR UPDATE
+	`
+
+	t, err := scanTopUp(tx.QueryRow(query, provider, paymentID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("top-up not found")
+		}
+		return nil, fmt.Errorf("failed to lock top-up: %w", err)
+	}
+
+	return t, nil
+}
+
+// ConfirmTopUp credits the balance and marks the top-up succeeded in one
+// transaction. Confirming an already succeeded top-up is a no-op.
+func (r *TopUpRepository) ConfirmTopUp(provider, paymentID string) (*models.TopUp, error) {
+	var topUp *models.TopUp
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		t, err := lockTopUpByPaymentTx(tx, provider, paymentID)
+		if err != nil {
+			return err
+		}
+
+		// An expired top-up paid late is credited; its bonus went with the expiry
+		switch t.Status {
+		case models.TopUpStatusSucceeded:
+			topUp = t
+			return nil
+		case models.TopUpStatusFailed:
+			return fmt.Errorf("top-up already failed")
+		}
+
+		entryID, err := creditUserTx(tx, t.UserID, t.Amount, EntryKindTopUp, AccountPayments,
+			topUpReference(t.ID), "Balance top-up via "+provider)
+		if err != nil {
+			return err
+		}
+
+		if t.BonusAmount.IsPositive() {
+			_, err := creditUserTx(tx, t.UserID, t.BonusAmount, EntryKindPromoBonus, AccountPromotions,
+				topUpReference(t.ID), "Promo bonus "+t.PromoCode)
+			if err != nil {
+				return err
+			}
+		}
+
+		topUp, err = scanTopUp(tx.QueryRow(`
+			UPDATE topups
+			SET status = 'succeeded', entry_id = $2, updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+topUpColumns, t.ID, entryID))
+		if err != nil {
+			return fmt.Errorf("failed to mark top-up as succeeded: %w", err)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return topUp, nil
+}
+
+// FailTopUp marks a pending top-up as failed.
+func (r *TopUpRepository) FailTopUp(provider, paymentID, reason string) (*models.TopUp, error) {
+	var topUp *models.TopUp
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		t, err := lockTopUpByPaymentTx(tx, provider, paymentID)
+		if err != nil {
+			return err
+		}
+
+		if t.Status != models.TopUpStatusPending {
+			topUp = t
+			return nil
+		}
+
+		topUp, err = scanTopUp(tx.QueryRow(`
+			UPDATE topups
+			SET status = 'failed', failure_reason = $2, updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+topUpColumns, t.ID, reason))
+		if err != nil {
+			return fmt.Errorf("failed to mark top-up as failed: %w", err)
+		}
+
+		return voidPromoRedemptionsTx(tx, "topup_id", t.ID)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return topUp, nil
+}
+
+// ExpirePendingTopUps gives up on top-ups still pending after olderThan,
+// e.g. because the user never completed the payment, so that the promo codes
+// they hold are given back. It returns the number of expired top-ups.
+func (r *TopUpRepository) ExpirePendingTopUps(olderThan time.Duration) (int, error) {
+	var expired []int
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`
+			UPDATE topups
+			SET status = 'expired', bonus_amount = 0, failure_reason = 'payment not completed in time', updated_at = NOW()
+			WHERE status = 'pending' AND created_at < NOW() - $1 * INTERVAL '1 second'
+			RETURNING id
+		`, olderThan.Seconds())
+		if err != nil {
+			return fmt.Errorf("failed to expire top-ups: %w", err)
+		}
+
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan top-up: %w", err)
+			}
+			expired = append(expired, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to expire top-ups: %w", err)
+		}
+
+		for _, id := range expired {
+			if err := voidPromoRedemptionsTx(tx, "topup_id", id); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
+
+// MarkTopUpFailed fails a top-up that never reached the provider.
+func (r *TopUpRepository) MarkTopUpFailed(id int, reason string) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE topups
+			SET status = 'failed', failure_reason = $2, updated_at = NOW()
+			WHERE id = $1 AND status = 'pending'
+		`, id, reason)
+		if err != nil {
+			return fmt.Errorf("failed to mark top-up as failed: %w", err)
+		}
+
+		return voidPromoRedemptionsTx(tx, "topup_id", id)
+	})
+}
+
+// ReverseTopUp takes back amount (0 means whatever is left) of a succeeded
+// top-up after a provider refund or chargeback. The balance may go negative:
+// the money has already left us. Once nothing is left the status becomes
+// finalStatus and the promo bonus paid on it is taken back as well. amount is
+// in minor units of the top-up currency.
+//
+// Each provider event is applied once: reversing again with the same eventID
+// changes nothing. applied reports whether this call took any money back.
+func (r *TopUpRepository) ReverseTopUp(provider, paymentID, eventID string, amount int64, kind, finalStatus, reason string) (topUp *models.TopUp, applied bool, err error) {
+	err = withTx(r.db, func(tx *sql.Tx) error {
+		t, err := lockTopUpByPaymentTx(tx, provider, paymentID)
+		if err != nil {
+			return err
+		}
+
+		remaining := t.Amount.Sub(t.ReversedAmount)
+		if t.Status == models.TopUpStatusPending || t.Status == models.TopUpStatusFailed || t.Status == models.TopUpStatusExpired {
+			return fmt.Errorf("top-up not paid")
+		}
+		if remaining.IsZero() {
+			topUp = t
+			return nil
+		}
+
+		reversal := money.New(amount, remaining.Currency)
+		if amount <= 0 || remaining.LessThan(reversal) {
+			reversal = remaining
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO topup_reversals (topup_id, event_id, amount)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (topup_id, event_id) DO NOTHING
+		`, t.ID, eventID, reversal.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to record top-up reversal: %w", err)
+		}
+
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rows == 0 {
+			topUp = t
+			return nil
+		}
+
+		if _, err := debitUserTx(tx, t.UserID, reversal, kind, AccountPayments, topUpReference(t.ID), reason, true); err != nil {
+			return err
+		}
+
+		status := t.Status
+		if reversal == remaining {
+			status = finalStatus
+
+			if t.BonusAmount.IsPositive() {
+				_, err := debitUserTx(tx, t.UserID, t.BonusAmount, EntryKindPromoBonus, AccountPromotions,
+					topUpReference(t.ID), "Promo bonus reversal "+t.PromoCode, true)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		topUp, err = scanTopUp(tx.QueryRow(`
+			UPDATE topups
+			SET reversed_amount = reversed_amount + $2, status = $3, failure_reason = $4, updated_at = NOW()
+			WHERE id = $1
+			RETURNING `+topUpColumns, t.ID, reversal.Amount, status, reason))
+		if err != nil {
+			return fmt.Errorf("failed to reverse top-up: %w", err)
+		}
+
+		applied = true
+		return nil
+	})
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return topUp, applied, nil
+}
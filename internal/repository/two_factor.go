@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+)
+
+const loginChallengeColumns = `id, user_id, login, user_agent, ip, attempts, expires_at`
+
+type TwoFactorRepository struct {
+	db *sql.DB
+}
+
+func NewTwoFactorRepository(db *sql.DB) *TwoFactorRepository {
+	return &TwoFactorRepository{db: db}
+}
+
+func scanLoginChallenge(row rowScanner) (*models.LoginChallenge, error) {
+	var c models.LoginChallenge
+	err := row.Scan(
+		&c.ID,
+		&c.UserID,
+		&c.Login,
+		&c.UserAgent,
+		&c.IP,
+		&c.Attempts,
+		&c.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// SetPendingSecret stores a TOTP secret that takes effect once confirmed,
+// replacing an earlier unconfirmed one.
+func (r *TwoFactorRepository) SetPendingSecret(userID int, secret string) error {
+	result, err := r.db.Exec(`
+		UPDATE users SET totp_secret = $2
+		WHERE id = $1 AND totp_enabled_at IS NULL
+	`, userID, secret)
+	if err != nil {
+		return fmt.Errorf("failed to store TOTP secret: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("2fa already enabled")
+	}
+
+	return nil
+}
+
+// Enable turns 2FA on after the user confirmed a code of step, and replaces
+// the recovery codes.
+func (r *TwoFactorRepository) Enable(userID int, step int64, codeHashes []string) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		result, err := tx.Exec(`
+			UPDATE users SET totp_enabled_at = NOW(), totp_last_step = $2
+			WHERE id = $1 AND totp_enabled_at IS NULL AND totp_secret IS NOT NULL
+		`, userID, step)
+		if err != nil {
+			return fmt.Errorf("failed to enable 2FA: %w", err)
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			return fmt.Errorf("2fa already enabled")
+		}
+
+		return replaceRecoveryCodesTx(tx, userID, codeHashes)
+	})
+}
+
+// ReplaceRecoveryCodes invalidates the user's recovery codes and stores new ones.
+func (r *TwoFactorRepository) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		return replaceRecoveryCodesTx(tx, userID, codeHashes)
+	})
+}
+
+func replaceRecoveryCodesTx(tx *sql.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(`INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash); err != nil {
+			return fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Disable turns 2FA off and forgets the secret and recovery codes.
+func (r *TwoFactorRepository) Disable(userID int) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL
+			WHERE id = $1
+		`, userID)
+		if err != nil {
+			return fmt.Errorf("failed to disable 2FA: %w", err)
+		}
+
+		return replaceRecoveryCodesTx(tx, userID, nil)
+	})
+}
+
+// UseStep records that a code of step was accepted. It returns false if a
+// code of that step or a later one was used already, i.e. the code is replayed.
+func (r *TwoFactorRepository) UseStep(userID int, step int64) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE users SET totp_last_step = $2
+		WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)
+	`, userID, step)
+	if err != nil {
+		return false, fmt.Errorf("failed to use TOTP code: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// UseRecoveryCode uses up a recovery code, returning false if it is unknown or used.
+func (r *TwoFactorRepository) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE totp_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// CreateChallenge starts a login waiting for the second factor.
+func (r *TwoFactorRepository) CreateChallenge(userID int, tokenHash, login, userAgent, ip string, ttl time.Duration) error {
+	_, err := r.db.Exec(`
+		INSERT INTO login_challenges (user_id, token_hash, login, user_agent, ip, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NOW() + $6 * INTERVAL '1 second')
+	`, userID, tokenHash, login, userAgent, ip, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to create login challenge: %w", err)
+	}
+
+	return nil
+}
+
+// GetChallenge returns a challenge that can still be completed, without
+// counting an attempt.
+func (r *TwoFactorRepository) GetChallenge(tokenHash string, maxAttempts int) (*models.LoginChallenge, error) {
+	c, err := scanLoginChallenge(r.db.QueryRow(`
+		SELECT `+loginChallengeColumns+`
+		FROM login_challenges
+		WHERE token_hash = $1 AND completed_at IS NULL AND expires_at > NOW() AND attempts < $2
+	`, tokenHash, maxAttempts))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid challenge token")
+		}
+		return nil, fmt.Errorf("failed to get login challenge: %w", err)
+	}
+
+	return c, nil
+}
+
+// AttemptChallenge counts an attempt to complete the challenge and returns
+// it. Challenges that are completed, expired or out of attempts are invalid.
+func (r *TwoFactorRepository) AttemptChallenge(tokenHash string, maxAttempts int) (*models.LoginChallenge, error) {
+	c, err := scanLoginChallenge(r.db.QueryRow(`
+		UPDATE login_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND completed_at IS NULL AND expires_at > NOW() AND attempts < $2
+		RETURNING `+loginChallengeColumns, tokenHash, maxAttempts))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("invalid challenge token")
+		}
+		return nil, fmt.Errorf("failed to get login challenge: %w", err)
+	}
+
+	return c, nil
+}
+
+// CompleteChallenge marks the challenge completed so it can't be used again.
+func (r *TwoFactorRepository) CompleteChallenge(id int) error {
+	result, err := r.db.Exec(`
+		UPDATE login_challenges SET completed_at = NOW()
+		WHERE id = $1 AND completed_at IS NULL
+	`, id)
+	if err != nil {
+		return fmt.Errorf("failed to complete login challenge: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("invalid challenge token")
+	}
+
+	return nil
+}
+
+// DeleteExpired removes challenges that can't be completed any more.
+func (r *TwoFactorRepository) DeleteExpired() (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM login_challenges WHERE expires_at <= NOW() OR completed_at IS NOT NULL`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired login challenges: %w", err)
+	}
+
+	return result.RowsAffected()
+}
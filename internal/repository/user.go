@@ -4,10 +4,19 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 
 	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+
+	"github.com/lib/pq"
 )
 
+// SignupBonus is the starting balance of every user.
+var SignupBonus = money.New(10000, money.Base) // 100.00 RUB
+
+const userColumns = `id, login, role, password_hash, balance, flagged_at, flag_reason, token_version, created_at, totp_secret, totp_enabled_at, disabled_at, disabled_reason, email, email_verified_at`
+
 type UserRepository struct {
 	db *sql.DB
 }
@@ -16,45 +25,80 @@ func NewUserRepository(db *sql.DB) *UserRepository {
 	return &UserRepository{db: db}
 }
 
-func (r *UserRepository) CreateUser(login, passwordHash string) (*models.User, error) {
-	query := `
-		INSERT INTO users (login, password_hash, balance)
-		VALUES ($1, $2, 10000) -- 100.00 in cents as a starting balance
-		RETURNING id, login, password_hash, balance, created_at
-	`
-
+func scanUser(row rowScanner) (*models.User, error) {
 	var user models.User
-	err := r.db.QueryRow(query, login, passwordHash).Scan(
+	err := row.Scan(
 		&user.ID,
 		&user.Login,
+		&user.Role,
 		&user.PasswordHash,
-		&user.Balance,
+		&user.Balance.Amount,
+		&user.FlaggedAt,
+		&user.FlagReason,
+		&user.TokenVersion,
 		&user.CreatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabledAt,
+		&user.DisabledAt,
+		&user.DisabledReason,
+		&user.Email,
+		&user.EmailVerifiedAt,
 	)
+	if err != nil {
+		return nil, err
+	}
+	user.Balance.Currency = money.Base
+
+	return &user, nil
+}
+
+// CreateUser creates a user with an optional unverified email.
+func (r *UserRepository) CreateUser(login, passwordHash string, email *string) (*models.User, error) {
+	var user *models.User
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var err error
+		user, err = createUserTx(tx, login, passwordHash, email, false)
+		return err
+	})
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
+}
+
+// createUserTx inserts the user and credits the signup bonus. An empty
+// passwordHash makes a user who can't log in with a password.
+func createUserTx(tx *sql.Tx, login, passwordHash string, email *string, emailVerified bool) (*models.User, error) {
+	query := `
+		INSERT INTO users (login, password_hash, balance, email, email_verified_at)
+		VALUES ($1, $2, 0, $3, CASE WHEN $4 THEN NOW() END)
+		RETURNING ` + userColumns
+
+	user, err := scanUser(tx.QueryRow(query, login, passwordHash, email, emailVerified))
+	if err != nil {
+		return nil, err
+	}
+
+	// The starting balance is a signup bonus entry in the ledger
+	if _, err := creditUserTx(tx, user.ID, SignupBonus, EntryKindSignupBonus, AccountSignupBonus,
+		userAccountCode(user.ID), "Signup bonus"); err != nil {
+		return nil, err
+	}
+	user.Balance = user.Balance.Add(SignupBonus)
+
+	return user, nil
 }
 
 func (r *UserRepository) GetUserByLogin(login string) (*models.User, error) {
 	query := `
-		SELECT id, login, password_hash, balance, created_at
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE login = $1
 	`
 
-	var user models.User
-	err := r.db.QueryRow(query, login).Scan(
-		&user.ID,
-		&user.Login,
-		&user.PasswordHash,
-		&user.Balance,
-		&user.CreatedAt,
-	)
-
+	user, err := scanUser(r.db.QueryRow(query, login))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("user not found") // User not found
@@ -62,25 +106,122 @@ func (r *UserRepository) GetUserByLogin(login string) (*models.User, error) {
 		return nil, fmt.Errorf("failed to get user by login: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
+}
+
+// GetUserByLoginOrEmail finds the user by login or verified email. A login
+// wins over another user's email.
+func (r *UserRepository) GetUserByLoginOrEmail(identifier string) (*models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE login = $1 OR (LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL)
+		ORDER BY login = $1 DESC
+		LIMIT 1
+	`
+
+	user, err := scanUser(r.db.QueryRow(query, identifier))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, fmt.Errorf("failed to get user by login or email: %w", err)
+	}
+
+	return user, nil
+}
+
+func (r *UserRepository) GetUserByVerifiedEmail(email string) (*models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL
+	`
+
+	user, err := scanUser(r.db.QueryRow(query, email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, fmt.Errorf("failed to get user by email: %w", err)
+	}
+
+	return user, nil
+}
+
+// IsEmailTaken tells whether another user has verified email.
+func (r *UserRepository) IsEmailTaken(email string, exceptUserID int) (bool, error) {
+	var taken bool
+	err := r.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM users
+			WHERE LOWER(email) = LOWER($1) AND email_verified_at IS NOT NULL AND id <> $2
+		)
+	`, email, exceptUserID).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("failed to check email: %w", err)
+	}
+
+	return taken, nil
+}
+
+// SetEmail changes the user's email, or removes it if email is nil. A new
+// address is unverified; setting the current one again keeps it verified.
+func (r *UserRepository) SetEmail(userID int, email *string) (*models.User, error) {
+	user, err := scanUser(r.db.QueryRow(`
+		UPDATE users
+		SET email = $2,
+		    email_verified_at = CASE WHEN LOWER(email) = LOWER($2) THEN email_verified_at END
+		WHERE id = $1
+		RETURNING `+userColumns, userID, email))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user not found")
+		}
+		if isEmailTaken(err) {
+			return nil, fmt.Errorf("email taken")
+		}
+		return nil, fmt.Errorf("failed to set email: %w", err)
+	}
+
+	return user, nil
+}
+
+// VerifyEmail marks email verified, provided it is still the user's email.
+// Verifying twice is harmless.
+func (r *UserRepository) VerifyEmail(userID int, email string) error {
+	result, err := r.db.Exec(`
+		UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW())
+		WHERE id = $1 AND email = $2
+	`, userID, email)
+	if err != nil {
+		if isEmailTaken(err) {
+			return fmt.Errorf("email taken")
+		}
+		return fmt.Errorf("failed to verify email: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("invalid verification token")
+	}
+
+	return nil
+}
+
+// isEmailTaken tells whether err is a clash with another user's verified email.
+func isEmailTaken(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "idx_users_verified_email"
 }
 
 func (r *UserRepository) GetUserByID(id int) (*models.User, error) {
 	query := `
-		SELECT id, login, password_hash, balance, created_at
+		SELECT ` + userColumns + `
 		FROM users
 		WHERE id = $1
 	`
 
-	var user models.User
-	err := r.db.QueryRow(query, id).Scan(
-		&user.ID,
-		&user.Login,
-		&user.PasswordHash,
-		&user.Balance,
-		&user.CreatedAt,
-	)
-
+	user, err := scanUser(r.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("user not found") // User not found
@@ -88,19 +229,167 @@ func (r *UserRepository) GetUserByID(id int) (*models.User, error) {
 		return nil, fmt.Errorf("failed to get user by ID: %w", err)
 	}
 
-	return &user, nil
+	return user, nil
 }
 
-func (r *UserRepository) UpdateUserBalance(userID int, newBalance int) error {
-	query := `
+// FindUsers lists users whose login contains query, best matches first.
+func (r *UserRepository) FindUsers(query string, limit int) ([]models.User, error) {
+	rows, err := r.db.Query(`
+		SELECT `+userColumns+`
+		FROM users
+		WHERE login ILIKE '%' || $1 || '%' OR email ILIKE '%' || $1 || '%'
+		ORDER BY login = $3 DESC, login ILIKE $1 || '%' DESC, login
+		LIMIT $2
+	`, escapeLike(query), limit, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, *user)
+	}
+
+	return users, rows.Err()
+}
+
+// escapeLike makes s match itself literally in a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// GetWallets lists the user's balances in every currency they have used.
+func (r *UserRepository) GetWallets(userID int) ([]models.Wallet, error) {
+	rows, err := r.db.Query(`
+		SELECT currency, balance, updated_at
+		FROM wallets
+		WHERE user_id = $1
+		ORDER BY currency
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wallets: %w", err)
+	}
+	defer rows.Close()
+
+	wallets := []models.Wallet{}
+	for rows.Next() {
+		var w models.Wallet
+		if err := rows.Scan(&w.Currency, &w.Balance.Amount, &w.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan wallet: %w", err)
+		}
+		w.Balance.Currency = w.Currency
+		wallets = append(wallets, w)
+	}
+
+	return wallets, rows.Err()
+}
+
+// GetWalletBalance returns the user's balance in currency, zero when they have no such wallet.
+func (r *UserRepository) GetWalletBalance(userID int, currency money.Currency) (money.Money, error) {
+	balance := money.New(0, currency)
+	err := r.db.QueryRow(`SELECT balance FROM wallets WHERE user_id = $1 AND currency = $2`, userID, currency).Scan(&balance.Amount)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return money.Money{}, fmt.Errorf("failed to get wallet: %w", err)
+	}
+
+	return balance, nil
+}
+
+// UpdateUserBalance sets the wallet of newBalance's currency to newBalance by
+// posting an adjustment entry for the difference, so the change stays visible
+// in the ledger.
+func (r *UserRepository) UpdateUserBalance(userID int, newBalance money.Money, reason string) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		var id int
+		err := tx.QueryRow(`SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("user with ID %d not found", userID)
+			}
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+
+		balance := money.New(0, newBalance.Currency)
+		err = tx.QueryRow(`
+			SELECT balance FROM wallets WHERE user_id = $1 AND currency = $2 FOR UPDATE
+		`, userID, newBalance.Currency).Scan(&balance.Amount)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+
+		delta := newBalance.Sub(balance)
+		if delta.IsZero() {
+			return nil
+		}
+
+		_, err = postEntryTx(tx, EntryKindAdjustment, userAccountCode(userID), reason, []posting{
+			{account: AccountAdjustments, amount: delta.Neg()},
+			{userID: userID, amount: delta},
+		}, true)
+		if err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// DeductBalance charges the user for a purchase identified by reference.
+func (r *UserRepository) DeductBalance(userID int, amount money.Money, reference string) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		_, err := debitUserTx(tx, userID, amount, EntryKindPurchase, AccountRevenue, reference, "Report purchase", false)
+		if err != nil {
+			if err.Error() == "insufficient balance" {
+				return fmt.Errorf("insufficient balance or user not found")
+			}
+			return fmt.Errorf("failed to deduct balance: %w", err)
+		}
+		return nil
+	})
+}
+
+// CreditBalance returns money to the user, e.g. for a top-up or a refund.
+func (r *UserRepository) CreditBalance(userID int, amount money.Money, kind, from, reference, description string) error {
+	return withTx(r.db, func(tx *sql.Tx) error {
+		if _, err := creditUserTx(tx, userID, amount, kind, from, reference, description); err != nil {
+			return fmt.Errorf("failed to credit balance: %w", err)
+		}
+		return nil
+	})
+}
+
+// FlagUser marks the account as suspicious, e.g. after a chargeback.
+func (r *UserRepository) FlagUser(userID int, reason string) error {
+	result, err := r.db.Exec(`
 		UPDATE users
-		SET balance = $2
+		SET flagged_at = COALESCE(flagged_at, NOW()), flag_reason = $2
 		WHERE id = $1
-	`
+	`, userID, reason)
+	if err != nil {
+		return fmt.Errorf("failed to flag user: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
 
-	result, err := r.db.Exec(query, userID, newBalance)
+func (r *UserRepository) UnflagUser(userID int) error {
+	result, err := r.db.Exec(`UPDATE users SET flagged_at = NULL, flag_reason = '' WHERE id = $1`, userID)
 	if err != nil {
-		return fmt.Errorf("failed to update user balance: %w", err)
+		return fmt.Errorf("failed to unflag user: %w", err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -109,28 +398,140 @@ func (r *UserRepository) UpdateUserBalance(userID int, newBalance int) error {
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("user with ID %d not found", userID)
+		return fmt.Errorf("user not found")
 	}
 
 	return nil
 }
 
-func (r *UserRepository) DeductBalance(userID, amount int) error {
-	query := `
+// UpdatePasswordHash replaces the user's password.
+func (r *UserRepository) UpdatePasswordHash(userID int, passwordHash string) error {
+	result, err := r.db.Exec(`UPDATE users SET password_hash = $2 WHERE id = $1`, userID, passwordHash)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// AdjustBalance credits or, for a negative amount, debits the user's wallet
+// with an adjustment entry. Debits can't take the wallet below zero.
+func (r *UserRepository) AdjustBalance(userID int, amount money.Money, reference, reason string) (money.Money, error) {
+	var balance money.Money
+	err := withTx(r.db, func(tx *sql.Tx) error {
+		var err error
+		if amount.IsPositive() {
+			_, err = creditUserTx(tx, userID, amount, EntryKindAdjustment, AccountAdjustments, reference, reason)
+		} else {
+			_, err = debitUserTx(tx, userID, amount.Neg(), EntryKindAdjustment, AccountAdjustments, reference, reason, false)
+		}
+		if err != nil {
+			if err.Error() == "insufficient balance" {
+				return err
+			}
+			return fmt.Errorf("failed to adjust balance: %w", err)
+		}
+
+		balance = money.New(0, amount.Currency)
+		err = tx.QueryRow(`SELECT balance FROM wallets WHERE user_id = $1 AND currency = $2`, userID, amount.Currency).Scan(&balance.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to get balance: %w", err)
+		}
+
+		return nil
+	})
+
+	return balance, err
+}
+
+// SetRole changes the user's role.
+func (r *UserRepository) SetRole(userID int, role string) error {
+	result, err := r.db.Exec(`UPDATE users SET role = $2 WHERE id = $1`, userID, role)
+	if err != nil {
+		return fmt.Errorf("failed to set role: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// GrantRoleByLogin sets the role of the user with login, returning false if there is none.
+func (r *UserRepository) GrantRoleByLogin(login, role string) (bool, error) {
+	result, err := r.db.Exec(`UPDATE users SET role = $2 WHERE login = $1 AND role <> $2`, login, role)
+	if err != nil {
+		return false, fmt.Errorf("failed to grant role: %w", err)
+	}
+
+	rows, _ := result.RowsAffected()
+	return rows > 0, nil
+}
+
+// DisableUser keeps the user from logging in.
+func (r *UserRepository) DisableUser(userID int, reason string) error {
+	result, err := r.db.Exec(`
 		UPDATE users
-		SET balance = balance - $2
-		WHERE id = $1 AND balance >= $2
-		RETURNING balance
-	`
+		SET disabled_at = COALESCE(disabled_at, NOW()), disabled_reason = $2
+		WHERE id = $1
+	`, userID, reason)
+	if err != nil {
+		return fmt.Errorf("failed to disable user: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+func (r *UserRepository) EnableUser(userID int) error {
+	result, err := r.db.Exec(`UPDATE users SET disabled_at = NULL, disabled_reason = '' WHERE id = $1`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to enable user: %w", err)
+	}
+
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
 
-	var newBalance int
-	err := r.db.QueryRow(query, userID, amount).Scan(&newBalance)
+// GetTokenVersion returns the version access tokens of the user must carry.
+func (r *UserRepository) GetTokenVersion(userID int) (int, error) {
+	var version int
+	err := r.db.QueryRow(`SELECT token_version FROM users WHERE id = $1`, userID).Scan(&version)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return fmt.Errorf("insufficient balance or user not found")
+			return 0, fmt.Errorf("user not found")
 		}
-		return fmt.Errorf("failed to deduct balance: %w", err)
+		return 0, fmt.Errorf("failed to get token version: %w", err)
 	}
 
-	return nil
+	return version, nil
+}
+
+// IncrementTokenVersion revokes every access token issued to the user so far
+// and returns the new version.
+func (r *UserRepository) IncrementTokenVersion(userID int) (int, error) {
+	var version int
+	err := r.db.QueryRow(`
+		UPDATE users SET token_version = token_version + 1 WHERE id = $1
+		RETURNING token_version
+	`, userID).Scan(&version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("user not found")
+		}
+		return 0, fmt.Errorf("failed to increment token version: %w", err)
+	}
+
+	return version, nil
 }
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type WebhookEventRepository struct {
+	db *sql.DB
+	// An unprocessed reservation older than this is considered abandoned
+	staleAfter time.Duration
+}
+
+func NewWebhookEventRepository(db *sql.DB, staleAfter time.Duration) *WebhookEventRepository {
+	return &WebhookEventRepository{db: db, staleAfter: staleAfter}
+}
+
+// Reserve records the event, returning false when it was already processed or
+// is being processed right now.
+func (r *WebhookEventRepository) Reserve(eventID, eventType string) (bool, error) {
+	// Take over reservations left behind by a crashed request
+	_, err := r.db.Exec(`
+		DELETE FROM webhook_events
+		WHERE event_id = $1 AND processed_at IS NULL AND received_at < NOW() - $2 * INTERVAL '1 second'
+	`, eventID, r.staleAfter.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("failed to expire webhook event: %w", err)
+	}
+
+	result, err := r.db.Exec(`
+		INSERT INTO webhook_events (event_id, type)
+		VALUES ($1, $2)
+		ON CONFLICT (event_id) DO NOTHING
+	`, eventID, eventType)
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve webhook event: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return rowsAffected == 1, nil
+}
+
+func (r *WebhookEventRepository) MarkProcessed(eventID string) error {
+	_, err := r.db.Exec(`UPDATE webhook_events SET processed_at = NOW() WHERE event_id = $1`, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to mark webhook event as processed: %w", err)
+	}
+
+	return nil
+}
+
+func (r *WebhookEventRepository) Release(eventID string) error {
+	_, err := r.db.Exec(`DELETE FROM webhook_events WHERE event_id = $1 AND processed_at IS NULL`, eventID)
+	if err != nil {
+		return fmt.Errorf("failed to release webhook event: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"fmt"
+	"log"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/repository"
+)
+
+// maxFoundUsers caps user search results.
+const maxFoundUsers = 50
+
+// AdminService is what support staff and admins use to look after accounts.
+type AdminService struct {
+	userRepo     *repository.UserRepository
+	purchaseRepo *repository.PurchaseRepository
+	revocations  *RevocationService
+}
+
+func NewAdminService(userRepo *repository.UserRepository, purchaseRepo *repository.PurchaseRepository, revocations *RevocationService) *AdminService {
+	return &AdminService{
+		userRepo:     userRepo,
+		purchaseRepo: purchaseRepo,
+		revocations:  revocations,
+	}
+}
+
+// FindUsers looks users up by a part of their login.
+func (s *AdminService) FindUsers(query string) (*models.UsersResponse, error) {
+	users, err := s.userRepo.FindUsers(query, maxFoundUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.UsersResponse{
+		Users: users,
+	}, nil
+}
+
+// GetUser returns the user with their balances.
+func (s *AdminService) GetUser(userID int) (*models.AdminUserResponse, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	wallets, err := s.userRepo.GetWallets(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wallets: %w", err)
+	}
+
+	return &models.AdminUserResponse{
+		User:    *user,
+		Wallets: wallets,
+		TwoFA:   user.TOTPEnabledAt != nil,
+	}, nil
+}
+
+func (s *AdminService) GetUserPurchases(userID, limit, offset int) (*models.PurchasesResponse, error) {
+	// Set default pagination values
+	if limit <= 0 || limit > 100 {
+		limit = 20 // Default limit
+	}
+
+	if offset < 0 {
+		offset = 0 // Default offset
+	}
+
+	purchases, err := s.purchaseRepo.GetUserPurchases(userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.PurchasesResponse{
+		Purchases: purchases,
+		Limit:     limit,
+		Offset:    offset,
+	}, nil
+}
+
+// AdjustBalance credits or debits the user's wallet by amount. The entry
+// references the admin who made it; reason is its description.
+func (s *AdminService) AdjustBalance(adminID, userID int, amount money.Money, reason string) (money.Money, error) {
+	if amount.IsZero() {
+		return money.Money{}, fmt.Errorf("invalid amount")
+	}
+
+	if _, err := s.userRepo.GetUserByID(userID); err != nil {
+		return money.Money{}, err
+	}
+
+	balance, err := s.userRepo.AdjustBalance(userID, amount, fmt.Sprintf("admin:%d", adminID), reason)
+	if err != nil {
+		return money.Money{}, err
+	}
+
+	log.Printf("Admin %d adjusted balance of user %d by %s: %s", adminID, userID, amount, reason)
+	return balance, nil
+}
+
+// DisableUser keeps the user from logging in and logs them out everywhere.
+func (s *AdminService) DisableUser(adminID, userID int, reason string) error {
+	if adminID == userID {
+		return fmt.Errorf("cannot change own account")
+	}
+
+	if err := s.userRepo.DisableUser(userID, reason); err != nil {
+		return err
+	}
+
+	if err := s.revocations.RevokeUserTokens(userID, "disabled"); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	log.Printf("Admin %d disabled user %d: %s", adminID, userID, reason)
+	return nil
+}
+
+// EnableUser lets a disabled user log in again.
+func (s *AdminService) EnableUser(adminID, userID int) error {
+	if err := s.userRepo.EnableUser(userID); err != nil {
+		return err
+	}
+
+	log.Printf("Admin %d enabled user %d", adminID, userID)
+	return nil
+}
+
+// SetRole changes the user's role. Their tokens are revoked, so the role in
+// tokens they already hold doesn't outlive the change.
+func (s *AdminService) SetRole(adminID, userID int, role string) error {
+	switch role {
+	case models.RoleUser, models.RoleSupport, models.RoleAdmin:
+	default:
+		return fmt.Errorf("invalid role")
+	}
+
+	// Admins can't lock themselves out of the admin API
+	if adminID == userID {
+		return fmt.Errorf("cannot change own account")
+	}
+
+	if err := s.userRepo.SetRole(userID, role); err != nil {
+		return err
+	}
+
+	if err := s.revocations.RevokeUserTokens(userID, "role_change"); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %w", err)
+	}
+
+	log.Printf("Admin %d set role of user %d to %s", adminID, userID, role)
+	return nil
+}
+
+// BootstrapAdmin makes the user with login an admin, so the first admin
+// doesn't need SQL. Missing users are skipped; they can register and restart.
+func (s *AdminService) BootstrapAdmin(login string) error {
+	granted, err := s.userRepo.GrantRoleByLogin(login, models.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if granted {
+		log.Printf("Granted admin role to %q", login)
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"zl0y-billing/internal/fingerprint"
+	"zl0y-billing/internal/models"
+)
+
+// AnalysisRequest is what a report is generated from.
+type AnalysisRequest struct {
+	ReportID    string
+	ProductCode string
+	Input       json.RawMessage
+	Attempt     int // 1 on the first attempt
+}
+
+// AnalysisResult is a generated report with its free preview and, for
+// fingerprint analyses, the result in any supported schema version.
+type AnalysisResult struct {
+	ContentType string
+	Content     []byte
+	Preview     string
+	Fingerprint json.RawMessage
+}
+
+// ErrAnalysisRejected is wrapped by analyzers for input they will never
+// accept, so the job fails without being retried.
+var ErrAnalysisRejected = errors.New("analysis rejected")
+
+// Analyzer generates reports. Errors other than ErrAnalysisRejected are
+// treated as transient and retried.
+type Analyzer interface {
+	Analyze(ctx context.Context, req AnalysisRequest) (*AnalysisResult, error)
+}
+
+// NewAnalyzer returns the analyzer named in the config. Only "fake" exists so far.
+func NewAnalyzer(name string, fakeDelay time.Duration) (Analyzer, error) {
+	switch name {
+	case "fake":
+		return NewFakeAnalyzer(fakeDelay), nil
+	default:
+		return nil, fmt.Errorf("unknown analyzer %q", name)
+	}
+}
+
+// FakeAnalyzer generates placeholder reports for local testing. It takes
+// delay per report, so the statuses can be watched, and fails on demand
+// through the input's "simulate" field:
+//   - "flaky": the first attempt fails, retries succeed
+//   - "error": every attempt fails, until the job gives up
+//   - "reject": the input is rejected without retries
+//   - "bad_fingerprint": the fingerprint result fails validation
+//
+// The fingerprint result is made up from the input's "user_agent" and
+// "email", with a risk score derived from the input's hash.
+type FakeAnalyzer struct {
+	delay time.Duration
+}
+
+func NewFakeAnalyzer(delay time.Duration) *FakeAnalyzer {
+	return &FakeAnalyzer{delay: delay}
+}
+
+type fakeAnalysisInput struct {
+	Subject   string `json:"subject"`
+	UserAgent string `json:"user_agent"`
+	Email     string `json:"email"`
+	Simulate  string `json:"simulate"`
+}
+
+const fakeUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36"
+
+func (a *FakeAnalyzer) Analyze(ctx context.Context, req AnalysisRequest) (*AnalysisResult, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(req.Input, &fields); err != nil {
+		return nil, fmt.Errorf("%w: input must be a JSON object", ErrAnalysisRejected)
+	}
+
+	var input fakeAnalysisInput
+	if err := json.Unmarshal(req.Input, &input); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrAnalysisRejected, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(a.delay):
+	}
+
+	switch input.Simulate {
+	case "", "bad_fingerprint":
+	case "flaky":
+		if req.Attempt == 1 {
+			return nil, fmt.Errorf("fake analyzer: simulated transient failure")
+		}
+	case "error":
+		return nil, fmt.Errorf("fake analyzer: simulated failure")
+	case "reject":
+		return nil, fmt.Errorf("%w: simulated rejection", ErrAnalysisRejected)
+	default:
+		return nil, fmt.Errorf("%w: unknown simulate value %q", ErrAnalysisRejected, input.Simulate)
+	}
+
+	subject := input.Subject
+	if subject == "" {
+		subject = "untitled"
+	}
+	if runes := []rune(subject); len(runes) > 200 {
+		subject = string(runes[:200]) + "..."
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var pretty bytes.Buffer
+	_ = json.Indent(&pretty, req.Input, "", "  ")
+	sum := sha256.Sum256(req.Input)
+
+	result := fakeFingerprint(input, sum)
+	if input.Simulate == "bad_fingerprint" {
+		result.RiskScore = 150
+	}
+	fp, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode fingerprint: %w", err)
+	}
+
+	var content strings.Builder
+	fmt.Fprintf(&content, "# Report %s\n\n", req.ReportID)
+	fmt.Fprintf(&content, "Subject: %s\n", subject)
+	fmt.Fprintf(&content, "Product: %s\n", req.ProductCode)
+	fmt.Fprintf(&content, "Fields: %s\n", strings.Join(keys, ", "))
+	fmt.Fprintf(&content, "Input sha256: %s\n", hex.EncodeToString(sum[:]))
+	fmt.Fprintf(&content, "Generated at: %s\n\n", time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&content, "## Fingerprint\n\n")
+	fmt.Fprintf(&content, "Browser: %s %s on %s (%s)\n", result.Browser.Name, result.Browser.Version, result.Device.OS, result.Device.Type)
+	fmt.Fprintf(&content, "Risk score: %d (%s)\n", result.RiskScore, fingerprint.RiskLevel(result.RiskScore))
+	for _, signal := range result.Signals {
+		fmt.Fprintf(&content, "- %s (%s): %s\n", signal.Code, signal.Severity, signal.Description)
+	}
+	for _, leak := range result.Leaks {
+		fmt.Fprintf(&content, "- Leaked in %s: %s\n", leak.Source, strings.Join(leak.DataClasses, ", "))
+	}
+	fmt.Fprintf(&content, "\n")
+	fmt.Fprintf(&content, "## Input\n\n```json\n%s\n```\n", pretty.String())
+
+	return &AnalysisResult{
+		ContentType: "text/markdown; charset=utf-8",
+		Content:     []byte(content.String()),
+		Preview:     fmt.Sprintf("Report on %s covering %d input fields, risk level %s.", subject, len(keys), fingerprint.RiskLevel(result.RiskScore)),
+		Fingerprint: fp,
+	}, nil
+}
+
+// fakeFingerprint makes up a plausible fingerprint result for the input.
+func fakeFingerprint(input fakeAnalysisInput, sum [sha256.Size]byte) models.FingerprintResult {
+	ua := input.UserAgent
+	if ua == "" {
+		ua = fakeUserAgent
+	}
+
+	result := models.FingerprintResult{
+		SchemaVersion: fingerprint.CurrentVersion,
+		AnalyzedAt:    time.Now().UTC().Truncate(time.Second),
+		Browser: models.FingerprintBrowser{
+			UserAgent:      ua,
+			Languages:      []string{"ru-RU", "en-US"},
+			Timezone:       "Europe/Moscow",
+			CookiesEnabled: true,
+		},
+		Device: models.FingerprintDevice{
+			Type:         models.DeviceTypeDesktop,
+			OS:           "Windows",
+			ScreenWidth:  1920,
+			ScreenHeight: 1080,
+			PixelRatio:   1,
+			CPUCores:     8,
+		},
+		RiskScore: int(sum[0]) * 100 / 255,
+		Signals:   []models.FingerprintSignal{},
+		Leaks:     []models.FingerprintLeak{},
+	}
+	result.RiskLevel = fingerprint.RiskLevel(result.RiskScore)
+
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Version/", "Safari"},
+	} {
+		if i := strings.Index(ua, b.token); i >= 0 {
+			result.Browser.Name = b.name
+			result.Browser.Version, _, _ = strings.Cut(ua[i+len(b.token):], " ")
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "iPad"):
+		result.Device = models.FingerprintDevice{Type: models.DeviceTypeTablet, OS: "iOS", ScreenWidth: 820, ScreenHeight: 1180, PixelRatio: 2, CPUCores: 6, TouchPoints: 5}
+	case strings.Contains(ua, "iPhone"):
+		result.Device = models.FingerprintDevice{Type: models.DeviceTypeMobile, OS: "iOS", ScreenWidth: 390, ScreenHeight: 844, PixelRatio: 3, CPUCores: 6, TouchPoints: 5}
+	case strings.Contains(ua, "Android"):
+		result.Device = models.FingerprintDevice{Type: models.DeviceTypeMobile, OS: "Android", ScreenWidth: 412, ScreenHeight: 915, PixelRatio: 2.6, CPUCores: 8, TouchPoints: 5}
+	case strings.Contains(ua, "Mac OS X"):
+		result.Device.OS = "macOS"
+		result.Device.PixelRatio = 2
+	case strings.Contains(ua, "Linux"):
+		result.Device.OS = "Linux"
+	}
+
+	if result.RiskScore >= 30 {
+		result.Signals = append(result.Signals, models.FingerprintSignal{
+			Code:        "datacenter_ip",
+			Category:    models.SignalCategoryNetwork,
+			Severity:    models.RiskMedium,
+			Description: "The IP address belongs to a hosting provider",
+		})
+	}
+	if result.RiskScore >= 70 {
+		result.Signals = append(result.Signals, models.FingerprintSignal{
+			Code:        "timezone_mismatch",
+			Category:    models.SignalCategoryBrowser,
+			Severity:    models.RiskHigh,
+			Description: "The browser timezone doesn't match the IP location",
+		})
+	}
+
+	if name, domain, ok := strings.Cut(input.Email, "@"); ok && name != "" {
+		breachedAt := time.Date(2019, time.June, 1, 0, 0, 0, 0, time.UTC)
+		result.Leaks = append(result.Leaks, models.FingerprintLeak{
+			Source:      "fake-breach-2019",
+			BreachedAt:  &breachedAt,
+			DataClasses: []string{"email", "password_hash"},
+			Identifier:  string([]rune(name)[:1]) + "***@" + domain,
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+const (
+	// maxAPIKeys is how many active API keys a user may have
+	maxAPIKeys = 20
+	// apiKeyPrefixLength is how much of a key is kept in the clear to tell keys apart
+	apiKeyPrefixLength = 12
+)
+
+// APIKeyService issues API keys and authenticates requests made with them.
+// A key is shown once on creation; only its hash is stored.
+type APIKeyService struct {
+	apiKeyRepo *repository.APIKeyRepository
+}
+
+func NewAPIKeyService(apiKeyRepo *repository.APIKeyRepository) *APIKeyService {
+	return &APIKeyService{
+		apiKeyRepo: apiKeyRepo,
+	}
+}
+
+func (s *APIKeyService) Create(userID int, req *models.CreateAPIKeyRequest) (*models.CreateAPIKeyResponse, error) {
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(models.APIKeyScopes, scope) {
+			return nil, fmt.Errorf("invalid scope")
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	secret, err := generateRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	key := models.APIKeyPrefix + secret
+
+	ttl := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	apiKey, err := s.apiKeyRepo.CreateAPIKey(userID, strings.TrimSpace(req.Name), key[:apiKeyPrefixLength], hashToken(key), scopes, ttl, maxAPIKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.CreateAPIKeyResponse{
+		Key:    key,
+		APIKey: *apiKey,
+	}, nil
+}
+
+func (s *APIKeyService) List(userID int) (*models.APIKeysResponse, error) {
+	keys, err := s.apiKeyRepo.GetActiveAPIKeys(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.APIKeysResponse{APIKeys: keys}, nil
+}
+
+func (s *APIKeyService) Revoke(userID, keyID int) error {
+	return s.apiKeyRepo.RevokeAPIKey(userID, keyID)
+}
+
+// IsAPIKey tells API keys apart from access tokens.
+func (s *APIKeyService) IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, models.APIKeyPrefix)
+}
+
+// Authenticate returns the key's owner and scopes, recording the use from ip.
+func (s *APIKeyService) Authenticate(key, ip string) (*models.APIKey, error) {
+	return s.apiKeyRepo.UseAPIKey(hashToken(key), ip)
+}
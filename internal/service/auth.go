@@ -1,7 +1,14 @@
 package service
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"net/url"
+	"strings"
 	"time"
 
 	"zl0y-billing/internal/models"
@@ -11,78 +18,411 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// resetRequestCooldown is how long after sending a reset link further
+// requests are ignored, so the link keeps working
+const resetRequestCooldown = 5 * time.Minute
+
 type AuthService struct {
-	userRepo  *repository.UserRepository
-	jwtSecret string
+	userRepo        *repository.UserRepository
+	sessionRepo     *repository.SessionRepository
+	resetRepo       *repository.PasswordResetRepository
+	revocations     *RevocationService
+	keys            *KeyService
+	twoFactor       *TwoFactorService
+	throttle        *LoginThrottleService
+	emails          *EmailService
+	notifier        Notifier
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+	resetTokenTTL   time.Duration
+	publicBaseURL   string
 }
 
-func NewAuthService(userRepo *repository.UserRepository, jwtSecret string) *AuthService {
+func NewAuthService(userRepo *repository.UserRepository, sessionRepo *repository.SessionRepository, resetRepo *repository.PasswordResetRepository, revocations *RevocationService, keys *KeyService, twoFactor *TwoFactorService, throttle *LoginThrottleService, emails *EmailService, notifier Notifier, accessTokenTTL, refreshTokenTTL, resetTokenTTL time.Duration, publicBaseURL string) *AuthService {
 	return &AuthService{
-		userRepo:  userRepo,
-		jwtSecret: jwtSecret,
+		userRepo:        userRepo,
+		sessionRepo:     sessionRepo,
+		resetRepo:       resetRepo,
+		revocations:     revocations,
+		keys:            keys,
+		twoFactor:       twoFactor,
+		throttle:        throttle,
+		emails:          emails,
+		notifier:        notifier,
+		accessTokenTTL:  accessTokenTTL,
+		refreshTokenTTL: refreshTokenTTL,
+		resetTokenTTL:   resetTokenTTL,
+		publicBaseURL:   publicBaseURL,
 	}
 }
 
-func (s *AuthService) Register(login, password string) (*models.AuthResponse, error) {
+// Register creates the user and logs them in on the device described by
+// userAgent and ip. email is optional; a verification link is sent to it.
+func (s *AuthService) Register(login, password, email, userAgent, ip string) (*models.AuthResponse, error) {
 	// Check if user already exists
 	existingUser, err := s.userRepo.GetUserByLogin(login)
 	if existingUser != nil {
 		return nil, fmt.Errorf("user with login %s already exists", login)
 	}
 
+	// Logins take precedence over emails when logging in, so a login that
+	// looks like an email could take over someone's email, verified later
+	if strings.Contains(login, "@") {
+		return nil, fmt.Errorf("invalid login")
+	}
+
 	// Hash the password
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, fmt.Errorf("failed to hash password: %w", err)
 	}
 
+	var userEmail *string
+	if email != "" {
+		taken, err := s.userRepo.IsEmailTaken(email, 0)
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return nil, fmt.Errorf("email taken")
+		}
+		userEmail = &email
+	}
+
 	// Create the user
-	user, err := s.userRepo.CreateUser(login, string(passwordHash))
+	user, err := s.userRepo.CreateUser(login, string(passwordHash), userEmail)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %w", err)
 	}
 
-	// Generate JWT token
-	token, err := s.generateToken(user.ID)
+	s.emails.SendVerificationQuietly(user)
+
+	return s.startSession(user.ID, userAgent, ip)
+}
+
+// Login checks the credentials and starts a new session on the device
+// described by userAgent and ip. login may also be the user's verified
+// email. For users with 2FA on it returns a challenge instead, to be
+// completed with CompleteLogin; the failures of the login are only forgotten
+// once that succeeds. Logins and IPs with too many failures are refused with
+// a *LoginBlockedError.
+func (s *AuthService) Login(login, password, userAgent, ip string) (*models.AuthResponse, *models.LoginChallengeResponse, error) {
+	if err := s.throttle.Check(login, ip); err != nil {
+		return nil, nil, err
+	}
+
+	// Get user by login or email
+	user, err := s.userRepo.GetUserByLoginOrEmail(login)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate token: %w", err)
+		if err.Error() == "user not found" {
+			s.recordLoginFailure(login, ip)
+		}
+		return nil, nil, fmt.Errorf("invalid credentials: %w", err)
 	}
 
-	return &models.AuthResponse{
-		AccessToken: token,
+	// Compare password
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		s.recordLoginFailure(login, ip)
+		return nil, nil, fmt.Errorf("invalid credentials")
+	}
+
+	response, challenge, err := s.logIn(user, login, userAgent, ip)
+	if response != nil {
+		s.recordLoginSuccess(login)
+	}
+	return response, challenge, err
+}
+
+// LoginUser logs in a user who was authenticated some other way, e.g. by an
+// OpenID provider. As with Login, users with 2FA on get a challenge.
+func (s *AuthService) LoginUser(userID int, userAgent, ip string) (*models.AuthResponse, *models.LoginChallengeResponse, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.logIn(user, user.Login, userAgent, ip)
+}
+
+// CompleteLogin finishes a login challenged for the second factor with a
+// TOTP or recovery code, starting the session on the device that logged in.
+// Wrong codes count as failed logins of the challenge's login and of ip, the
+// client sending the code, and are refused the same way.
+func (s *AuthService) CompleteLogin(challengeToken, code, ip string) (*models.AuthResponse, error) {
+	pending, err := s.twoFactor.GetChallenge(challengeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.throttle.Check(pending.Login, ip); err != nil {
+		return nil, err
+	}
+
+	challenge, err := s.twoFactor.CompleteChallenge(challengeToken, code)
+	if err != nil {
+		if err.Error() == "invalid code" {
+			s.recordLoginFailure(pending.Login, ip)
+		}
+		return nil, err
+	}
+
+	s.recordLoginSuccess(challenge.Login)
+
+	return s.startSession(challenge.UserID, challenge.UserAgent, challenge.IP)
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token; the old one can't be used again. Presenting a used refresh token
+// revokes its session, since either the client or an attacker holds a copy.
+func (s *AuthService) Refresh(refreshToken string) (*models.AuthResponse, error) {
+	newToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	session, err := s.sessionRepo.RotateRefreshToken(hashToken(refreshToken), hashToken(newToken), s.refreshTokenTTL)
+	if err != nil {
+		switch err.Error() {
+		case "invalid refresh token", "refresh token reused":
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to refresh session: %w", err)
+	}
+
+	return s.authResponse(session, newToken)
+}
+
+// Logout ends the session of the refresh token.
+func (s *AuthService) Logout(refreshToken string) error {
+	return s.sessionRepo.RevokeSessionByToken(hashToken(refreshToken), "logout")
+}
+
+// GetSessions lists the user's active sessions, marking the one of currentSessionID.
+func (s *AuthService) GetSessions(userID, currentSessionID int) (*models.SessionsResponse, error) {
+	sessions, err := s.sessionRepo.GetActiveSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+
+	return &models.SessionsResponse{
+		Sessions: sessions,
 	}, nil
 }
 
-func (s *AuthService) Login(login, password string) (*models.AuthResponse, error) {
-	// Get user by login
-	user, err := s.userRepo.GetUserByLogin(login)
+// RevokeSession logs the user out on one device. Its access token stays
+// valid until it expires, at most the access token TTL.
+func (s *AuthService) RevokeSession(userID, sessionID int) error {
+	return s.sessionRepo.RevokeSession(userID, sessionID, "revoked")
+}
+
+// ChangePassword sets a new password after checking the current one. Every
+// session is revoked, and a new one started on the device making the change.
+func (s *AuthService) ChangePassword(userID int, currentPassword, newPassword, userAgent, ip string) (*models.AuthResponse, error) {
+	user, err := s.userRepo.GetUserByID(userID)
 	if err != nil {
-		return nil, fmt.Errorf("invalid credentials: %w", err)
+		return nil, err
 	}
 
-	// Compare password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		return nil, fmt.Errorf("invalid credentials")
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)); err != nil {
+		return nil, fmt.Errorf("invalid current password")
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	if err := s.userRepo.UpdatePasswordHash(userID, string(passwordHash)); err != nil {
+		return nil, err
+	}
+
+	if err := s.revocations.RevokeUserTokens(userID, "password_change"); err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	return s.startSession(userID, userAgent, ip)
+}
+
+// RequestPasswordReset sends the user a single-use reset link, to their
+// verified email if they have one. login may also be the verified email.
+// Unknown logins are ignored without an error, so the endpoint can't be used
+// to find accounts, and so are requests within resetRequestCooldown of the
+// last link sent. Too many requests for a login or from ip are refused with
+// a *LoginBlockedError.
+func (s *AuthService) RequestPasswordReset(login, ip string) error {
+	if err := s.throttle.CheckPasswordReset(login, ip); err != nil {
+		return err
+	}
+
+	user, err := s.userRepo.GetUserByLoginOrEmail(login)
+	if err != nil {
+		if err.Error() == "user not found" {
+			return nil
+		}
+		return err
+	}
+
+	token, err := generateRefreshToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate reset token: %w", err)
+	}
+
+	expiresAt, err := s.resetRepo.CreateResetToken(user.ID, hashToken(token), s.resetTokenTTL, resetRequestCooldown)
+	if err != nil {
+		if err.Error() == "reset recently requested" {
+			return nil
+		}
+		return err
+	}
+
+	resetURL := s.publicBaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	to := user.Login
+	if user.Email != nil && user.EmailVerifiedAt != nil {
+		to = *user.Email
+	}
+
+	if err := s.notifier.SendPasswordReset(to, resetURL, expiresAt); err != nil {
+		return fmt.Errorf("failed to send reset link: %w", err)
+	}
+
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token and logs the user out
+// everywhere; they log in again with the new password.
+func (s *AuthService) ResetPassword(token, newPassword string) error {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	userID, err := s.resetRepo.ResetPassword(hashToken(token), string(passwordHash))
+	if err != nil {
+		return err
+	}
+
+	if err := s.revocations.RevokeUserTokens(userID, "password_reset"); err != nil {
+		// The password has changed already; old sessions still expire on their own
+		log.Printf("Failed to revoke sessions of user %d after password reset: %v", userID, err)
+	}
+
+	return nil
+}
+
+func (s *AuthService) logIn(user *models.User, login, userAgent, ip string) (*models.AuthResponse, *models.LoginChallengeResponse, error) {
+	if user.DisabledAt != nil {
+		return nil, nil, fmt.Errorf("account disabled")
+	}
+
+	if user.TOTPEnabledAt != nil {
+		challenge, err := s.twoFactor.StartChallenge(user.ID, login, userAgent, ip)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, challenge, nil
+	}
+
+	response, err := s.startSession(user.ID, userAgent, ip)
+	return response, nil, err
+}
+
+func (s *AuthService) recordLoginFailure(login, ip string) {
+	if err := s.throttle.RecordFailure(login, ip); err != nil {
+		log.Printf("Failed to record failed login of %q from %s: %v", login, ip, err)
+	}
+}
+
+func (s *AuthService) recordLoginSuccess(login string) {
+	if err := s.throttle.RecordSuccess(login); err != nil {
+		log.Printf("Failed to reset login throttle of %q: %v", login, err)
+	}
+}
+
+func (s *AuthService) startSession(userID int, userAgent, ip string) (*models.AuthResponse, error) {
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	session, err := s.sessionRepo.CreateSession(userID, hashToken(refreshToken), userAgent, ip, s.refreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.authResponse(session, refreshToken)
+}
+
+func (s *AuthService) authResponse(session *models.Session, refreshToken string) (*models.AuthResponse, error) {
+	user, err := s.userRepo.GetUserByID(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.DisabledAt != nil {
+		return nil, fmt.Errorf("account disabled")
 	}
 
 	// Generate JWT token
-	token, err := s.generateToken(user.ID)
+	token, err := s.generateToken(user, session.ID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
 
 	return &models.AuthResponse{
-		AccessToken: token,
+		AccessToken:  token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.accessTokenTTL.Seconds()),
 	}, nil
 }
 
-func (s *AuthService) generateToken(userID int) (string, error) {
+// generateToken issues an access token. jti identifies it for revocation;
+// ver is the user's token version, bumped to revoke all their tokens at once,
+// e.g. when their role changes.
+func (s *AuthService) generateToken(user *models.User, sessionID int) (string, error) {
+	jti, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
+
 	claims := jwt.MapClaims{
-		"user_id": userID,
-		"exp":     time.Now().Add(time.Minute * 5).Unix(), // Token valid for 5 minutes
+		"user_id": user.ID,
+		"role":    user.Role,
+		"sid":     sessionID,
+		"jti":     jti,
+		"ver":     user.TokenVersion,
+		"exp":     time.Now().Add(s.accessTokenTTL).Unix(),
 		"iat":     time.Now().Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.jwtSecret))
+	return s.keys.Sign(claims)
+}
+
+// generateRefreshToken returns an opaque random token. Only its hash is stored.
+func generateRefreshToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// generateTokenID returns a random access token ID.
+func generateTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// hashToken is how refresh tokens are stored; they are random enough that a
+// plain sha256 can't be brute-forced.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/repository"
+	"zl0y-billing/internal/webhook"
+)
+
+type BillingService struct {
+	topUpRepo       *repository.TopUpRepository
+	userRepo        *repository.UserRepository
+	refundService   *RefundService
+	providers       map[string]PaymentProvider
+	defaultProvider string
+	rates           *money.Rates
+	minTopUp        money.Money
+	maxTopUp        money.Money
+}
+
+// NewBillingService creates the billing service. The top-up limits are in
+// minor units of the base currency; top-ups in other currencies are
+// converted before they are checked.
+func NewBillingService(topUpRepo *repository.TopUpRepository, userRepo *repository.UserRepository, refundService *RefundService, rates *money.Rates, defaultProvider string, minTopUp, maxTopUp int, providers ...PaymentProvider) *BillingService {
+	s := &BillingService{
+		topUpRepo:       topUpRepo,
+		userRepo:        userRepo,
+		refundService:   refundService,
+		providers:       make(map[string]PaymentProvider),
+		defaultProvider: defaultProvider,
+		rates:           rates,
+		minTopUp:        money.New(int64(minTopUp), money.Base),
+		maxTopUp:        money.New(int64(maxTopUp), money.Base),
+	}
+
+	for _, provider := range providers {
+		s.providers[provider.Name()] = provider
+	}
+
+	return s
+}
+
+// CreateTopUp creates a pending top-up and the matching payment at the provider.
+// The balance, and the bonus of the optional promo code, is credited once the
+// provider confirms the payment. The money goes to the wallet in amount's currency.
+func (s *BillingService) CreateTopUp(userID int, amount money.Money, promoCode string) (*models.TopUp, error) {
+	base, err := s.rates.Convert(amount, money.Base, money.RoundHalfUp)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported currency")
+	}
+	if base.LessThan(s.minTopUp) || s.maxTopUp.LessThan(base) {
+		return nil, fmt.Errorf("invalid amount")
+	}
+
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+
+	// Flagged accounts can't bring in more money until support has a look
+	if user.FlaggedAt != nil {
+		return nil, fmt.Errorf("account flagged")
+	}
+
+	provider, ok := s.providers[s.defaultProvider]
+	if !ok {
+		return nil, fmt.Errorf("top-ups disabled")
+	}
+
+	topUp, err := s.topUpRepo.CreateTopUp(userID, amount, provider.Name(), promoCode)
+	if err != nil {
+		if isPromoError(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to create top-up: %w", err)
+	}
+
+	intent, err := provider.CreatePayment(topUp)
+	if err != nil {
+		if markErr := s.topUpRepo.MarkTopUpFailed(topUp.ID, err.Error()); markErr != nil {
+			log.Printf("Failed to mark top-up %d as failed: %v", topUp.ID, markErr)
+		}
+		return nil, fmt.Errorf("failed to create payment: %w", err)
+	}
+
+	topUp, err = s.topUpRepo.SetProviderPayment(topUp.ID, intent.PaymentID, intent.ConfirmationURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create top-up: %w", err)
+	}
+
+	return topUp, nil
+}
+
+// ExchangeRates returns the configured rates against the base currency.
+func (s *BillingService) ExchangeRates() *money.Rates {
+	return s.rates
+}
+
+func (s *BillingService) GetTopUp(userID, topUpID int) (*models.TopUp, error) {
+	topUp, err := s.topUpRepo.GetTopUpByID(topUpID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Hide other users' top-ups
+	if topUp.UserID != userID {
+		return nil, fmt.Errorf("top-up not found")
+	}
+
+	return topUp, nil
+}
+
+// HandleCallback authenticates a provider callback and applies its outcome.
+// Callbacks are idempotent: repeated deliveries don't credit twice.
+func (s *BillingService) HandleCallback(providerName string, body []byte, headers http.Header) (*models.TopUp, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider")
+	}
+
+	callback, err := provider.ParseCallback(body, headers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback")
+	}
+
+	if callback.Succeeded {
+		return s.ConfirmTopUp(providerName, callback.PaymentID)
+	}
+
+	return s.FailTopUp(providerName, callback.PaymentID, callback.Reason)
+}
+
+func (s *BillingService) ConfirmTopUp(providerName, paymentID string) (*models.TopUp, error) {
+	topUp, err := s.topUpRepo.ConfirmTopUp(providerName, paymentID)
+	if err != nil {
+		switch err.Error() {
+		case "top-up not found", "top-up already failed":
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to confirm top-up: %w", err)
+	}
+
+	return topUp, nil
+}
+
+func (s *BillingService) FailTopUp(providerName, paymentID, reason string) (*models.TopUp, error) {
+	if reason == "" {
+		reason = "payment failed"
+	}
+
+	topUp, err := s.topUpRepo.FailTopUp(providerName, paymentID, reason)
+	if err != nil {
+		if err.Error() == "top-up not found" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to fail top-up: %w", err)
+	}
+
+	return topUp, nil
+}
+
+// RefundTopUp takes back a top-up the provider refunded to the payer.
+// amount is in minor units of the top-up currency; eventID identifies the
+// provider event, which is applied only once.
+func (s *BillingService) RefundTopUp(providerName, paymentID, eventID string, amount int64, reason string) (*models.TopUp, error) {
+	if reason == "" {
+		reason = "payment refunded"
+	}
+
+	topUp, _, err := s.topUpRepo.ReverseTopUp(providerName, paymentID, eventID, amount,
+		repository.EntryKindTopUpRefund, models.TopUpStatusRefunded, reason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refund top-up: %w", err)
+	}
+
+	return topUp, nil
+}
+
+// ChargebackTopUp takes back a top-up the payer disputed with their bank,
+// flags the account and refunds purchases made with the disputed money.
+func (s *BillingService) ChargebackTopUp(providerName, paymentID, eventID string, amount int64, reason string) (*models.TopUp, error) {
+	if reason == "" {
+		reason = "chargeback"
+	}
+
+	topUp, applied, err := s.topUpRepo.ReverseTopUp(providerName, paymentID, eventID, amount,
+		repository.EntryKindChargeback, models.TopUpStatusDisputed, reason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to charge back top-up: %w", err)
+	}
+	if !applied {
+		return topUp, nil
+	}
+
+	// The money is already taken back, so a redelivery must not repeat that;
+	// leftovers of a failed follow-up are for support to resolve
+	if err := s.refundService.HandleChargeback(topUp.UserID, topUp.Amount.Currency, reason); err != nil {
+		log.Printf("Failed to handle chargeback for top-up %d: %v", topUp.ID, err)
+	}
+
+	return topUp, nil
+}
+
+// WebhookDispatcher applies signed webhook events of one provider to top-ups.
+func (s *BillingService) WebhookDispatcher(providerName string) webhook.Dispatcher {
+	return &billingWebhookDispatcher{
+		billingService: s,
+		provider:       providerName,
+	}
+}
+
+type billingWebhookDispatcher struct {
+	billingService *BillingService
+	provider       string
+}
+
+func (d *billingWebhookDispatcher) PaymentSucceeded(event *webhook.Event) error {
+	_, err := d.billingService.ConfirmTopUp(d.provider, event.Data.PaymentID)
+	return err
+}
+
+func (d *billingWebhookDispatcher) PaymentFailed(event *webhook.Event) error {
+	_, err := d.billingService.FailTopUp(d.provider, event.Data.PaymentID, event.Data.Reason)
+	return err
+}
+
+func (d *billingWebhookDispatcher) PaymentRefunded(event *webhook.Event) error {
+	_, err := d.billingService.RefundTopUp(d.provider, event.Data.PaymentID, event.ID, int64(event.Data.Amount), event.Data.Reason)
+	return err
+}
+
+func (d *billingWebhookDispatcher) Chargeback(event *webhook.Event) error {
+	_, err := d.billingService.ChargebackTopUp(d.provider, event.Data.PaymentID, event.ID, int64(event.Data.Amount), event.Data.Reason)
+	return err
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"fmt"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/repository"
+)
+
+// DefaultProductCode is the product of reports created without a type.
+const DefaultProductCode = "standard"
+
+type CatalogService struct {
+	productRepo *repository.ProductRepository
+}
+
+func NewCatalogService(productRepo *repository.ProductRepository) *CatalogService {
+	return &CatalogService{
+		productRepo: productRepo,
+	}
+}
+
+func (s *CatalogService) ListProducts(activeOnly bool) ([]models.Product, error) {
+	products, err := s.productRepo.ListProducts(activeOnly)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list products: %w", err)
+	}
+
+	return products, nil
+}
+
+// ProductForReport looks up the report's product with its current price.
+// Prices are read on every purchase, so catalogue edits apply immediately.
+func (s *CatalogService) ProductForReport(report *models.Report) (*models.Product, error) {
+	code := report.ProductCode
+	if code == "" {
+		code = DefaultProductCode
+	}
+
+	product, err := s.productRepo.GetProductByCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	if !product.Active {
+		return nil, fmt.Errorf("product unavailable")
+	}
+
+	return product, nil
+}
+
+// ValidateProductCode checks that new reports can be created as code.
+func (s *CatalogService) ValidateProductCode(code string) error {
+	if code == "" {
+		return nil
+	}
+
+	product, err := s.productRepo.GetProductByCode(code)
+	if err != nil {
+		return err
+	}
+
+	if !product.Active {
+		return fmt.Errorf("product unavailable")
+	}
+
+	return nil
+}
+
+func (s *CatalogService) CreateProduct(code, name string, price money.Money) (*models.Product, error) {
+	return s.productRepo.CreateProduct(code, name, price)
+}
+
+func (s *CatalogService) UpdateProduct(code string, req models.UpdateProductRequest) (*models.Product, error) {
+	return s.productRepo.UpdateProduct(code, req.Name, req.Price, req.Active)
+}
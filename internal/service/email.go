@@ -0,0 +1,178 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+// EmailService manages users' optional email. An address is verified with
+// a signed, expiring link; nothing about pending verifications is stored.
+type EmailService struct {
+	userRepo      *repository.UserRepository
+	notifier      Notifier
+	secret        []byte
+	ttl           time.Duration
+	publicBaseURL string
+}
+
+func NewEmailService(userRepo *repository.UserRepository, notifier Notifier, secret string, ttl time.Duration, publicBaseURL string) *EmailService {
+	return &EmailService{
+		userRepo:      userRepo,
+		notifier:      notifier,
+		secret:        []byte(secret),
+		ttl:           ttl,
+		publicBaseURL: publicBaseURL,
+	}
+}
+
+// verificationClaims is what a verification link vouches for. The email is
+// included so links stop working once the user changes their email.
+type verificationClaims struct {
+	UserID    int    `json:"uid"`
+	Email     string `json:"email"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (s *EmailService) GetEmail(userID int) (*models.EmailResponse, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return emailResponse(user), nil
+}
+
+// SetEmail changes the user's email and sends a verification link to it.
+func (s *EmailService) SetEmail(userID int, email string) (*models.EmailResponse, error) {
+	email = strings.TrimSpace(email)
+
+	taken, err := s.userRepo.IsEmailTaken(email, userID)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, fmt.Errorf("email taken")
+	}
+
+	user, err := s.userRepo.SetEmail(userID, &email)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.EmailVerifiedAt == nil {
+		if err := s.sendVerification(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return emailResponse(user), nil
+}
+
+func (s *EmailService) RemoveEmail(userID int) error {
+	_, err := s.userRepo.SetEmail(userID, nil)
+	return err
+}
+
+// SendVerification sends a new verification link for the user's email.
+func (s *EmailService) SendVerification(userID int) error {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == nil {
+		return fmt.Errorf("no email")
+	}
+	if user.EmailVerifiedAt != nil {
+		return fmt.Errorf("email already verified")
+	}
+
+	return s.sendVerification(user)
+}
+
+// SendVerificationQuietly is SendVerification for when the user has just
+// given their email elsewhere, e.g. on registration. Failures are logged;
+// the user can ask for another link.
+func (s *EmailService) SendVerificationQuietly(user *models.User) {
+	if user.Email == nil || user.EmailVerifiedAt != nil {
+		return
+	}
+
+	if err := s.sendVerification(user); err != nil {
+		log.Printf("Failed to send email verification to user %d: %v", user.ID, err)
+	}
+}
+
+// Verify checks a verification link's token and marks the email verified.
+func (s *EmailService) Verify(token string) error {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return fmt.Errorf("invalid verification token")
+	}
+
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, s.sign(payload)) {
+		return fmt.Errorf("invalid verification token")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("invalid verification token")
+	}
+
+	var claims verificationClaims
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return fmt.Errorf("invalid verification token")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return fmt.Errorf("verification token expired")
+	}
+
+	return s.userRepo.VerifyEmail(claims.UserID, claims.Email)
+}
+
+func (s *EmailService) sendVerification(user *models.User) error {
+	expiresAt := time.Now().Add(s.ttl)
+	raw, err := json.Marshal(verificationClaims{
+		UserID:    user.ID,
+		Email:     *user.Email,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	token := payload + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+
+	verifyURL := s.publicBaseURL + "/api/auth/email/verify?token=" + url.QueryEscape(token)
+	if err := s.notifier.SendEmailVerification(*user.Email, verifyURL, expiresAt); err != nil {
+		return fmt.Errorf("failed to send verification link: %w", err)
+	}
+
+	return nil
+}
+
+// sign computes the link signature; the prefix keeps it from being valid
+// for anything else signed with the same secret.
+func (s *EmailService) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte("email-verification:" + payload))
+	return mac.Sum(nil)
+}
+
+func emailResponse(user *models.User) *models.EmailResponse {
+	return &models.EmailResponse{
+		Email:           user.Email,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+	}
+}
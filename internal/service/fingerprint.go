@@ -0,0 +1,88 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"zl0y-billing/internal/fingerprint"
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+// MaxFingerprintSize caps an ingested fingerprint document.
+const MaxFingerprintSize = 256 << 10
+
+const fingerprintMigrationBatchSize = 100
+
+// FingerprintService stores fingerprint analysis results on reports.
+type FingerprintService struct {
+	reportRepo *repository.ReportRepository
+}
+
+func NewFingerprintService(reportRepo *repository.ReportRepository) *FingerprintService {
+	return &FingerprintService{reportRepo: reportRepo}
+}
+
+// Ingest validates a result of any supported schema version and stores it,
+// upgraded to the current version, on the report. Invalid results are
+// rejected with a *fingerprint.ValidationError.
+func (s *FingerprintService) Ingest(reportID string, data []byte) (*models.FingerprintResult, error) {
+	if len(data) > MaxFingerprintSize {
+		return nil, fmt.Errorf("fingerprint too large")
+	}
+
+	result, err := fingerprint.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.reportRepo.SetReportFingerprint(reportID, result, string(data)); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// MigrateStored upgrades stored results written before the current schema
+// version by parsing their ingested documents again. Results that no longer
+// parse are logged and left alone. It returns the number of upgraded reports.
+func (s *FingerprintService) MigrateStored() (int, error) {
+	migrated := 0
+	after := ""
+	for {
+		reports, err := s.reportRepo.GetOutdatedFingerprints(fingerprint.CurrentVersion, after, fingerprintMigrationBatchSize)
+		if err != nil {
+			return migrated, err
+		}
+
+		for _, report := range reports {
+			after = report.ReportID
+
+			result, err := fingerprint.Parse([]byte(report.FingerprintRaw))
+			if err != nil {
+				log.Printf("Failed to upgrade the fingerprint of report %s: %v", report.ReportID, describeFingerprintError(err))
+				continue
+			}
+
+			if err := s.reportRepo.SetReportFingerprint(report.ReportID, result, report.FingerprintRaw); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+
+		if len(reports) < fingerprintMigrationBatchSize {
+			return migrated, nil
+		}
+	}
+}
+
+// describeFingerprintError spells out validation problems.
+func describeFingerprintError(err error) string {
+	var invalid *fingerprint.ValidationError
+	if errors.As(err, &invalid) {
+		return fmt.Sprintf("%v: %s", invalid, strings.Join(invalid.Problems, "; "))
+	}
+	return err.Error()
+}
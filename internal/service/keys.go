@@ -0,0 +1,340 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms
+const (
+	SigningAlgEdDSA = "EdDSA"
+	SigningAlgRS256 = "RS256"
+)
+
+// keyReloadInterval limits reloads caused by tokens with an unknown kid.
+const keyReloadInterval = 10 * time.Second
+
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	private   crypto.Signer
+	notBefore time.Time
+}
+
+// KeyService holds the key set that signs access tokens. Keys live in
+// Postgres so every instance signs with the same key. A new key is added
+// overlap before it starts signing, so verifiers that cache the JWKS see it
+// in time; a replaced key stays published until the last token it signed
+// has expired.
+type KeyService struct {
+	keyRepo          *repository.SigningKeyRepository
+	algorithm        string
+	rotationInterval time.Duration
+	overlap          time.Duration
+	accessTokenTTL   time.Duration
+
+	mu         sync.RWMutex
+	keys       []signingKey // oldest first
+	reloadedAt time.Time
+}
+
+func NewKeyService(keyRepo *repository.SigningKeyRepository, algorithm string, rotationInterval, overlap, accessTokenTTL time.Duration) (*KeyService, error) {
+	if algorithm != SigningAlgEdDSA && algorithm != SigningAlgRS256 {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+
+	s := &KeyService{
+		keyRepo:          keyRepo,
+		algorithm:        algorithm,
+		rotationInterval: rotationInterval,
+		overlap:          overlap,
+		accessTokenTTL:   accessTokenTTL,
+	}
+
+	// Make sure there is a key to sign with before serving requests
+	if err := s.Rotate(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Sign signs claims with the current key, naming it in the kid header.
+func (s *KeyService) Sign(claims jwt.Claims) (string, error) {
+	key, err := s.currentKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// Keyfunc returns the public key a token names in its kid header. Keys added
+// by other instances are picked up on demand.
+func (s *KeyService) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("token has no kid")
+	}
+
+	key, ok := s.findKey(kid)
+	if !ok && s.reloadAllowed() {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		key, ok = s.findKey(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+
+	// The algorithm is the key's, never what the token claims
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	return key.private.Public(), nil
+}
+
+// ValidMethods lists the algorithms tokens may be signed with.
+func (s *KeyService) ValidMethods() []string {
+	return []string{SigningAlgEdDSA, SigningAlgRS256}
+}
+
+// JWKS returns the public keys of the set, including ones not signing yet
+// and ones replaced but still verifying.
+func (s *KeyService) JWKS() *models.JWKSResponse {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	response := &models.JWKSResponse{Keys: []models.JWK{}}
+	for _, key := range s.keys {
+		jwk := models.JWK{
+			Use: "sig",
+			Alg: key.method.Alg(),
+			Kid: key.kid,
+		}
+
+		switch public := key.private.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+
+		response.Keys = append(response.Keys, jwk)
+	}
+
+	return response
+}
+
+// Rotate adds the next key once the current one is due for replacement and
+// reloads the key set. The first key is added straight away.
+func (s *KeyService) Rotate() error {
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.mu.RLock()
+	var latest time.Time
+	if len(s.keys) > 0 {
+		latest = s.keys[len(s.keys)-1].notBefore
+	}
+	s.mu.RUnlock()
+
+	var delay time.Duration
+	switch {
+	case latest.IsZero():
+		// Nothing could have cached an empty set
+	case now.Before(latest.Add(s.rotationInterval - s.overlap)):
+		return nil
+	default:
+		delay = s.overlap
+	}
+
+	key, err := s.generateKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate signing key: %w", err)
+	}
+
+	// Replaced keys verify until the tokens they signed last have expired,
+	// with overlap to spare for clock skew
+	added, err := s.keyRepo.AddKey(*key, latest, delay, s.accessTokenTTL+s.overlap)
+	if err != nil {
+		return err
+	}
+	if added {
+		log.Printf("Added signing key %s, signing in %s", key.KID, delay)
+	}
+
+	return s.load()
+}
+
+// Run rotates keys and picks up keys added by other instances until ctx is
+// cancelled. interval must be well below the overlap.
+func (s *KeyService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Rotate(); err != nil {
+				log.Printf("Failed to rotate signing keys: %v", err)
+			}
+		}
+	}
+}
+
+func (s *KeyService) currentKey() (*signingKey, error) {
+	now := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Keys are sorted oldest first; the newest one in effect signs
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if !now.Before(s.keys[i].notBefore) {
+			return &s.keys[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no signing key in effect")
+}
+
+func (s *KeyService) findKey(kid string) (*signingKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := range s.keys {
+		if s.keys[i].kid == kid {
+			return &s.keys[i], true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *KeyService) reloadAllowed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Since(s.reloadedAt) < keyReloadInterval {
+		return false
+	}
+	s.reloadedAt = time.Now()
+	return true
+}
+
+func (s *KeyService) load() error {
+	stored, err := s.keyRepo.GetUnexpiredKeys()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]signingKey, 0, len(stored))
+	for _, k := range stored {
+		key, err := parseSigningKey(k)
+		if err != nil {
+			return fmt.Errorf("failed to parse signing key %s: %w", k.KID, err)
+		}
+		keys = append(keys, *key)
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *KeyService) generateKey() (*models.SigningKey, error) {
+	var private crypto.Signer
+	switch s.algorithm {
+	case SigningAlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	default:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		private = key
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+
+	return &models.SigningKey{
+		KID:        hex.EncodeToString(kid),
+		Algorithm:  s.algorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}, nil
+}
+
+func parseSigningKey(k models.SigningKey) (*signingKey, error) {
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{
+		kid:       k.KID,
+		notBefore: k.NotBefore,
+	}
+
+	switch private := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.method, key.private = jwt.SigningMethodEdDSA, private
+	case *rsa.PrivateKey:
+		key.method, key.private = jwt.SigningMethodRS256, private
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	if key.method.Alg() != k.Algorithm {
+		return nil, fmt.Errorf("key type doesn't match algorithm %s", k.Algorithm)
+	}
+
+	return key, nil
+}
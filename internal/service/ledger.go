@@ -0,0 +1,49 @@
+package service
+
+import (
+	"fmt"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+type LedgerService struct {
+	ledgerRepo *repository.LedgerRepository
+}
+
+func NewLedgerService(ledgerRepo *repository.LedgerRepository) *LedgerService {
+	return &LedgerService{
+		ledgerRepo: ledgerRepo,
+	}
+}
+
+// Migrate posts opening balances for users that predate the ledger.
+func (s *LedgerService) Migrate() (int, error) {
+	count, err := s.ledgerRepo.BackfillOpeningBalances()
+	if err != nil {
+		return 0, fmt.Errorf("failed to backfill opening balances: %w", err)
+	}
+
+	return count, nil
+}
+
+// Reconcile compares cached balances with the ledger. With fix set, every
+// mismatching cached balance is recomputed from the postings.
+func (s *LedgerService) Reconcile(fix bool) ([]models.BalanceMismatch, error) {
+	mismatches, err := s.ledgerRepo.FindBalanceMismatches()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find balance mismatches: %w", err)
+	}
+
+	if !fix {
+		return mismatches, nil
+	}
+
+	for _, m := range mismatches {
+		if err := s.ledgerRepo.RecomputeUserBalance(m.UserID); err != nil {
+			return nil, fmt.Errorf("failed to recompute balance for user %d: %w", m.UserID, err)
+		}
+	}
+
+	return mismatches, nil
+}
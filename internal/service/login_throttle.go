@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+const (
+	// freeLoginFailures is how many failures go without a delay
+	freeLoginFailures = 3
+	// maxLoginDelay caps the delay, which doubles with every further failure
+	maxLoginDelay = 30 * time.Second
+	// maxResetRequests and maxIPResetRequests are how many password reset
+	// requests a login and an IP may make within the window
+	maxResetRequests   = 3
+	maxIPResetRequests = 20
+)
+
+// LoginBlockedError is returned for login attempts refused before checking
+// the password. Error() is "account locked" for a locked login and "too many
+// attempts" for delays and locked IPs.
+type LoginBlockedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *LoginBlockedError) Error() string {
+	return e.Reason
+}
+
+// LoginThrottleService slows down password guessing. Failed logins are
+// counted per login and per client IP: after a few failures every attempt
+// has to wait a little longer, and too many lock the login or IP out for a
+// while. State lives in Postgres, so it holds across restarts and instances.
+type LoginThrottleService struct {
+	throttleRepo     *repository.LoginThrottleRepository
+	maxLoginFailures int
+	maxIPFailures    int
+	lockout          time.Duration
+	window           time.Duration
+}
+
+func NewLoginThrottleService(throttleRepo *repository.LoginThrottleRepository, maxLoginFailures, maxIPFailures int, lockout, window time.Duration) *LoginThrottleService {
+	return &LoginThrottleService{
+		throttleRepo:     throttleRepo,
+		maxLoginFailures: maxLoginFailures,
+		maxIPFailures:    maxIPFailures,
+		lockout:          lockout,
+		window:           window,
+	}
+}
+
+// Check returns a *LoginBlockedError if a login attempt for login from ip
+// must be refused right now.
+func (s *LoginThrottleService) Check(login, ip string) error {
+	login = loginThrottleKey(login)
+	loginState, err := s.throttleRepo.GetState(models.ThrottleScopeLogin, login, s.window)
+	if err != nil {
+		return err
+	}
+	if loginState.LockedFor > 0 {
+		return &LoginBlockedError{Reason: "account locked", RetryAfter: loginState.LockedFor}
+	}
+
+	ipState, err := s.throttleRepo.GetState(models.ThrottleScopeIP, ip, s.window)
+	if err != nil {
+		return err
+	}
+	if ipState.LockedFor > 0 {
+		return &LoginBlockedError{Reason: "too many attempts", RetryAfter: ipState.LockedFor}
+	}
+
+	for _, state := range []*repository.ThrottleState{loginState, ipState} {
+		if wait := loginDelay(state.Failures) - state.SinceLastFailure; wait > 0 {
+			return &LoginBlockedError{Reason: "too many attempts", RetryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+// RecordFailure counts a failed login for both the login and the IP.
+// Unknown logins count too, so lockouts don't reveal which logins exist.
+func (s *LoginThrottleService) RecordFailure(login, ip string) error {
+	login = loginThrottleKey(login)
+	locked, err := s.throttleRepo.RecordFailure(models.ThrottleScopeLogin, login, s.window, s.maxLoginFailures, s.lockout)
+	if err != nil {
+		return err
+	}
+	if locked {
+		log.Printf("Locked out login %q for %s after %d failed attempts", login, s.lockout, s.maxLoginFailures)
+	}
+
+	locked, err = s.throttleRepo.RecordFailure(models.ThrottleScopeIP, ip, s.window, s.maxIPFailures, s.lockout)
+	if err != nil {
+		return err
+	}
+	if locked {
+		log.Printf("Locked out IP %s for %s after %d failed attempts", ip, s.lockout, s.maxIPFailures)
+	}
+
+	return nil
+}
+
+// CheckPasswordReset returns a *LoginBlockedError if a password reset request
+// for login from ip must be refused right now, and counts it otherwise.
+// Reset requests are counted apart from failed logins, so they can't lock
+// anybody out of logging in.
+func (s *LoginThrottleService) CheckPasswordReset(login, ip string) error {
+	login = loginThrottleKey(login)
+	limits := []struct {
+		scope, key  string
+		maxRequests int
+	}{
+		{models.ThrottleScopeResetLogin, login, maxResetRequests},
+		{models.ThrottleScopeResetIP, ip, maxIPResetRequests},
+	}
+
+	for _, limit := range limits {
+		state, err := s.throttleRepo.GetState(limit.scope, limit.key, s.window)
+		if err != nil {
+			return err
+		}
+		if state.LockedFor > 0 {
+			return &LoginBlockedError{Reason: "too many attempts", RetryAfter: state.LockedFor}
+		}
+	}
+
+	for _, limit := range limits {
+		locked, err := s.throttleRepo.RecordFailure(limit.scope, limit.key, s.window, limit.maxRequests, s.lockout)
+		if err != nil {
+			return err
+		}
+		if locked {
+			log.Printf("Blocked password reset requests of %s %q for %s after %d requests", limit.scope, limit.key, s.lockout, limit.maxRequests)
+		}
+	}
+
+	return nil
+}
+
+// RecordSuccess forgets the failures of the login. Those of the IP stay, or
+// an attacker could reset them by logging into an account of their own.
+func (s *LoginThrottleService) RecordSuccess(login string) error {
+	_, err := s.throttleRepo.Reset(models.ThrottleScopeLogin, loginThrottleKey(login))
+	return err
+}
+
+// GetLockouts lists the logins and IPs locked out now.
+func (s *LoginThrottleService) GetLockouts() (*models.LockoutsResponse, error) {
+	lockouts, err := s.throttleRepo.GetLockouts()
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.LockoutsResponse{
+		Lockouts: lockouts,
+	}, nil
+}
+
+// ClearLockout lifts the lockout of a login or IP and forgets its failures.
+func (s *LoginThrottleService) ClearLockout(scope, key string) error {
+	switch scope {
+	case models.ThrottleScopeLogin, models.ThrottleScopeResetLogin:
+		key = loginThrottleKey(key)
+	case models.ThrottleScopeIP, models.ThrottleScopeResetIP:
+	default:
+		return fmt.Errorf("invalid scope")
+	}
+
+	cleared, err := s.throttleRepo.Reset(scope, key)
+	if err != nil {
+		return err
+	}
+	if !cleared {
+		return fmt.Errorf("lockout not found")
+	}
+
+	log.Printf("Cleared login throttle of %s %q", scope, key)
+	return nil
+}
+
+// Run hourly removes entries that have nothing to throttle any more, until ctx is cancelled.
+func (s *LoginThrottleService) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.throttleRepo.DeleteStale(s.window); err != nil {
+				log.Printf("Failed to delete stale login throttles: %v", err)
+			}
+		}
+	}
+}
+
+// loginThrottleKey is the key failures of login are counted under. Emails
+// match case-insensitively when logging in, so every spelling of one must
+// share a counter.
+func loginThrottleKey(login string) string {
+	return strings.ToLower(strings.TrimSpace(login))
+}
+
+// loginDelay is how long to wait after the last of failures before trying again.
+func loginDelay(failures int) time.Duration {
+	if failures < freeLoginFailures {
+		return 0
+	}
+
+	delay := time.Second
+	for i := freeLoginFailures; i < failures && delay < maxLoginDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxLoginDelay)
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier delivers messages to users, e.g. by email. to is the user's
+// verified email, or their login if they have none.
+type Notifier interface {
+	// SendPasswordReset delivers a password reset link to the user
+	SendPasswordReset(to, resetURL string, expiresAt time.Time) error
+	// SendEmailVerification delivers a link confirming the user owns the email to
+	SendEmailVerification(to, verifyURL string, expiresAt time.Time) error
+}
+
+// NewNotifier returns the notifier named in the config: "log" or "file".
+func NewNotifier(name, path string) (Notifier, error) {
+	switch name {
+	case "log":
+		return LogNotifier{}, nil
+	case "file":
+		return NewFileNotifier(path), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier %q", name)
+	}
+}
+
+// LogNotifier writes notifications to the service log. For local use only:
+// the log then holds working reset links.
+type LogNotifier struct{}
+
+func (LogNotifier) SendPasswordReset(to, resetURL string, expiresAt time.Time) error {
+	log.Printf("Password reset for %s: %s (expires %s)", to, resetURL, expiresAt.Format(time.RFC3339))
+	return nil
+}
+
+func (LogNotifier) SendEmailVerification(to, verifyURL string, expiresAt time.Time) error {
+	log.Printf("Email verification for %s: %s (expires %s)", to, verifyURL, expiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// FileNotifier appends notifications to a file as JSON lines, so local tools
+// and scripts can pick them up.
+type FileNotifier struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	return &FileNotifier{path: path}
+}
+
+type fileNotification struct {
+	Type      string    `json:"type"`
+	To        string    `json:"to"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+func (n *FileNotifier) SendPasswordReset(to, resetURL string, expiresAt time.Time) error {
+	return n.write(fileNotification{
+		Type:      "password_reset",
+		To:        to,
+		URL:       resetURL,
+		ExpiresAt: expiresAt,
+		SentAt:    time.Now(),
+	})
+}
+
+func (n *FileNotifier) SendEmailVerification(to, verifyURL string, expiresAt time.Time) error {
+	return n.write(fileNotification{
+		Type:      "email_verification",
+		To:        to,
+		URL:       verifyURL,
+		ExpiresAt: expiresAt,
+		SentAt:    time.Now(),
+	})
+}
+
+func (n *FileNotifier) write(notification fileNotification) error {
+	line, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open notification file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write notification: %w", err)
+	}
+
+	return nil
+}
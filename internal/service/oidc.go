@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/oidc"
+	"zl0y-billing/internal/repository"
+)
+
+// OIDCLoginResult is the outcome of a provider callback: tokens or a 2FA
+// challenge for a login, the linked identity when a logged-in user linked one.
+type OIDCLoginResult struct {
+	Auth      *models.AuthResponse
+	Challenge *models.LoginChallengeResponse
+	Linked    *models.UserIdentity
+}
+
+// OIDCService logs users in with accounts at OpenID providers. An identity
+// logs in as the user it is linked to; a new identity is linked to the user
+// who verified the same email, or gets a new user.
+type OIDCService struct {
+	providers    map[string]*oidc.Provider
+	identityRepo *repository.IdentityRepository
+	userRepo     *repository.UserRepository
+	auth         *AuthService
+	stateTTL     time.Duration
+}
+
+func NewOIDCService(providers map[string]*oidc.Provider, identityRepo *repository.IdentityRepository, userRepo *repository.UserRepository, auth *AuthService, stateTTL time.Duration) *OIDCService {
+	return &OIDCService{
+		providers:    providers,
+		identityRepo: identityRepo,
+		userRepo:     userRepo,
+		auth:         auth,
+		stateTTL:     stateTTL,
+	}
+}
+
+// Providers lists the configured provider names.
+func (s *OIDCService) Providers() *models.OIDCProvidersResponse {
+	names := []string{}
+	for name := range s.providers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return &models.OIDCProvidersResponse{Providers: names}
+}
+
+// Start begins a login at the provider. With linkUserID set, the callback
+// links the identity to that user instead of logging in. It also returns the
+// browser secret, to be kept in a cookie of the browser starting the login:
+// the callback only works with it, so a login or link started by someone else
+// can't be completed in a victim's browser.
+func (s *OIDCService) Start(ctx context.Context, providerName, loginHint string, linkUserID *int) (*models.OIDCStartResponse, string, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown provider")
+	}
+
+	state, err := generateRefreshToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate state: %w", err)
+	}
+	browserSecret, err := generateRefreshToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate browser secret: %w", err)
+	}
+	nonce, err := generateTokenID()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	verifier, err := oidc.GenerateVerifier()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate code verifier: %w", err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, oidc.Challenge(verifier), loginHint)
+	if err != nil {
+		log.Printf("Failed to reach OpenID provider %s: %v", providerName, err)
+		return nil, "", fmt.Errorf("provider unavailable")
+	}
+
+	if err := s.identityRepo.CreateLoginState(hashToken(state), hashToken(browserSecret), providerName, nonce, verifier, linkUserID, s.stateTTL); err != nil {
+		return nil, "", err
+	}
+
+	return &models.OIDCStartResponse{
+		AuthorizationURL: authURL,
+		ExpiresIn:        int(s.stateTTL.Seconds()),
+	}, browserSecret, nil
+}
+
+// StateTTL is how long a login started with Start can be completed.
+func (s *OIDCService) StateTTL() time.Duration {
+	return s.stateTTL
+}
+
+// Callback completes a login started with Start, on the device described by
+// userAgent and ip. browserSecret is the one Start returned. A link also
+// needs the user who started it logged in, as currentUserID.
+func (s *OIDCService) Callback(ctx context.Context, providerName, state, browserSecret, code, userAgent, ip string, currentUserID *int) (*OIDCLoginResult, error) {
+	provider, ok := s.providers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider")
+	}
+	if browserSecret == "" {
+		return nil, fmt.Errorf("invalid state")
+	}
+
+	login, err := s.identityRepo.TakeLoginState(hashToken(state), hashToken(browserSecret), providerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if login.LinkUserID != nil && (currentUserID == nil || *currentUserID != *login.LinkUserID) {
+		return nil, fmt.Errorf("link requires login")
+	}
+
+	identity, err := provider.Exchange(ctx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		log.Printf("Failed to log in with OpenID provider %s: %v", providerName, err)
+		return nil, fmt.Errorf("provider login failed")
+	}
+
+	if login.LinkUserID != nil {
+		linked, err := s.identityRepo.LinkIdentity(*login.LinkUserID, providerName, identity.Subject, identity.Email)
+		if err != nil {
+			return nil, err
+		}
+		return &OIDCLoginResult{Linked: linked}, nil
+	}
+
+	userID, err := s.resolveUser(providerName, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	response, challenge, err := s.auth.LoginUser(userID, userAgent, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCLoginResult{Auth: response, Challenge: challenge}, nil
+}
+
+func (s *OIDCService) GetIdentities(userID int) (*models.IdentitiesResponse, error) {
+	identities, err := s.identityRepo.GetUserIdentities(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.IdentitiesResponse{Identities: identities}, nil
+}
+
+func (s *OIDCService) Unlink(userID int, providerName string) error {
+	return s.identityRepo.UnlinkIdentity(userID, providerName)
+}
+
+// resolveUser finds or creates the user the identity logs in as.
+func (s *OIDCService) resolveUser(providerName string, identity *oidc.Identity) (int, error) {
+	existing, err := s.identityRepo.UseIdentity(providerName, identity.Subject, identity.Email)
+	if err == nil {
+		return existing.UserID, nil
+	}
+	if err.Error() != "identity not found" {
+		return 0, err
+	}
+
+	// An account is claimed only when both sides verified the email
+	verified := identity.EmailVerified && identity.Email != ""
+	if verified {
+		user, err := s.userRepo.GetUserByVerifiedEmail(identity.Email)
+		if err == nil {
+			if _, err := s.identityRepo.LinkIdentity(user.ID, providerName, identity.Subject, identity.Email); err != nil {
+				return 0, err
+			}
+			return user.ID, nil
+		}
+		if err.Error() != "user not found" {
+			return 0, err
+		}
+
+		user, err = s.identityRepo.CreateUserWithIdentity(identity.Email, providerName, identity.Subject, identity.Email, true)
+		if err == nil {
+			return user.ID, nil
+		}
+		if err.Error() != "login taken" {
+			return 0, err
+		}
+	}
+
+	// Unverified emails can't be logins, someone else may register them
+	user, err := s.identityRepo.CreateUserWithIdentity(providerName+":"+identity.Subject, providerName, identity.Subject, identity.Email, verified)
+	if err != nil {
+		return 0, err
+	}
+
+	return user.ID, nil
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"zl0y-billing/internal/models"
+)
+
+// PaymentIntent is what a provider returns for a newly created payment.
+type PaymentIntent struct {
+	PaymentID       string
+	ConfirmationURL string // Where the user completes the payment
+}
+
+// PaymentCallback is a provider notification about the outcome of a payment.
+type PaymentCallback struct {
+	PaymentID string
+	Succeeded bool
+	Reason    string
+}
+
+// PaymentProvider is implemented by every payment integration.
+type PaymentProvider interface {
+	// Name identifies the provider in URLs and in the topups table
+	Name() string
+	// CreatePayment registers the top-up with the provider
+	CreatePayment(topUp *models.TopUp) (*PaymentIntent, error)
+	// ParseCallback authenticates and decodes a provider callback
+	ParseCallback(body []byte, headers http.Header) (*PaymentCallback, error)
+}
+
+const FakeProviderSecretHeader = "X-Fake-Provider-Secret"
+
+// FakeProvider is a payment provider for local testing. Payments are
+// completed by posting a callback, e.g. through /api/mock/payments.
+type FakeProvider struct {
+	secret  string
+	baseURL string
+}
+
+func NewFakeProvider(secret, baseURL string) *FakeProvider {
+	return &FakeProvider{
+		secret:  secret,
+		baseURL: baseURL,
+	}
+}
+
+type fakeCallback struct {
+	PaymentID string `json:"payment_id"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) CreatePayment(topUp *models.TopUp) (*PaymentIntent, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate payment ID: %w", err)
+	}
+	paymentID := "fake_" + hex.EncodeToString(buf)
+
+	return &PaymentIntent{
+		PaymentID:       paymentID,
+		ConfirmationURL: fmt.Sprintf("%s/api/mock/payments/%s/complete", p.baseURL, paymentID),
+	}, nil
+}
+
+func (p *FakeProvider) ParseCallback(body []byte, headers http.Header) (*PaymentCallback, error) {
+	if p.secret != "" && subtle.ConstantTimeCompare([]byte(headers.Get(FakeProviderSecretHeader)), []byte(p.secret)) != 1 {
+		return nil, fmt.Errorf("invalid callback")
+	}
+
+	var callback fakeCallback
+	if err := json.Unmarshal(body, &callback); err != nil || callback.PaymentID == "" {
+		return nil, fmt.Errorf("invalid callback")
+	}
+
+	switch callback.Status {
+	case "succeeded", "failed":
+	default:
+		return nil, fmt.Errorf("invalid callback")
+	}
+
+	return &PaymentCallback{
+		PaymentID: callback.PaymentID,
+		Succeeded: callback.Status == "succeeded",
+		Reason:    callback.Reason,
+	}, nil
+}
+
+// Callback builds the callback the fake provider would send for a payment.
+func (p *FakeProvider) Callback(paymentID, status, reason string) ([]byte, http.Header) {
+	body, _ := json.Marshal(fakeCallback{
+		PaymentID: paymentID,
+		Status:    status,
+		Reason:    reason,
+	})
+
+	headers := http.Header{}
+	headers.Set(FakeProviderSecretHeader, p.secret)
+
+	return body, headers
+}
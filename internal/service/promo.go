@@ -0,0 +1,77 @@
+package service
+
+import (
+	"fmt"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/repository"
+)
+
+// promoErrors are the reasons a promo code is refused. They are passed on
+// unwrapped so handlers can tell the user what is wrong with the code.
+var promoErrors = map[string]bool{
+	"promo code not found":                  true,
+	"promo code not applicable":             true,
+	"promo code expired":                    true,
+	"promo code exhausted":                  true,
+	"promo code limit reached":              true,
+	"promo code is for first purchase only": true,
+}
+
+func isPromoError(err error) bool {
+	return promoErrors[err.Error()]
+}
+
+type PromoService struct {
+	promoRepo *repository.PromoRepository
+}
+
+func NewPromoService(promoRepo *repository.PromoRepository) *PromoService {
+	return &PromoService{
+		promoRepo: promoRepo,
+	}
+}
+
+// Quote returns the discount or bonus code would give the user on amount.
+// Nothing is redeemed: the purchase or top-up re-checks the code when it redeems it.
+func (s *PromoService) Quote(code string, userID int, target string, amount money.Money) (money.Money, error) {
+	_, value, err := s.promoRepo.QuotePromoCode(code, userID, target, amount)
+	if err != nil {
+		if isPromoError(err) {
+			return money.Money{}, err
+		}
+		return money.Money{}, fmt.Errorf("failed to check promo code: %w", err)
+	}
+
+	return value, nil
+}
+
+func (s *PromoService) CreatePromoCode(req models.CreatePromoCodeRequest) (*models.PromoCode, error) {
+	if req.DiscountType == models.PromoDiscountPercent && req.Value > 100 {
+		return nil, fmt.Errorf("invalid promo value")
+	}
+
+	if repository.NormalizePromoCode(req.Code) == "" {
+		return nil, fmt.Errorf("invalid promo code")
+	}
+
+	currency, err := money.ParseCurrency(req.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.promoRepo.CreatePromoCode(req, currency)
+}
+
+func (s *PromoService) ListPromoCodes() ([]models.PromoCode, error) {
+	return s.promoRepo.ListPromoCodes()
+}
+
+func (s *PromoService) UpdatePromoCode(code string, req models.UpdatePromoCodeRequest) (*models.PromoCode, error) {
+	return s.promoRepo.UpdatePromoCode(code, req)
+}
+
+func (s *PromoService) GetRedemptions(code string) ([]models.PromoRedemption, error) {
+	return s.promoRepo.GetRedemptions(code)
+}
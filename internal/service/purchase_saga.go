@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+// purchaseLease is how long a purchase is reserved for whoever is driving it
+// before the background worker may pick it up again.
+const purchaseLease = 30 * time.Second
+
+const purchaseBatchSize = 50
+
+// maxRetryDelay caps the backoff of steps that are retried forever.
+const maxRetryDelay = time.Hour
+
+// PurchaseSaga moves report purchases through
+// pending -> charged -> unlocked, or compensates by refunding the charge.
+// Full refunds go on through refunding -> refunded. Every step is persisted
+// in Postgres, so a crashed request is finished by the background worker
+// after restart.
+type PurchaseSaga struct {
+	purchaseRepo *repository.PurchaseRepository
+	reportRepo   *repository.ReportRepository
+	maxAttempts  int
+	retryDelay   time.Duration
+}
+
+func NewPurchaseSaga(purchaseRepo *repository.PurchaseRepository, reportRepo *repository.ReportRepository, maxAttempts int, retryDelay time.Duration) *PurchaseSaga {
+	return &PurchaseSaga{
+		purchaseRepo: purchaseRepo,
+		reportRepo:   reportRepo,
+		maxAttempts:  maxAttempts,
+		retryDelay:   retryDelay,
+	}
+}
+
+// Advance drives the purchase as far as it can go right now. A step that
+// fails transiently is scheduled for a retry and the current state is returned.
+func (s *PurchaseSaga) Advance(p *models.Purchase) (*models.Purchase, error) {
+	for {
+		var next *models.Purchase
+		var err error
+
+		switch p.State {
+		case models.PurchaseStatePending:
+			next, err = s.charge(p)
+		case models.PurchaseStateCharged:
+			next, err = s.unlock(p)
+		case models.PurchaseStateRefunding:
+			next, err = s.relock(p)
+		default:
+			return p, nil
+		}
+
+		if err != nil {
+			return p, err
+		}
+
+		// The step was postponed
+		if next.State == p.State {
+			return next, nil
+		}
+
+		p = next
+	}
+}
+
+func (s *PurchaseSaga) charge(p *models.Purchase) (*models.Purchase, error) {
+	next, err := s.purchaseRepo.ChargePurchase(p.ID)
+	if err == nil {
+		return next, nil
+	}
+
+	if err.Error() == "insufficient balance" {
+		return s.purchaseRepo.MarkPurchaseFailed(p.ID, err.Error())
+	}
+
+	return s.retry(p, err, func(reason string) (*models.Purchase, error) {
+		return s.purchaseRepo.MarkPurchaseFailed(p.ID, reason)
+	})
+}
+
+func (s *PurchaseSaga) unlock(p *models.Purchase) (*models.Purchase, error) {
+	err := s.reportRepo.MarkReportAsPurchased(p.ReportID)
+	if err == nil {
+		return s.purchaseRepo.MarkPurchaseUnlocked(p.ID)
+	}
+
+	// Retrying won't bring a missing report back
+	if err.Error() == "report not found" {
+		return s.compensate(p, err.Error())
+	}
+
+	return s.retry(p, err, func(reason string) (*models.Purchase, error) {
+		return s.compensate(p, reason)
+	})
+}
+
+func (s *PurchaseSaga) relock(p *models.Purchase) (*models.Purchase, error) {
+	err := s.reportRepo.MarkReportAsRefunded(p.ReportID)
+	if err == nil || err.Error() == "report not found" {
+		return s.purchaseRepo.MarkPurchaseRefunded(p.ID)
+	}
+
+	// The money is already back on the balance, so there is nothing to
+	// compensate: keep retrying until the report is locked
+	backoff := min(s.retryDelay*time.Duration(1<<min(p.Attempts, 20)), maxRetryDelay)
+	return s.purchaseRepo.RecordPurchaseFailure(p.ID, err.Error(), backoff)
+}
+
+func (s *PurchaseSaga) retry(p *models.Purchase, cause error, giveUp func(reason string) (*models.Purchase, error)) (*models.Purchase, error) {
+	if p.Attempts+1 >= s.maxAttempts {
+		log.Printf("Purchase %d gave up after %d attempts: %v", p.ID, p.Attempts+1, cause)
+		return giveUp(cause.Error())
+	}
+
+	// Exponential backoff: retryDelay, 2*retryDelay, 4*retryDelay, ...
+	backoff := s.retryDelay * time.Duration(1<<p.Attempts)
+	return s.purchaseRepo.RecordPurchaseFailure(p.ID, cause.Error(), backoff)
+}
+
+func (s *PurchaseSaga) compensate(p *models.Purchase, reason string) (*models.Purchase, error) {
+	// Best effort: an unlock that landed but wasn't acknowledged must not survive the refund
+	if err := s.reportRepo.MarkReportAsUnpurchased(p.ReportID); err != nil {
+		log.Printf("Failed to re-lock report %s for purchase %d: %v", p.ReportID, p.ID, err)
+	}
+
+	return s.purchaseRepo.CompensatePurchase(p.ID, reason)
+}
+
+// ProcessDue advances every unfinished purchase whose next attempt is due.
+func (s *PurchaseSaga) ProcessDue() int {
+	processed := 0
+	for {
+		purchases, err := s.purchaseRepo.ClaimDuePurchases(purchaseBatchSize, purchaseLease)
+		if err != nil {
+			log.Printf("Failed to claim due purchases: %v", err)
+			return processed
+		}
+
+		for i := range purchases {
+			if _, err := s.Advance(&purchases[i]); err != nil {
+				log.Printf("Failed to advance purchase %d: %v", purchases[i].ID, err)
+			}
+		}
+		processed += len(purchases)
+
+		if len(purchases) < purchaseBatchSize {
+			return processed
+		}
+	}
+}
+
+// Run processes due purchases immediately, which recovers whatever a previous
+// run left behind, and then every interval until ctx is cancelled.
+func (s *PurchaseSaga) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n := s.ProcessDue(); n > 0 {
+			log.Printf("Processed %d pending purchases", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
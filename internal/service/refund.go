@@ -0,0 +1,88 @@
+package service
+
+import (
+	"fmt"
+	"log"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/repository"
+)
+
+type RefundService struct {
+	purchaseRepo *repository.PurchaseRepository
+	userRepo     *repository.UserRepository
+	saga         *PurchaseSaga
+}
+
+func NewRefundService(purchaseRepo *repository.PurchaseRepository, userRepo *repository.UserRepository, saga *PurchaseSaga) *RefundService {
+	return &RefundService{
+		purchaseRepo: purchaseRepo,
+		userRepo:     userRepo,
+		saga:         saga,
+	}
+}
+
+// RefundPurchase credits amount (0 means whatever is left) back to the
+// wallet it was paid from; amount is in minor units of the purchase currency.
+// A full refund also locks the report again.
+func (s *RefundService) RefundPurchase(purchaseID int, amount int64, reason, source string) (*models.Purchase, *models.Refund, error) {
+	if amount < 0 {
+		return nil, nil, fmt.Errorf("invalid amount")
+	}
+
+	purchase, refund, err := s.purchaseRepo.RefundPurchase(purchaseID, amount, reason, source)
+	if err != nil {
+		switch err.Error() {
+		case "purchase not found", "purchase is not refundable", "refund exceeds purchase amount":
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("failed to refund purchase: %w", err)
+	}
+
+	// Lock the report again; the background worker retries if MongoDB is unavailable
+	purchase, err = s.saga.Advance(purchase)
+	if err != nil {
+		log.Printf("Failed to lock report for refunded purchase %d: %v", purchaseID, err)
+	}
+
+	return purchase, refund, nil
+}
+
+// HandleChargeback flags the account and, when the chargeback took the
+// wallet in currency below zero, refunds the user's newest purchases paid
+// from that wallet until it is covered. The refunds lock the reports that
+// were paid with the disputed money.
+func (s *RefundService) HandleChargeback(userID int, currency money.Currency, reason string) error {
+	if err := s.userRepo.FlagUser(userID, "chargeback: "+reason); err != nil {
+		return fmt.Errorf("failed to flag user: %w", err)
+	}
+
+	balance, err := s.userRepo.GetWalletBalance(userID, currency)
+	if err != nil {
+		return fmt.Errorf("failed to get balance: %w", err)
+	}
+
+	deficit := balance.Neg()
+	if !deficit.IsPositive() {
+		return nil
+	}
+
+	purchases, err := s.purchaseRepo.GetRefundablePurchases(userID, currency)
+	if err != nil {
+		return fmt.Errorf("failed to get refundable purchases: %w", err)
+	}
+
+	for _, p := range purchases {
+		if !deficit.IsPositive() {
+			break
+		}
+
+		if _, _, err := s.RefundPurchase(p.ID, 0, "chargeback: "+reason, models.RefundSourceChargeback); err != nil {
+			return fmt.Errorf("failed to refund purchase %d: %w", p.ID, err)
+		}
+		deficit = deficit.Sub(p.Amount.Sub(p.RefundedAmount))
+	}
+
+	return nil
+}
@@ -1,68 +1,184 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
 	"zl0y-billing/internal/repository"
 )
 
-const ReportCost = 500 // 5.00 in cents
-
 type ReportService struct {
-	reportRepo *repository.ReportRepository
-	userRepo   *repository.UserRepository
+	reportRepo   *repository.ReportRepository
+	userRepo     *repository.UserRepository
+	purchaseRepo *repository.PurchaseRepository
+	saga         *PurchaseSaga
+	catalog      *CatalogService
+	promos       *PromoService
+	rates        *money.Rates
+
+	// Purchases need a verified email when set
+	requireVerifiedEmail bool
 }
 
-func NewReportService(reportRepo *repository.ReportRepository, userRepo *repository.UserRepository) *ReportService {
+func NewReportService(reportRepo *repository.ReportRepository, userRepo *repository.UserRepository, purchaseRepo *repository.PurchaseRepository, saga *PurchaseSaga, catalog *CatalogService, promos *PromoService, rates *money.Rates, requireVerifiedEmail bool) *ReportService {
 	return &ReportService{
-		reportRepo: reportRepo,
-		userRepo:   userRepo,
+		reportRepo:   reportRepo,
+		userRepo:     userRepo,
+		purchaseRepo: purchaseRepo,
+		saga:         saga,
+		catalog:      catalog,
+		promos:       promos,
+		rates:        rates,
+
+		requireVerifiedEmail: requireVerifiedEmail,
 	}
 }
 
-func (s *ReportService) PurchaseReport(userID int, reportID string) error {
+// PurchaseReport starts a purchase saga and drives it inline. A purchase that
+// is returned still charged will be finished by the background worker.
+// Reports are taken from the subscription allowance while it lasts, then paid
+// from the wallet in currency, the product's own currency if empty. promoCode
+// is optional and only applies to paid purchases; the applied discount is on
+// the returned purchase.
+func (s *ReportService) PurchaseReport(userID int, reportID, currency, promoCode string) (*models.Purchase, error) {
 	// Get the report
 	report, err := s.reportRepo.GetReportByID(reportID)
 	if err != nil {
-		return fmt.Errorf("report not found")
+		return nil, fmt.Errorf("report not found")
 	}
 
 	// Check if report belongs to user
 	if report.UserID == nil || *report.UserID != userID {
-		return fmt.Errorf("report not found")
+		return nil, fmt.Errorf("report not found")
+	}
+
+	// Reports still being generated have nothing to sell yet
+	if !report.IsReady() {
+		return nil, fmt.Errorf("report not ready")
 	}
 
 	// Check if already purchased
 	if report.IsPurchased {
-		return fmt.Errorf("report already purchased")
+		return nil, fmt.Errorf("report already purchased")
+	}
+
+	// The price is whatever the catalogue says right now
+	product, err := s.catalog.ProductForReport(report)
+	if err != nil {
+		if err.Error() == "product not found" || err.Error() == "product unavailable" {
+			return nil, fmt.Errorf("product unavailable")
+		}
+		return nil, fmt.Errorf("failed to get price: %w", err)
+	}
+
+	// Prices in another currency are converted at the configured rates,
+	// rounding half up since the user pays
+	price := product.Price
+	if currency != "" {
+		walletCurrency, err := money.ParseCurrency(currency)
+		if err != nil {
+			return nil, err
+		}
+
+		price, err = s.rates.Convert(product.Price, walletCurrency, money.RoundHalfUp)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported currency")
+		}
 	}
 
 	// Get user to check balance
 	user, err := s.userRepo.GetUserByID(userID)
 	if err != nil {
-		return fmt.Errorf("user not found")
+		return nil, fmt.Errorf("user not found")
+	}
+
+	// Flagged accounts can't spend until support has a look
+	if user.FlaggedAt != nil {
+		return nil, fmt.Errorf("account flagged")
+	}
+
+	if s.requireVerifiedEmail && user.EmailVerifiedAt == nil {
+		return nil, fmt.Errorf("email not verified")
+	}
+
+	// Reports from the subscription allowance come first; the unique index
+	// on live purchases rejects a concurrent second purchase
+	purchase, err := s.purchaseRepo.CreateSubscriptionPurchase(userID, reportID, product.Code, price.Currency, purchaseLease)
+	if err != nil {
+		switch err.Error() {
+		case "report already purchased":
+			return nil, err
+		case "no allowance left":
+			purchase, err = s.createPaidPurchase(user, reportID, product, price, promoCode)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("failed to create purchase: %w", err)
+		}
+	}
+
+	// 1. Charge the balance, 2. unlock the report in MongoDB
+	purchase, err = s.saga.Advance(purchase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to process purchase: %w", err)
+	}
+
+	switch purchase.State {
+	case models.PurchaseStateFailed:
+		return nil, errors.New(purchase.LastError)
+	case models.PurchaseStateCompensated:
+		return nil, fmt.Errorf("purchase compensated")
+	}
+
+	return purchase, nil
+}
+
+// createPaidPurchase persists a purchase of product at price, paid from the
+// wallet in price's currency, less the promo discount.
+func (s *ReportService) createPaidPurchase(user *models.User, reportID string, product *models.Product, price money.Money, promoCode string) (*models.Purchase, error) {
+	amount := price
+	if promoCode != "" {
+		discount, err := s.promos.Quote(promoCode, user.ID, models.PromoTargetPurchase, price)
+		if err != nil {
+			return nil, err
+		}
+		amount = amount.Sub(discount)
 	}
 
 	// Check if user has sufficient balance
-	if user.Balance < ReportCost {
-		return fmt.Errorf("insufficient balance")
+	balance, err := s.userRepo.GetWalletBalance(user.ID, price.Currency)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance: %w", err)
+	}
+	if balance.LessThan(amount) {
+		return nil, fmt.Errorf("insufficient balance")
+	}
+
+	// Persist the purchase before touching either database
+	purchase, err := s.purchaseRepo.CreatePurchase(user.ID, reportID, product.Code, price, promoCode, purchaseLease)
+	if err != nil {
+		if err.Error() == "report already purchased" || isPromoError(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to create purchase: %w", err)
 	}
 
-	// Simulate transaction by performing both operations
-	// In a real scenario, this would be wrapped in a distributed transaction
-	// or use a saga pattern for cross-database consistency
+	return purchase, nil
+}
 
-	// 1. Deduct balance from user
-	if err := s.userRepo.DeductBalance(userID, ReportCost); err != nil {
-		return fmt.Errorf("failed to deduct balance: %w", err)
+func (s *ReportService) GetPurchase(userID, purchaseID int) (*models.Purchase, error) {
+	purchase, err := s.purchaseRepo.GetPurchaseByID(purchaseID)
+	if err != nil {
+		return nil, err
 	}
 
-	// 2. Mark report as purchased
-	if err := s.reportRepo.MarkReportAsPurchased(reportID); err != nil {
-		// In a real scenario, you would need to compensate by adding balance back
-		// or implement proper distributed transaction handling
-		return fmt.Errorf("failed to mark report as purchased: %w", err)
+	// Hide other users' purchases
+	if purchase.UserID != userID {
+		return nil, fmt.Errorf("purchase not found")
 	}
 
-	return nil
+	return purchase, nil
 }
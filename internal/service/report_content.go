@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	"zl0y-billing/internal/blob"
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+const (
+	// MaxReportSize caps stored report payloads
+	MaxReportSize = 20 << 20
+	// MaxPreviewLength caps the free preview, in bytes
+	MaxPreviewLength = 4 << 10
+)
+
+// ReportContentService stores report payloads and delivers them. The free
+// preview is always shown; the payload is downloaded through short-lived
+// signed links handed out to the owner of a purchased report.
+type ReportContentService struct {
+	reportRepo    *repository.ReportRepository
+	store         blob.Store
+	secret        []byte
+	downloadTTL   time.Duration
+	publicBaseURL string
+}
+
+func NewReportContentService(reportRepo *repository.ReportRepository, store blob.Store, secret string, downloadTTL time.Duration, publicBaseURL string) *ReportContentService {
+	return &ReportContentService{
+		reportRepo:    reportRepo,
+		store:         store,
+		secret:        []byte(secret),
+		downloadTTL:   downloadTTL,
+		publicBaseURL: publicBaseURL,
+	}
+}
+
+// GetReport returns the user's report with its preview, and the fingerprint
+// analysis and a download link if it is purchased.
+func (s *ReportContentService) GetReport(userID int, reportID string) (*models.ReportResponse, error) {
+	report, err := s.ownedReport(userID, reportID)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &models.ReportResponse{Report: *report}
+	if report.IsPurchased {
+		response.Fingerprint = report.Fingerprint
+	}
+	if report.Content == nil {
+		return response, nil
+	}
+	response.Preview = report.Content.Preview
+
+	if report.IsPurchased {
+		expiresAt := time.Now().Add(s.downloadTTL).Truncate(time.Second)
+		params := url.Values{}
+		params.Set("uid", strconv.Itoa(userID))
+		params.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+		params.Set("signature", s.sign(reportID, userID, expiresAt.Unix()))
+
+		response.DownloadURL = s.publicBaseURL + "/api/reports/" + url.PathEscape(reportID) + "/download?" + params.Encode()
+		response.DownloadExpiresAt = &expiresAt
+	}
+
+	return response, nil
+}
+
+// OpenDownload checks a signed download link and opens the payload. The
+// report must still be the user's and purchased, so refunds lock it at once.
+func (s *ReportContentService) OpenDownload(ctx context.Context, reportID, uid, expires, signature string) (*models.Report, io.ReadCloser, error) {
+	userID, err := strconv.Atoi(uid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid download link")
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid download link")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(s.sign(reportID, userID, expiresAt))) {
+		return nil, nil, fmt.Errorf("invalid download link")
+	}
+	if time.Now().Unix() >= expiresAt {
+		return nil, nil, fmt.Errorf("download link expired")
+	}
+
+	report, err := s.ownedReport(userID, reportID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !report.IsPurchased {
+		return nil, nil, fmt.Errorf("report not purchased")
+	}
+	if report.Content == nil {
+		return nil, nil, fmt.Errorf("report content not ready")
+	}
+
+	r, err := s.store.Get(ctx, reportBlobKey(reportID))
+	if err != nil {
+		if errors.Is(err, blob.ErrNotFound) {
+			return nil, nil, fmt.Errorf("report content not ready")
+		}
+		return nil, nil, err
+	}
+
+	return report, r, nil
+}
+
+// StoreContent stores the report's payload and preview, replacing earlier ones.
+func (s *ReportContentService) StoreContent(ctx context.Context, reportID, contentType string, content io.Reader, preview string) (*models.ReportContent, error) {
+	if _, err := s.reportRepo.GetReportByID(reportID); err != nil {
+		return nil, err
+	}
+	if len(preview) > MaxPreviewLength {
+		return nil, fmt.Errorf("preview too long")
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	counter := &countingHash{hash: sha256.New()}
+	limited := io.LimitReader(io.TeeReader(content, counter), MaxReportSize+1)
+	if err := s.store.Put(ctx, reportBlobKey(reportID), &maxSizeReader{r: limited, counter: counter}); err != nil {
+		// Stores may not wrap the reader's error
+		if errors.Is(err, errReportTooLarge) || counter.n > MaxReportSize {
+			return nil, fmt.Errorf("report too large")
+		}
+		return nil, err
+	}
+
+	stored := models.ReportContent{
+		ContentType: contentType,
+		Size:        counter.n,
+		SHA256:      hex.EncodeToString(counter.hash.Sum(nil)),
+		Preview:     preview,
+		StoredAt:    time.Now(),
+	}
+	if err := s.reportRepo.SetReportContent(reportID, stored); err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+func (s *ReportContentService) ownedReport(userID int, reportID string) (*models.Report, error) {
+	report, err := s.reportRepo.GetReportByID(reportID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Other users' reports don't exist as far as this user can tell
+	if report.UserID == nil || *report.UserID != userID {
+		return nil, fmt.Errorf("report not found")
+	}
+
+	return report, nil
+}
+
+// sign computes a download link signature; the prefix keeps it from being
+// valid for anything else signed with the same secret.
+func (s *ReportContentService) sign(reportID string, userID int, expiresAt int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "report-download:%s:%d:%d", reportID, userID, expiresAt)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func reportBlobKey(reportID string) string {
+	return "reports/" + reportID
+}
+
+var errReportTooLarge = errors.New("report too large")
+
+// countingHash hashes and counts what is written to it.
+type countingHash struct {
+	hash hash.Hash
+	n    int64
+}
+
+func (c *countingHash) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return c.hash.Write(p)
+}
+
+// maxSizeReader fails the upload once more than MaxReportSize was read,
+// before the store commits it.
+type maxSizeReader struct {
+	r       io.Reader
+	counter *countingHash
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if m.counter.n > MaxReportSize {
+		return n, errReportTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"zl0y-billing/internal/models"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// reportCursorToken is what a report list cursor carries. Clients only see
+// it as an opaque string.
+type reportCursorToken struct {
+	CreatedAt int64  `json:"t"` // Unix milliseconds, Mongo's time precision
+	ID        string `json:"id"`
+	Direction string `json:"d"`
+	Sort      string `json:"s"`
+}
+
+const (
+	cursorDirectionNext = "next"
+	cursorDirectionPrev = "prev"
+)
+
+// cursorSort reports whether the list order can be paged with cursors.
+func cursorSort(sort string) bool {
+	return sort == models.ReportSortNewest || sort == models.ReportSortOldest
+}
+
+// encodeReportCursor makes a cursor for the page after the report, or before
+// it when backward is set.
+func encodeReportCursor(report models.Report, sort string, backward bool) string {
+	token := reportCursorToken{
+		CreatedAt: report.CreatedAt.UnixMilli(),
+		ID:        report.ID.Hex(),
+		Direction: cursorDirectionNext,
+		Sort:      sort,
+	}
+	if backward {
+		token.Direction = cursorDirectionPrev
+	}
+
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeReportCursor reads a cursor made for the given sort order.
+func decodeReportCursor(cursor, sort string) (models.ReportCursor, error) {
+	invalid := fmt.Errorf("invalid cursor")
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.ReportCursor{}, invalid
+	}
+
+	var token reportCursorToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return models.ReportCursor{}, invalid
+	}
+
+	// A cursor is a position in one particular order
+	if token.Sort != sort || !cursorSort(sort) {
+		return models.ReportCursor{}, invalid
+	}
+
+	id, err := bson.ObjectIDFromHex(token.ID)
+	if err != nil {
+		return models.ReportCursor{}, invalid
+	}
+
+	switch token.Direction {
+	case cursorDirectionNext, cursorDirectionPrev:
+	default:
+		return models.ReportCursor{}, invalid
+	}
+
+	return models.ReportCursor{
+		CreatedAt: time.UnixMilli(token.CreatedAt).UTC(),
+		ID:        id,
+		Backward:  token.Direction == cursorDirectionPrev,
+	}, nil
+}
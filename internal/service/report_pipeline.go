@@ -0,0 +1,342 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"zl0y-billing/internal/fingerprint"
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+// MaxReportInputSize caps the analysis input of a submitted report.
+const MaxReportInputSize = 64 << 10
+
+// ReportPipeline generates reports: submitted reports are queued as jobs in
+// Postgres, and workers move them through
+// queued -> processing -> ready, or failed once retries run out. The report
+// in MongoDB mirrors the job's status.
+type ReportPipeline struct {
+	jobRepo      *repository.ReportJobRepository
+	reportRepo   *repository.ReportRepository
+	catalog      *CatalogService
+	content      *ReportContentService
+	fingerprints *FingerprintService
+	analyzer     Analyzer
+	workers      int           // jobs processed at once
+	lease        time.Duration // how long a worker holds a job before it must extend the lease
+	maxAttempts  int
+	retryDelay   time.Duration
+}
+
+func NewReportPipeline(jobRepo *repository.ReportJobRepository, reportRepo *repository.ReportRepository, catalog *CatalogService, content *ReportContentService, fingerprints *FingerprintService, analyzer Analyzer, workers int, lease time.Duration, maxAttempts int, retryDelay time.Duration) *ReportPipeline {
+	return &ReportPipeline{
+		jobRepo:      jobRepo,
+		reportRepo:   reportRepo,
+		catalog:      catalog,
+		content:      content,
+		fingerprints: fingerprints,
+		analyzer:     analyzer,
+		workers:      max(workers, 1),
+		lease:        lease,
+		maxAttempts:  maxAttempts,
+		retryDelay:   retryDelay,
+	}
+}
+
+// Submit creates a queued report of the user and its generation job.
+func (s *ReportPipeline) Submit(userID int, req models.SubmitReportRequest) (*models.ReportJob, error) {
+	if len(req.Input) > MaxReportInputSize {
+		return nil, fmt.Errorf("input too large")
+	}
+
+	if err := s.catalog.ValidateProductCode(req.ProductCode); err != nil {
+		if err.Error() == "product not found" || err.Error() == "product unavailable" {
+			return nil, fmt.Errorf("product unavailable")
+		}
+		return nil, fmt.Errorf("failed to validate product: %w", err)
+	}
+
+	productCode := req.ProductCode
+	if productCode == "" {
+		productCode = DefaultProductCode
+	}
+
+	report, err := s.reportRepo.CreateQueuedReport(userID, req.ClientGeneratedID, productCode, req.Title, req.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	job, err := s.jobRepo.CreateReportJob(userID, report.ReportID, productCode, req.Input)
+	if err != nil {
+		// Don't leave a report behind that will never be generated
+		if err := s.reportRepo.DeleteReport(report.ReportID); err != nil {
+			log.Printf("Failed to delete unqueued report %s: %v", report.ReportID, err)
+		}
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// GetJob returns the generation job of the user's report.
+func (s *ReportPipeline) GetJob(userID int, reportID string) (*models.ReportJob, error) {
+	job, err := s.jobRepo.GetReportJob(reportID)
+	if err != nil {
+		if err.Error() == "report job not found" {
+			return nil, fmt.Errorf("report not found")
+		}
+		return nil, err
+	}
+
+	// Other users' reports don't exist as far as this user can tell
+	if job.UserID != userID {
+		return nil, fmt.Errorf("report not found")
+	}
+
+	return job, nil
+}
+
+// Watch polls the job of the user's report every interval and sends it
+// whenever its status or attempt changes, starting with its current state.
+// The channel is closed once the job is finished or ctx is cancelled.
+func (s *ReportPipeline) Watch(ctx context.Context, userID int, reportID string, interval time.Duration) (<-chan models.ReportJob, error) {
+	job, err := s.GetJob(userID, reportID)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(chan models.ReportJob, 1)
+	updates <- *job
+
+	go func() {
+		defer close(updates)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for !job.IsFinished() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			next, err := s.jobRepo.GetReportJob(reportID)
+			if err != nil {
+				log.Printf("Failed to poll report job %s: %v", reportID, err)
+				continue
+			}
+			if next.Status == job.Status && next.Attempts == job.Attempts {
+				continue
+			}
+			job = next
+
+			select {
+			case <-ctx.Done():
+				return
+			case updates <- *job:
+			}
+		}
+	}()
+
+	return updates, nil
+}
+
+// process runs one attempt of a leased job.
+func (s *ReportPipeline) process(ctx context.Context, job *models.ReportJob) {
+	// Workers that died while holding the job used up its attempts too
+	if job.Attempts > s.maxAttempts {
+		s.finish(job, fmt.Errorf("gave up after %d attempts", s.maxAttempts), true)
+		return
+	}
+
+	if err := s.reportRepo.SetReportStatus(job.ReportID, models.ReportStatusProcessing, ""); err != nil {
+		log.Printf("Failed to mark report %s as processing: %v", job.ReportID, err)
+	}
+
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.keepLease(attemptCtx, cancel, job)
+
+	err := s.generate(attemptCtx, job)
+	switch {
+	case err == nil:
+		// Completing the job checks the lease, so only its holder marks the report ready
+		if err := s.jobRepo.CompleteJob(job.ID, job.LeaseToken); err != nil {
+			log.Printf("Failed to complete report job %d: %v", job.ID, err)
+			return
+		}
+		if err := s.reportRepo.SetReportStatus(job.ReportID, models.ReportStatusReady, ""); err != nil {
+			log.Printf("Failed to mark report %s as ready: %v", job.ReportID, err)
+		}
+	case ctx.Err() != nil:
+		// Shutting down: hand the job to the next worker right away
+		s.requeue(job, "interrupted", 0)
+	case attemptCtx.Err() != nil, err.Error() == "lease lost":
+		// Whoever holds the lease now finishes the job
+		log.Printf("Report job %d lost its lease, dropping the attempt", job.ID)
+	default:
+		s.finish(job, err, errors.Is(err, ErrAnalysisRejected) || isPermanentContentError(err))
+	}
+}
+
+// generate runs the analyzer and stores the report it produced. The lease is
+// extended right before each write to the report, so another worker can't
+// take the job over while the write runs; if it already has, generate fails
+// with "lease lost" without writing.
+func (s *ReportPipeline) generate(ctx context.Context, job *models.ReportJob) error {
+	result, err := s.analyzer.Analyze(ctx, AnalysisRequest{
+		ReportID:    job.ReportID,
+		ProductCode: job.ProductCode,
+		Input:       job.Input,
+		Attempt:     job.Attempts,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A result the schema rejects is a bug in the analyzer, retrying won't help
+	if len(result.Fingerprint) > 0 {
+		if err := s.jobRepo.ExtendLease(job.ID, job.LeaseToken, s.lease); err != nil {
+			return err
+		}
+		if _, err := s.fingerprints.Ingest(job.ReportID, result.Fingerprint); err != nil {
+			var invalid *fingerprint.ValidationError
+			if errors.As(err, &invalid) || err.Error() == "fingerprint too large" {
+				return fmt.Errorf("%w: %s", ErrAnalysisRejected, describeFingerprintError(err))
+			}
+			return err
+		}
+	}
+
+	if err := s.jobRepo.ExtendLease(job.ID, job.LeaseToken, s.lease); err != nil {
+		return err
+	}
+	_, err = s.content.StoreContent(ctx, job.ReportID, result.ContentType, bytes.NewReader(result.Content), result.Preview)
+	return err
+}
+
+// finish ends a failed attempt: the job is queued again with exponential
+// backoff, or failed if the error is permanent or no attempts are left.
+func (s *ReportPipeline) finish(job *models.ReportJob, cause error, permanent bool) {
+	if permanent || job.Attempts >= s.maxAttempts {
+		log.Printf("Report job %d failed after %d attempts: %v", job.ID, job.Attempts, cause)
+
+		if err := s.jobRepo.FailJob(job.ID, job.LeaseToken, cause.Error()); err != nil {
+			log.Printf("Failed to fail report job %d: %v", job.ID, err)
+			return
+		}
+		if err := s.reportRepo.SetReportStatus(job.ReportID, models.ReportStatusFailed, cause.Error()); err != nil {
+			log.Printf("Failed to mark report %s as failed: %v", job.ReportID, err)
+		}
+		return
+	}
+
+	// Exponential backoff: retryDelay, 2*retryDelay, 4*retryDelay, ...
+	s.requeue(job, cause.Error(), s.retryDelay*time.Duration(1<<min(job.Attempts-1, 20)))
+}
+
+// requeue gives up the job's lease and schedules the next attempt. The
+// report is marked queued while the lease is still held, before the next
+// worker can claim the job and mark it processing.
+func (s *ReportPipeline) requeue(job *models.ReportJob, reason string, retryIn time.Duration) {
+	if err := s.jobRepo.ExtendLease(job.ID, job.LeaseToken, s.lease); err != nil {
+		log.Printf("Failed to requeue report job %d: %v", job.ID, err)
+		return
+	}
+	if err := s.reportRepo.SetReportStatus(job.ReportID, models.ReportStatusQueued, ""); err != nil {
+		log.Printf("Failed to mark report %s as queued: %v", job.ReportID, err)
+	}
+	if err := s.jobRepo.RetryJob(job.ID, job.LeaseToken, reason, retryIn); err != nil {
+		log.Printf("Failed to retry report job %d: %v", job.ID, err)
+	}
+}
+
+// keepLease extends the job's lease until ctx is done, and calls lost once
+// another worker has taken the job over.
+func (s *ReportPipeline) keepLease(ctx context.Context, lost context.CancelFunc, job *models.ReportJob) {
+	ticker := time.NewTicker(s.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.jobRepo.ExtendLease(job.ID, job.LeaseToken, s.lease); err != nil {
+			if err.Error() == "lease lost" {
+				lost()
+				return
+			}
+			log.Printf("Failed to extend the lease of report job %d: %v", job.ID, err)
+		}
+	}
+}
+
+// isPermanentContentError tells whether storing the report failed in a way
+// that generating it again won't fix.
+func isPermanentContentError(err error) bool {
+	switch err.Error() {
+	case "report not found", "report too large", "preview too long":
+		return true
+	}
+	return false
+}
+
+// ProcessDue leases due jobs, at most workers at a time, and processes them
+// in parallel.
+func (s *ReportPipeline) ProcessDue(ctx context.Context) int {
+	processed := 0
+	for ctx.Err() == nil {
+		jobs, err := s.jobRepo.ClaimDueJobs(s.workers, s.lease)
+		if err != nil {
+			log.Printf("Failed to claim due report jobs: %v", err)
+			return processed
+		}
+
+		var wg sync.WaitGroup
+		for i := range jobs {
+			wg.Add(1)
+			go func(job *models.ReportJob) {
+				defer wg.Done()
+				s.process(ctx, job)
+			}(&jobs[i])
+		}
+		wg.Wait()
+		processed += len(jobs)
+
+		if len(jobs) < s.workers {
+			break
+		}
+	}
+
+	return processed
+}
+
+// Run processes due jobs immediately, which picks up whatever a previous run
+// left behind once the leases expire, and then every interval until ctx is
+// cancelled.
+func (s *ReportPipeline) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n := s.ProcessDue(ctx); n > 0 {
+			log.Printf("Processed %d report jobs", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"zl0y-billing/internal/repository"
+)
+
+// revocationSyncOverlap re-reads recent revocations on every sync, so rows
+// committed out of created_at order by other instances aren't missed.
+const revocationSyncOverlap = time.Minute
+
+type cachedTokenVersion struct {
+	version   int
+	fetchedAt time.Time
+}
+
+// RevocationService decides whether access tokens were revoked before they
+// expired. Revocations live in Postgres and are cached in memory: revocations
+// made by this instance apply at once, those made by other instances within
+// one sync interval. Until then a revoked token keeps working on the other
+// instances; a shorter interval narrows the window at the cost of more
+// Postgres queries.
+type RevocationService struct {
+	revocationRepo *repository.RevocationRepository
+	userRepo       *repository.UserRepository
+	sessionRepo    *repository.SessionRepository
+	apiKeyRepo     *repository.APIKeyRepository
+	accessTokenTTL time.Duration
+	syncInterval   time.Duration
+
+	mu          sync.RWMutex
+	revoked     map[string]time.Time // jti -> when the token expires anyway
+	versions    map[int]cachedTokenVersion
+	syncedUntil time.Time
+}
+
+func NewRevocationService(revocationRepo *repository.RevocationRepository, userRepo *repository.UserRepository, sessionRepo *repository.SessionRepository, apiKeyRepo *repository.APIKeyRepository, accessTokenTTL, syncInterval time.Duration) *RevocationService {
+	return &RevocationService{
+		revocationRepo: revocationRepo,
+		userRepo:       userRepo,
+		sessionRepo:    sessionRepo,
+		apiKeyRepo:     apiKeyRepo,
+		accessTokenTTL: accessTokenTTL,
+		syncInterval:   syncInterval,
+		revoked:        make(map[string]time.Time),
+		versions:       make(map[int]cachedTokenVersion),
+	}
+}
+
+// IsRevoked reports whether the token jti issued to userID at version was
+// revoked. Tokens without a jti can only be revoked through the version.
+func (s *RevocationService) IsRevoked(userID, version int, jti string) (bool, error) {
+	if jti != "" {
+		s.mu.RLock()
+		expiresAt, ok := s.revoked[jti]
+		s.mu.RUnlock()
+		if ok && time.Now().Before(expiresAt) {
+			return true, nil
+		}
+	}
+
+	current, err := s.tokenVersion(userID)
+	if err != nil {
+		// Tokens of deleted users are no good either
+		if err.Error() == "user not found" {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return version < current, nil
+}
+
+// RevokeToken revokes a single access token. Without its expiry at hand the
+// revocation is kept for the longest an access token can live.
+func (s *RevocationService) RevokeToken(jti string, userID *int, reason string) error {
+	if jti == "" {
+		return fmt.Errorf("invalid token id")
+	}
+
+	expiresAt := time.Now().Add(s.accessTokenTTL)
+	if err := s.revocationRepo.RevokeToken(jti, userID, reason, expiresAt); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.revoked[jti] = expiresAt
+	s.mu.Unlock()
+
+	return nil
+}
+
+// RevokeUserTokens logs the user out everywhere: every access token issued
+// so far stops working and every session is revoked, so they can't be
+// refreshed either. The user's API keys are revoked too, or a leaked key
+// would outlive the response. Used for password changes, bans and
+// compromised accounts.
+func (s *RevocationService) RevokeUserTokens(userID int, reason string) error {
+	version, err := s.userRepo.IncrementTokenVersion(userID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.versions[userID] = cachedTokenVersion{version: version, fetchedAt: time.Now()}
+	s.mu.Unlock()
+
+	if _, err := s.sessionRepo.RevokeUserSessions(userID, reason); err != nil {
+		return err
+	}
+
+	keys, err := s.apiKeyRepo.RevokeUserAPIKeys(userID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Revoked all tokens and %d API keys of user %d: %s", keys, userID, reason)
+	return nil
+}
+
+func (s *RevocationService) tokenVersion(userID int) (int, error) {
+	s.mu.RLock()
+	cached, ok := s.versions[userID]
+	s.mu.RUnlock()
+	if ok && time.Since(cached.fetchedAt) < s.syncInterval {
+		return cached.version, nil
+	}
+
+	version, err := s.userRepo.GetTokenVersion(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	s.versions[userID] = cachedTokenVersion{version: version, fetchedAt: time.Now()}
+	s.mu.Unlock()
+
+	return version, nil
+}
+
+// Sync loads revocations made since the last sync, including other
+// instances', and forgets what has expired.
+func (s *RevocationService) Sync() error {
+	s.mu.RLock()
+	since := s.syncedUntil.Add(-revocationSyncOverlap)
+	s.mu.RUnlock()
+
+	tokens, err := s.revocationRepo.GetRevokedTokensSince(since)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range tokens {
+		s.revoked[t.JTI] = t.ExpiresAt
+		if t.CreatedAt.After(s.syncedUntil) {
+			s.syncedUntil = t.CreatedAt
+		}
+	}
+
+	for jti, expiresAt := range s.revoked {
+		if !now.Before(expiresAt) {
+			delete(s.revoked, jti)
+		}
+	}
+	for userID, cached := range s.versions {
+		if now.Sub(cached.fetchedAt) >= s.syncInterval {
+			delete(s.versions, userID)
+		}
+	}
+
+	return nil
+}
+
+// Run syncs revocations until ctx is cancelled and hourly removes the expired ones from Postgres.
+func (s *RevocationService) Run(ctx context.Context) {
+	if err := s.Sync(); err != nil {
+		log.Printf("Failed to sync token revocations: %v", err)
+	}
+
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Sync(); err != nil {
+				log.Printf("Failed to sync token revocations: %v", err)
+			}
+		case <-cleanup.C:
+			if _, err := s.revocationRepo.DeleteExpired(); err != nil {
+				log.Printf("Failed to expire token revocations: %v", err)
+			}
+		}
+	}
+}
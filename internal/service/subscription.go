@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+)
+
+const subscriptionBatchSize = 50
+
+type SubscriptionService struct {
+	subscriptionRepo *repository.SubscriptionRepository
+	userRepo         *repository.UserRepository
+	gracePeriod      time.Duration
+}
+
+func NewSubscriptionService(subscriptionRepo *repository.SubscriptionRepository, userRepo *repository.UserRepository, gracePeriod time.Duration) *SubscriptionService {
+	return &SubscriptionService{
+		subscriptionRepo: subscriptionRepo,
+		userRepo:         userRepo,
+		gracePeriod:      gracePeriod,
+	}
+}
+
+func (s *SubscriptionService) ListPlans() ([]models.Plan, error) {
+	return s.subscriptionRepo.ListPlans()
+}
+
+func (s *SubscriptionService) GetSubscription(userID int) (*models.Subscription, error) {
+	return s.subscriptionRepo.GetLiveSubscription(userID)
+}
+
+// Subscribe charges the first month of the plan from the balance.
+func (s *SubscriptionService) Subscribe(userID int, planCode string) (*models.Subscription, error) {
+	if err := s.checkUser(userID); err != nil {
+		return nil, err
+	}
+
+	subscription, err := s.subscriptionRepo.CreateSubscription(userID, planCode)
+	if err != nil {
+		switch err.Error() {
+		case "plan not found", "subscription already exists", "insufficient balance":
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	return subscription, nil
+}
+
+// ChangePlan moves the subscription to another plan with prorated billing.
+func (s *SubscriptionService) ChangePlan(userID int, planCode string) (*models.Subscription, error) {
+	if err := s.checkUser(userID); err != nil {
+		return nil, err
+	}
+
+	subscription, err := s.subscriptionRepo.ChangePlan(userID, planCode)
+	if err != nil {
+		switch err.Error() {
+		case "plan not found", "subscription not found", "subscription is past due", "already on this plan", "insufficient balance",
+			"reports used exceed plan allowance":
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to change plan: %w", err)
+	}
+
+	return subscription, nil
+}
+
+// Cancel stops renewal; the allowance stays usable until the period ends.
+func (s *SubscriptionService) Cancel(userID int) (*models.Subscription, error) {
+	return s.subscriptionRepo.SetCancelAtPeriodEnd(userID, true)
+}
+
+func (s *SubscriptionService) checkUser(userID int) error {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return fmt.Errorf("user not found")
+	}
+
+	// Flagged accounts can't spend until support has a look
+	if user.FlaggedAt != nil {
+		return fmt.Errorf("account flagged")
+	}
+
+	return nil
+}
+
+// ProcessDue renews or expires every subscription whose period has ended.
+func (s *SubscriptionService) ProcessDue() int {
+	processed := 0
+	lastID := 0
+	for {
+		ids, err := s.subscriptionRepo.GetDueSubscriptionIDs(lastID, subscriptionBatchSize)
+		if err != nil {
+			log.Printf("Failed to get due subscriptions: %v", err)
+			return processed
+		}
+
+		for _, id := range ids {
+			subscription, err := s.subscriptionRepo.RenewSubscription(id, s.gracePeriod)
+			if err != nil {
+				log.Printf("Failed to renew subscription %d: %v", id, err)
+				continue
+			}
+			if subscription.Status == models.SubscriptionStatusExpired {
+				log.Printf("Subscription %d is %s: %s", id, subscription.Status, subscription.LastError)
+			}
+		}
+		processed += len(ids)
+
+		if len(ids) < subscriptionBatchSize {
+			return processed
+		}
+		lastID = ids[len(ids)-1]
+	}
+}
+
+// Run processes due subscriptions immediately and then every interval until
+// ctx is cancelled.
+func (s *SubscriptionService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n := s.ProcessDue(); n > 0 {
+			log.Printf("Processed %d due subscriptions", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
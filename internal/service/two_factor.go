@@ -0,0 +1,267 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/repository"
+	"zl0y-billing/internal/totp"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes the user gets at a time
+	recoveryCodeCount = 10
+	// maxChallengeAttempts is how many codes may be tried per login challenge
+	maxChallengeAttempts = 5
+)
+
+// TwoFactorService manages optional TOTP two-factor authentication. Login
+// with 2FA on is completed through AuthService.CompleteLogin.
+type TwoFactorService struct {
+	twoFactorRepo *repository.TwoFactorRepository
+	userRepo      *repository.UserRepository
+	issuer        string
+	challengeTTL  time.Duration
+}
+
+func NewTwoFactorService(twoFactorRepo *repository.TwoFactorRepository, userRepo *repository.UserRepository, issuer string, challengeTTL time.Duration) *TwoFactorService {
+	return &TwoFactorService{
+		twoFactorRepo: twoFactorRepo,
+		userRepo:      userRepo,
+		issuer:        issuer,
+		challengeTTL:  challengeTTL,
+	}
+}
+
+// Enroll generates a TOTP secret for the user to add to an authenticator
+// app. 2FA stays off until a code is confirmed; enrolling again replaces the secret.
+func (s *TwoFactorService) Enroll(userID int) (*models.TwoFactorEnrollResponse, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabledAt != nil {
+		return nil, fmt.Errorf("2fa already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+
+	if err := s.twoFactorRepo.SetPendingSecret(userID, secret); err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: totp.URI(s.issuer, user.Login, secret),
+	}, nil
+}
+
+// Confirm turns 2FA on once the user proves their app generates valid
+// codes, and returns the recovery codes. They are shown only this once.
+func (s *TwoFactorService) Confirm(userID int, code string) (*models.RecoveryCodesResponse, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabledAt != nil {
+		return nil, fmt.Errorf("2fa already enabled")
+	}
+	if user.TOTPSecret == nil {
+		return nil, fmt.Errorf("2fa not enrolled")
+	}
+
+	step, ok := totp.Validate(*user.TOTPSecret, normalizeCode(code), time.Now())
+	if !ok {
+		return nil, fmt.Errorf("invalid code")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+	}
+
+	if err := s.twoFactorRepo.Enable(userID, step, hashes); err != nil {
+		return nil, err
+	}
+
+	return &models.RecoveryCodesResponse{
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// Disable turns 2FA off. It takes both the password and a code, so neither
+// a stolen session nor a stolen phone is enough.
+func (s *TwoFactorService) Disable(userID int, password, code string) error {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabledAt == nil {
+		return fmt.Errorf("2fa not enabled")
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return fmt.Errorf("invalid password")
+	}
+
+	ok, err := s.Verify(user, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("invalid code")
+	}
+
+	return s.twoFactorRepo.Disable(userID)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes, e.g. when they run
+// out. It takes a code from the app; recovery codes don't count.
+func (s *TwoFactorService) RegenerateRecoveryCodes(userID int, code string) (*models.RecoveryCodesResponse, error) {
+	user, err := s.userRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabledAt == nil {
+		return nil, fmt.Errorf("2fa not enabled")
+	}
+
+	ok, err := s.verifyTOTP(user, normalizeCode(code))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid code")
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate recovery codes: %w", err)
+	}
+
+	if err := s.twoFactorRepo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return &models.RecoveryCodesResponse{
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// StartChallenge holds a login that passed the password check until the
+// second factor is provided, returning the token that identifies it. login
+// is the login as entered, for throttling wrong codes.
+func (s *TwoFactorService) StartChallenge(userID int, login, userAgent, ip string) (*models.LoginChallengeResponse, error) {
+	token, err := generateRefreshToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate challenge token: %w", err)
+	}
+
+	if err := s.twoFactorRepo.CreateChallenge(userID, hashToken(token), login, userAgent, ip, s.challengeTTL); err != nil {
+		return nil, err
+	}
+
+	return &models.LoginChallengeResponse{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresIn:         int(s.challengeTTL.Seconds()),
+	}, nil
+}
+
+// GetChallenge returns the login challenge of token if it can still be completed.
+func (s *TwoFactorService) GetChallenge(token string) (*models.LoginChallenge, error) {
+	return s.twoFactorRepo.GetChallenge(hashToken(token), maxChallengeAttempts)
+}
+
+// CompleteChallenge checks the code for the challenge and uses it up. After
+// maxChallengeAttempts wrong codes the user has to log in again.
+func (s *TwoFactorService) CompleteChallenge(token, code string) (*models.LoginChallenge, error) {
+	challenge, err := s.twoFactorRepo.AttemptChallenge(hashToken(token), maxChallengeAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetUserByID(challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabledAt == nil {
+		// 2FA was turned off meanwhile; the user logs in again without it
+		return nil, fmt.Errorf("invalid challenge token")
+	}
+
+	ok, err := s.Verify(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid code")
+	}
+
+	if err := s.twoFactorRepo.CompleteChallenge(challenge.ID); err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// Verify checks a TOTP code or a recovery code of a user with 2FA on. Either
+// works once: TOTP codes can't be replayed and recovery codes are used up.
+func (s *TwoFactorService) Verify(user *models.User, code string) (bool, error) {
+	code = normalizeCode(code)
+	if len(code) == totp.Digits {
+		return s.verifyTOTP(user, code)
+	}
+
+	return s.twoFactorRepo.UseRecoveryCode(user.ID, hashToken(code))
+}
+
+func (s *TwoFactorService) verifyTOTP(user *models.User, code string) (bool, error) {
+	if user.TOTPSecret == nil {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(*user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return s.twoFactorRepo.UseStep(user.ID, step)
+}
+
+// generateRecoveryCodes returns codes formatted for the user, e.g.
+// "k3j5d-q8w2z", and their hashes for storage.
+func generateRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(buf))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeCode strips what users type around codes: spaces and dashes.
+func normalizeCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ReplaceAll(code, "-", "")
+}
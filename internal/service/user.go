@@ -2,6 +2,8 @@ package service
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
 	"zl0y-billing/internal/models"
 	"zl0y-billing/internal/repository"
@@ -10,12 +12,14 @@ import (
 type UserService struct {
 	userRepo   *repository.UserRepository
 	reportRepo *repository.ReportRepository
+	ledgerRepo *repository.LedgerRepository
 }
 
-func NewUserService(userRepo *repository.UserRepository, reportRepo *repository.ReportRepository) *UserService {
+func NewUserService(userRepo *repository.UserRepository, reportRepo *repository.ReportRepository, ledgerRepo *repository.LedgerRepository) *UserService {
 	return &UserService{
 		userRepo:   userRepo,
 		reportRepo: reportRepo,
+		ledgerRepo: ledgerRepo,
 	}
 }
 
@@ -35,7 +39,35 @@ func (s *UserService) LinkAnonymousReport(clientGeneratedID string, userID int)
 	return count, nil
 }
 
-func (s *UserService) GetUserReports(userID, limit, offset int) (*models.ReportsResponse, error) {
+// GetWallets lists the user's balance in every currency they have used.
+func (s *UserService) GetWallets(userID int) (*models.WalletsResponse, error) {
+	wallets, err := s.userRepo.GetWallets(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wallets: %w", err)
+	}
+
+	return &models.WalletsResponse{
+		Wallets: wallets,
+	}, nil
+}
+
+// GetUserReports returns a page of the user's reports matching filter.
+// Pages of the creation time orders link to their neighbours with cursors,
+// which the client passes back along with the same filter and sort.
+func (s *UserService) GetUserReports(userID int, filter models.ReportFilter, page models.ReportPage) (*models.ReportsResponse, error) {
+	if err := normalizeReportFilter(&filter); err != nil {
+		return nil, err
+	}
+
+	var after *models.ReportCursor
+	if page.Cursor != "" {
+		cursor, err := decodeReportCursor(page.Cursor, filter.Sort)
+		if err != nil {
+			return nil, err
+		}
+		after = &cursor
+	}
+
 	// Verify if the user exists
 	_, err := s.userRepo.GetUserByID(userID)
 	if err != nil {
@@ -43,24 +75,139 @@ func (s *UserService) GetUserReports(userID, limit, offset int) (*models.Reports
 	}
 
 	// Set default pagination values
+	limit := page.Limit
 	if limit <= 0 || limit > 100 {
 		limit = 20 // Default limit
 	}
 
-	if offset < 0 {
+	offset := page.Offset
+	if offset < 0 || after != nil {
 		offset = 0 // Default offset
 	}
 
-	// Get user reports
-	reports, total, err := s.reportRepo.GetReportsByUserID(userID, limit, offset)
+	// One extra report tells whether there is another page
+	var reports []models.Report
+	if after != nil {
+		reports, err = s.reportRepo.GetReportsByUserIDAfter(userID, filter, *after, limit+1)
+	} else {
+		reports, err = s.reportRepo.GetReportsByUserID(userID, filter, limit+1, offset)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user reports: %w", err)
 	}
 
-	return &models.ReportsResponse{
+	more := len(reports) > limit
+	if more {
+		reports = reports[:limit]
+	}
+
+	response := &models.ReportsResponse{
 		Reports: reports,
-		Total:   total,
 		Limit:   limit,
 		Offset:  offset,
+	}
+
+	backward := after != nil && after.Backward
+	if backward {
+		slices.Reverse(reports)
+	}
+
+	if cursorSort(filter.Sort) && len(reports) > 0 {
+		first, last := reports[0], reports[len(reports)-1]
+
+		// Going backward, the page we came from follows; going forward, it
+		// precedes, as do the skipped reports in offset mode
+		hasNext, hasPrev := more, after != nil || offset > 0
+		if backward {
+			hasNext, hasPrev = true, more
+		}
+
+		if hasNext {
+			response.NextCursor = encodeReportCursor(last, filter.Sort, false)
+		}
+		if hasPrev {
+			response.PrevCursor = encodeReportCursor(first, filter.Sort, true)
+		}
+	}
+
+	// Counting every match is the slow part, so cursor mode skips it unless asked
+	includeTotal := after == nil
+	if page.IncludeTotal != nil {
+		includeTotal = *page.IncludeTotal
+	}
+	if includeTotal {
+		total, err := s.reportRepo.CountReportsByUserID(userID, filter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user reports: %w", err)
+		}
+		response.Total = &total
+	}
+
+	return response, nil
+}
+
+// normalizeReportFilter checks the filter values and fills in defaults.
+func normalizeReportFilter(filter *models.ReportFilter) error {
+	for _, status := range filter.Statuses {
+		switch status {
+		case models.ReportStatusQueued, models.ReportStatusProcessing, models.ReportStatusReady, models.ReportStatusFailed:
+		default:
+			return fmt.Errorf("invalid status")
+		}
+	}
+
+	// Reports created without a type are standard ones
+	if slices.Contains(filter.ProductCodes, DefaultProductCode) {
+		filter.ProductCodes = append(filter.ProductCodes, "")
+	}
+
+	if filter.From != nil && filter.To != nil && !filter.From.Before(*filter.To) {
+		return fmt.Errorf("invalid date range")
+	}
+
+	filter.Query = strings.TrimSpace(filter.Query)
+	if len(filter.Query) > 200 {
+		return fmt.Errorf("query too long")
+	}
+
+	switch filter.Sort {
+	case "":
+		filter.Sort = models.ReportSortNewest
+	case models.ReportSortNewest, models.ReportSortOldest, models.ReportSortTitle, models.ReportSortTitleDesc:
+	case models.ReportSortRelevance:
+		if filter.Query == "" {
+			return fmt.Errorf("relevance sort needs a query")
+		}
+	default:
+		return fmt.Errorf("invalid sort")
+	}
+
+	return nil
+}
+
+func (s *UserService) GetUserTransactions(userID, limit, offset int) (*models.TransactionsResponse, error) {
+	// Set default pagination values
+	if limit <= 0 || limit > 100 {
+		limit = 20 // Default limit
+	}
+
+	if offset < 0 {
+		offset = 0 // Default offset
+	}
+
+	transactions, err := s.ledgerRepo.GetUserTransactions(userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user transactions: %w", err)
+	}
+
+	return &models.TransactionsResponse{
+		Transactions: transactions,
+		Limit:        limit,
+		Offset:       offset,
 	}, nil
 }
+
+// UnflagUser clears the flag set by a chargeback once support reviewed the account.
+func (s *UserService) UnflagUser(userID int) error {
+	return s.userRepo.UnflagUser(userID)
+}
@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Event types sent by the payment provider
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+	EventPaymentRefunded  = "payment.refunded"
+	EventChargeback       = "payment.chargeback"
+)
+
+var errInvalidEvent = errors.New("invalid event")
+
+// Event is a payment provider webhook.
+type Event struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt int64     `json:"created_at"` // Unix timestamp
+	Data      EventData `json:"data"`
+}
+
+// EventData describes the payment an event refers to.
+type EventData struct {
+	PaymentID string `json:"payment_id"`
+	Amount    int    `json:"amount,omitempty"` // Refunded or disputed amount in cents, 0 means the full payment
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Dispatcher receives verified, deduplicated events, one method per type.
+// Returning an error makes the provider redeliver the event later.
+// Deduplication is best effort: an event whose handling crashed or outlived
+// its reservation is delivered again, so every method must be idempotent
+// per event ID.
+type Dispatcher interface {
+	PaymentSucceeded(event *Event) error
+	PaymentFailed(event *Event) error
+	PaymentRefunded(event *Event) error
+	Chargeback(event *Event) error
+}
+
+func parseEvent(body []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, errInvalidEvent
+	}
+
+	if event.ID == "" || event.Data.PaymentID == "" {
+		return nil, errInvalidEvent
+	}
+
+	switch event.Type {
+	case EventPaymentSucceeded, EventPaymentFailed, EventPaymentRefunded, EventChargeback:
+	default:
+		return nil, errInvalidEvent
+	}
+
+	return &event, nil
+}
+
+func dispatch(dispatcher Dispatcher, event *Event) error {
+	switch event.Type {
+	case EventPaymentSucceeded:
+		return dispatcher.PaymentSucceeded(event)
+	case EventPaymentFailed:
+		return dispatcher.PaymentFailed(event)
+	case EventPaymentRefunded:
+		return dispatcher.PaymentRefunded(event)
+	case EventChargeback:
+		return dispatcher.Chargeback(event)
+	}
+
+	return errInvalidEvent
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"zl0y-billing/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxEventBytes = 64 << 10
+
+// EventStore remembers event IDs so that redelivered events are applied once.
+type EventStore interface {
+	// Reserve records the event and reports whether it is new
+	Reserve(eventID, eventType string) (bool, error)
+	// MarkProcessed confirms a reserved event was applied
+	MarkProcessed(eventID string) error
+	// Release forgets a reserved event so that a redelivery is applied again
+	Release(eventID string) error
+}
+
+// Handler is the HTTP endpoint the payment provider posts webhooks to.
+type Handler struct {
+	verifier   *Verifier
+	store      EventStore
+	dispatcher Dispatcher
+}
+
+func NewHandler(verifier *Verifier, store EventStore, dispatcher Dispatcher) *Handler {
+	return &Handler{
+		verifier:   verifier,
+		store:      store,
+		dispatcher: dispatcher,
+	}
+}
+
+func (h *Handler) Handle(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxEventBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Failed to read request body",
+		})
+		return
+	}
+
+	// Authenticate before parsing anything
+	if err := h.verifier.Verify(body, c.GetHeader(SignatureHeader)); err != nil {
+		message := "Invalid signature"
+		if errors.Is(err, errStaleTimestamp) {
+			message = "Signature timestamp is outside the tolerance"
+		}
+		c.JSON(http.StatusUnauthorized, models.ErrorResponse{
+			Error: message,
+		})
+		return
+	}
+
+	event, err := parseEvent(body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.ErrorResponse{
+			Error: "Invalid event",
+		})
+		return
+	}
+
+	reserved, err := h.store.Reserve(event.ID, event.Type)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to store event",
+		})
+		return
+	}
+
+	// Already seen: acknowledge so the provider stops redelivering
+	if !reserved {
+		c.JSON(http.StatusOK, gin.H{
+			"status": "duplicate",
+		})
+		return
+	}
+
+	if err := dispatch(h.dispatcher, event); err != nil {
+		log.Printf("Failed to process webhook event %s (%s): %v", event.ID, event.Type, err)
+		if releaseErr := h.store.Release(event.ID); releaseErr != nil {
+			log.Printf("Failed to release webhook event %s: %v", event.ID, releaseErr)
+		}
+		c.JSON(http.StatusInternalServerError, models.ErrorResponse{
+			Error: "Failed to process event",
+		})
+		return
+	}
+
+	if err := h.store.MarkProcessed(event.ID); err != nil {
+		log.Printf("Failed to mark webhook event %s as processed: %v", event.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "processed",
+	})
+}
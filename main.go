@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"log"
+	"strings"
+	"time"
 
+	"zl0y-billing/internal/blob"
 	"zl0y-billing/internal/config"
 	"zl0y-billing/internal/database"
+	"zl0y-billing/internal/fingerprint"
 	"zl0y-billing/internal/handlers"
 	"zl0y-billing/internal/middleware"
+	"zl0y-billing/internal/models"
+	"zl0y-billing/internal/money"
+	"zl0y-billing/internal/oidc"
 	"zl0y-billing/internal/repository"
 	"zl0y-billing/internal/service"
+	"zl0y-billing/internal/webhook"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -22,6 +31,9 @@ func main() {
 
 	// Load configuration
 	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Initialize the database connections
 	pgDB, err := database.NewPostgresDB(cfg.PostgresDSN)
@@ -36,44 +48,327 @@ func main() {
 	}
 	defer mongoDB.Disconnect()
 
+	var blobStore blob.Store
+	switch cfg.BlobStore {
+	case "fs":
+		blobStore, err = blob.NewFileStore(cfg.BlobDir)
+		if err != nil {
+			log.Fatalf("Failed to initialize blob store: %v", err)
+		}
+	case "gridfs":
+		blobStore = blob.NewGridFSStore(mongoDB.Database, "report_contents")
+	default:
+		log.Fatalf("Unknown blob store %q", cfg.BlobStore)
+	}
+
+	rates, err := money.ParseRates(cfg.ExchangeRates)
+	if err != nil {
+		log.Fatalf("Failed to parse exchange rates: %v", err)
+	}
+
 	// initialize repositories
 	userRepo := repository.NewUserRepository(pgDB)
 	reportRepo := repository.NewReportRepository(mongoDB)
+	ledgerRepo := repository.NewLedgerRepository(pgDB)
+	purchaseRepo := repository.NewPurchaseRepository(pgDB)
+	idempotencyRepo := repository.NewIdempotencyRepository(pgDB, cfg.IdempotencyKeyTTL)
+	topUpRepo := repository.NewTopUpRepository(pgDB)
+	webhookEventRepo := repository.NewWebhookEventRepository(pgDB, time.Minute)
+	productRepo := repository.NewProductRepository(pgDB)
+	promoRepo := repository.NewPromoRepository(pgDB)
+	subscriptionRepo := repository.NewSubscriptionRepository(pgDB)
+	sessionRepo := repository.NewSessionRepository(pgDB)
+	revocationRepo := repository.NewRevocationRepository(pgDB)
+	signingKeyRepo := repository.NewSigningKeyRepository(pgDB)
+	passwordResetRepo := repository.NewPasswordResetRepository(pgDB)
+	twoFactorRepo := repository.NewTwoFactorRepository(pgDB)
+	loginThrottleRepo := repository.NewLoginThrottleRepository(pgDB)
+	apiKeyRepo := repository.NewAPIKeyRepository(pgDB)
+	identityRepo := repository.NewIdentityRepository(pgDB)
+	reportJobRepo := repository.NewReportJobRepository(pgDB)
+
+	notifier, err := service.NewNotifier(cfg.Notifier, cfg.NotifierFile)
+	if err != nil {
+		log.Fatalf("Failed to initialize notifier: %v", err)
+	}
+
+	analyzer, err := service.NewAnalyzer(cfg.Analyzer, cfg.FakeAnalyzerDelay)
+	if err != nil {
+		log.Fatalf("Failed to initialize analyzer: %v", err)
+	}
 
 	// Initialize services
-	authService := service.NewAuthService(userRepo, cfg.JWTSecret)
-	userService := service.NewUserService(userRepo, reportRepo)
-	reportService := service.NewReportService(reportRepo, userRepo)
+	keyService, err := service.NewKeyService(signingKeyRepo, cfg.JWTSigningAlg, cfg.JWTKeyRotationInterval, cfg.JWTKeyOverlap, cfg.AccessTokenTTL)
+	if err != nil {
+		log.Fatalf("Failed to initialize signing keys: %v", err)
+	}
+	revocationService := service.NewRevocationService(revocationRepo, userRepo, sessionRepo, apiKeyRepo, cfg.AccessTokenTTL, cfg.RevocationSyncInterval)
+	twoFactorService := service.NewTwoFactorService(twoFactorRepo, userRepo, cfg.TOTPIssuer, cfg.LoginChallengeTTL)
+	loginThrottleService := service.NewLoginThrottleService(loginThrottleRepo, cfg.LoginMaxFailures, cfg.LoginIPMaxFailures, cfg.LoginLockout, cfg.LoginFailureWindow)
+	emailService := service.NewEmailService(userRepo, notifier, cfg.EmailVerificationSecret, cfg.EmailVerificationTTL, cfg.PublicBaseURL)
+	authService := service.NewAuthService(userRepo, sessionRepo, passwordResetRepo, revocationService, keyService, twoFactorService, loginThrottleService, emailService, notifier,
+		cfg.AccessTokenTTL, cfg.RefreshTokenTTL, cfg.PasswordResetTTL, cfg.PublicBaseURL)
+	apiKeyService := service.NewAPIKeyService(apiKeyRepo)
+
+	mockOIDCIssuer := cfg.PublicBaseURL + "/api/mock/oidc"
+	oidcProviders := map[string]*oidc.Provider{}
+	for _, p := range cfg.OIDCProviders {
+		if p.Issuer == "" || p.ClientID == "" {
+			log.Fatalf("OpenID provider %s needs an issuer and a client ID", p.Name)
+		}
+		// The mock provider logs in as anyone, so it is for development only
+		if strings.TrimSuffix(p.Issuer, "/") == mockOIDCIssuer && !cfg.DevMode {
+			log.Fatalf("OpenID provider %s is the mock provider, which needs DEV_MODE=true", p.Name)
+		}
+		oidcProviders[p.Name] = oidc.NewProvider(oidc.Config{
+			Issuer:       p.Issuer,
+			ClientID:     p.ClientID,
+			ClientSecret: p.ClientSecret,
+			RedirectURL:  cfg.PublicBaseURL + "/api/auth/oidc/" + p.Name + "/callback",
+			Scopes:       p.Scopes,
+		})
+	}
+	oidcService := service.NewOIDCService(oidcProviders, identityRepo, userRepo, authService, cfg.OIDCStateTTL)
+	var mockOIDC *oidc.MockServer
+	if cfg.DevMode {
+		mockOIDC, err = oidc.NewMockServer(mockOIDCIssuer)
+		if err != nil {
+			log.Fatalf("Failed to initialize mock OpenID provider: %v", err)
+		}
+	}
+
+	userService := service.NewUserService(userRepo, reportRepo, ledgerRepo)
+	catalogService := service.NewCatalogService(productRepo)
+	promoService := service.NewPromoService(promoRepo)
+	subscriptionService := service.NewSubscriptionService(subscriptionRepo, userRepo, cfg.SubscriptionGracePeriod)
+	purchaseSaga := service.NewPurchaseSaga(purchaseRepo, reportRepo, cfg.PurchaseMaxAttempts, cfg.PurchaseRetryDelay)
+	reportService := service.NewReportService(reportRepo, userRepo, purchaseRepo, purchaseSaga, catalogService, promoService, rates, cfg.RequireVerifiedEmail)
+	reportContentService := service.NewReportContentService(reportRepo, blobStore, cfg.DownloadURLSecret, cfg.DownloadURLTTL, cfg.PublicBaseURL)
+	fingerprintService := service.NewFingerprintService(reportRepo)
+	reportPipeline := service.NewReportPipeline(reportJobRepo, reportRepo, catalogService, reportContentService, fingerprintService, analyzer,
+		cfg.ReportWorkers, cfg.ReportJobLease, cfg.ReportMaxAttempts, cfg.ReportRetryDelay)
+	ledgerService := service.NewLedgerService(ledgerRepo)
+	adminService := service.NewAdminService(userRepo, purchaseRepo, revocationService)
+	refundService := service.NewRefundService(purchaseRepo, userRepo, purchaseSaga)
+	fakeProvider := service.NewFakeProvider(cfg.FakeProviderSecret, cfg.PublicBaseURL)
+
+	// The fake provider confirms any payment it is told to, so it only exists in development mode
+	var paymentProviders []service.PaymentProvider
+	if cfg.DevMode {
+		paymentProviders = append(paymentProviders, fakeProvider)
+	} else if cfg.PaymentProvider == fakeProvider.Name() {
+		log.Fatalf("The fake payment provider needs DEV_MODE=true")
+	}
+	if cfg.PaymentProvider == "" {
+		log.Println("PAYMENT_PROVIDER is not set, top-ups are disabled")
+	}
+	billingService := service.NewBillingService(topUpRepo, userRepo, refundService, rates, cfg.PaymentProvider, cfg.TopUpMinAmount, cfg.TopUpMaxAmount, paymentProviders...)
+
+	// Bring pre-ledger balances into the ledger and check the cached balances
+	if count, err := ledgerService.Migrate(); err != nil {
+		log.Fatalf("Failed to migrate balances to the ledger: %v", err)
+	} else if count > 0 {
+		log.Printf("Posted opening balances for %d users", count)
+	}
+
+	mismatches, err := ledgerService.Reconcile(false)
+	if err != nil {
+		log.Fatalf("Failed to reconcile balances: %v", err)
+	}
+	for _, m := range mismatches {
+		log.Printf("Balance mismatch for user %d: cached %s, ledger %s", m.UserID, m.CachedBalance, m.LedgerBalance)
+	}
+
+	// Reports created before the switch to v2 ObjectIDs have a binary _id
+	if count, err := reportRepo.ConvertBinaryIDs(); err != nil {
+		log.Fatalf("Failed to convert report ids: %v", err)
+	} else if count > 0 {
+		log.Printf("Converted %d report ids to ObjectIDs", count)
+	}
+
+	// Bring fingerprints stored under an older schema version up to date
+	if count, err := fingerprintService.MigrateStored(); err != nil {
+		log.Fatalf("Failed to migrate report fingerprints: %v", err)
+	} else if count > 0 {
+		log.Printf("Upgraded %d report fingerprints to schema version %d", count, fingerprint.CurrentVersion)
+	}
+
+	if cfg.BootstrapAdminLogin != "" {
+		if err := adminService.BootstrapAdmin(cfg.BootstrapAdminLogin); err != nil {
+			log.Fatalf("Failed to bootstrap admin: %v", err)
+		}
+	}
+
+	// Start background workers; the first pass recovers purchases interrupted by a restart
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go purchaseSaga.Run(ctx, cfg.PurchaseWorkerInterval)
+	go subscriptionService.Run(ctx, cfg.SubscriptionWorkerInterval)
+	go expireIdempotencyKeys(ctx, idempotencyRepo)
+	go expireTopUps(ctx, topUpRepo, cfg.TopUpPendingTTL)
+	go expireSessions(ctx, sessionRepo, passwordResetRepo, twoFactorRepo, identityRepo)
+	go revocationService.Run(ctx)
+	go keyService.Run(ctx, cfg.JWTKeySyncInterval)
+	go loginThrottleService.Run(ctx)
+	go reportPipeline.Run(ctx, cfg.ReportWorkerInterval)
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authService)
+	twoFactorHandler := handlers.NewTwoFactorHandler(twoFactorService)
+	apiKeyHandler := handlers.NewAPIKeyHandler(apiKeyService)
+	oidcHandler := handlers.NewOIDCHandler(oidcService, strings.HasPrefix(cfg.PublicBaseURL, "https://"))
+	emailHandler := handlers.NewEmailHandler(emailService)
 	userHandler := handlers.NewUserHandler(userService)
-	reportHandler := handlers.NewReportHandler(reportService)
-	mockHandler := handlers.NewMockHandler(reportRepo)
+	reportHandler := handlers.NewReportHandler(reportService, reportContentService)
+	reportJobHandler := handlers.NewReportJobHandler(reportPipeline)
+	billingHandler := handlers.NewBillingHandler(billingService)
+	productHandler := handlers.NewProductHandler(catalogService)
+	promoHandler := handlers.NewPromoHandler(promoService)
+	subscriptionHandler := handlers.NewSubscriptionHandler(subscriptionService)
+	adminHandler := handlers.NewAdminHandler(adminService, refundService, userService, revocationService, loginThrottleService)
+	jwksHandler := handlers.NewJWKSHandler(keyService)
+	mockHandler := handlers.NewMockHandler(reportRepo, billingService, catalogService, fakeProvider, mockOIDC, reportContentService, fingerprintService)
+	webhookHandler := webhook.NewHandler(
+		webhook.NewVerifier(cfg.WebhookSecret, cfg.WebhookTolerance),
+		webhookEventRepo,
+		billingService.WebhookDispatcher(cfg.WebhookProvider),
+	)
 
 	// Setup routes
 	router := gin.Default()
+	// Without trusted proxies ClientIP ignores X-Forwarded-For, which any
+	// client could set to dodge the per-IP login throttle
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	idempotency := middleware.IdempotencyMiddleware(idempotencyRepo)
+
+	authMiddleware := middleware.AuthMiddleware(keyService, revocationService, apiKeyService)
+	sessionOnly := middleware.SessionOnly()
 
 	// Public routes
 	auth := router.Group("/api/auth")
 	{
+		// Not idempotent: a stored response would keep the issued tokens in plain text
 		auth.POST("/register", authHandler.Register)
 		auth.POST("/login", authHandler.Login)
+		auth.POST("/login/2fa", authHandler.CompleteLogin)
+		auth.POST("/refresh", authHandler.Refresh)
+		auth.POST("/logout", authHandler.Logout)
+		auth.POST("/password/change", authMiddleware, sessionOnly, authHandler.ChangePassword)
+		auth.POST("/password/reset/request", authHandler.RequestPasswordReset)
+		auth.POST("/password/reset", authHandler.ResetPassword)
+		auth.GET("/email/verify", emailHandler.Verify)
+		auth.GET("/oidc/providers", oidcHandler.ListProviders)
+		auth.POST("/oidc/:provider/start", oidcHandler.Start)
+		auth.GET("/oidc/:provider/callback", middleware.OptionalAuth(authMiddleware), oidcHandler.Callback)
 	}
 
-	// Mock routes for testing
-	mock := router.Group("/api/mock")
-	{
-		mock.POST("/create-report", mockHandler.CreateReport)
+	router.GET("/api/products", productHandler.ListProducts)
+	router.GET("/api/plans", subscriptionHandler.ListPlans)
+	router.GET("/api/exchange-rates", billingHandler.GetExchangeRates)
+
+	// Report downloads are authorized by the signed link itself
+	router.GET("/api/reports/:report_id/download", reportHandler.DownloadReport)
+	router.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
+	// Mock routes for testing; they are unauthenticated, so only in development mode
+	if cfg.DevMode {
+		log.Println("Development mode: mock endpoints are enabled under /api/mock")
+
+		mock := router.Group("/api/mock")
+		{
+			mock.POST("/create-report", mockHandler.CreateReport)
+			mock.POST("/payments/:payment_id/complete", mockHandler.CompletePayment)
+			mock.PUT("/reports/:report_id/content", mockHandler.UploadReportContent)
+			mock.PUT("/reports/:report_id/fingerprint", mockHandler.IngestFingerprint)
+			mock.GET("/oidc/.well-known/openid-configuration", mockHandler.OIDCDiscovery)
+			mock.GET("/oidc/authorize", mockHandler.OIDCAuthorize)
+			mock.POST("/oidc/token", mockHandler.OIDCToken)
+			mock.GET("/oidc/jwks", mockHandler.OIDCJWKS)
+		}
 	}
 
-	// Protected routes
+	// Payment provider callbacks
+	router.POST("/api/billing/callbacks/:provider", billingHandler.ProviderCallback)
+	router.POST("/api/webhooks/payments", webhookHandler.Handle)
+
+	// Protected routes; API keys reach only the routes of their scopes
+	reportsRead := middleware.RequireScope(models.ScopeReportsRead)
+	reportsCreate := middleware.RequireScope(models.ScopeReportsCreate)
+	reportsPurchase := middleware.RequireScope(models.ScopeReportsPurchase)
+	billingRead := middleware.RequireScope(models.ScopeBillingRead)
+	billingWrite := middleware.RequireScope(models.ScopeBillingWrite)
+
 	protected := router.Group("/api")
-	protected.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+	protected.Use(authMiddleware)
+	{
+		protected.POST("/user/link-anonymous", sessionOnly, idempotency, userHandler.LinkAnonymous)
+		protected.GET("/user/reports", reportsRead, userHandler.GetReports)
+		protected.GET("/user/transactions", billingRead, userHandler.GetTransactions)
+		protected.GET("/user/wallets", billingRead, userHandler.GetWallets)
+		protected.GET("/user/sessions", sessionOnly, authHandler.GetSessions)
+		protected.DELETE("/user/sessions/:session_id", sessionOnly, authHandler.RevokeSession)
+		protected.POST("/user/2fa/enroll", sessionOnly, twoFactorHandler.Enroll)
+		protected.POST("/user/2fa/confirm", sessionOnly, twoFactorHandler.Confirm)
+		protected.POST("/user/2fa/disable", sessionOnly, twoFactorHandler.Disable)
+		protected.POST("/user/2fa/recovery-codes", sessionOnly, twoFactorHandler.RegenerateRecoveryCodes)
+		protected.POST("/user/api-keys", sessionOnly, apiKeyHandler.CreateAPIKey)
+		protected.GET("/user/api-keys", sessionOnly, apiKeyHandler.ListAPIKeys)
+		protected.DELETE("/user/api-keys/:key_id", sessionOnly, apiKeyHandler.RevokeAPIKey)
+		protected.GET("/user/email", sessionOnly, emailHandler.GetEmail)
+		protected.PUT("/user/email", sessionOnly, emailHandler.SetEmail)
+		protected.DELETE("/user/email", sessionOnly, emailHandler.RemoveEmail)
+		protected.POST("/user/email/verification", sessionOnly, emailHandler.SendVerification)
+		protected.GET("/user/identities", sessionOnly, oidcHandler.GetIdentities)
+		protected.POST("/user/identities/:provider/link", sessionOnly, oidcHandler.StartLink)
+		protected.DELETE("/user/identities/:provider", sessionOnly, oidcHandler.Unlink)
+		protected.POST("/reports", reportsCreate, idempotency, reportJobHandler.SubmitReport)
+		protected.GET("/reports/:report_id", reportsRead, reportHandler.GetReport)
+		protected.GET("/reports/:report_id/status", reportsRead, reportJobHandler.GetReportStatus)
+		protected.GET("/reports/:report_id/events", reportsRead, reportJobHandler.StreamReportStatus)
+		protected.POST("/reports/:report_id/purchase", reportsPurchase, idempotency, reportHandler.PurchaseReport)
+		protected.GET("/purchases/:purchase_id", reportsRead, reportHandler.GetPurchase)
+		protected.POST("/billing/topups", billingWrite, idempotency, billingHandler.CreateTopUp)
+		protected.GET("/billing/topups/:topup_id", billingRead, billingHandler.GetTopUp)
+		protected.GET("/subscription", billingRead, subscriptionHandler.GetSubscription)
+		protected.POST("/subscription", billingWrite, idempotency, subscriptionHandler.Subscribe)
+		protected.PUT("/subscription/plan", billingWrite, idempotency, subscriptionHandler.ChangePlan)
+		protected.DELETE("/subscription", billingWrite, subscriptionHandler.Cancel)
+	}
+
+	// Staff routes: support staff look after users, admins can also change them
+	staff := router.Group("/api/admin")
+	staff.Use(authMiddleware, middleware.RequireRole(models.RoleSupport, models.RoleAdmin))
 	{
-		protected.POST("/user/link-anonymous", userHandler.LinkAnonymous)
-		protected.GET("/user/reports", userHandler.GetReports)
-		protected.POST("/reports/:report_id/purchase", reportHandler.PurchaseReport)
+		staff.GET("/users", adminHandler.FindUsers)
+		staff.GET("/users/:user_id", adminHandler.GetUser)
+		staff.GET("/users/:user_id/purchases", adminHandler.GetUserPurchases)
+		staff.GET("/users/:user_id/transactions", adminHandler.GetUserTransactions)
+		staff.DELETE("/users/:user_id/flag", adminHandler.UnflagUser)
+		staff.POST("/users/:user_id/revoke-tokens", adminHandler.RevokeUserTokens)
+		staff.GET("/lockouts", adminHandler.GetLockouts)
+		staff.DELETE("/lockouts/:scope/:key", adminHandler.ClearLockout)
+	}
+
+	// Admin routes
+	admin := router.Group("/api/admin")
+	admin.Use(authMiddleware, middleware.RequireRole(models.RoleAdmin))
+	{
+		admin.POST("/users/:user_id/balance-adjustments", adminHandler.AdjustBalance)
+		admin.POST("/users/:user_id/disable", adminHandler.DisableUser)
+		admin.POST("/users/:user_id/enable", adminHandler.EnableUser)
+		admin.PUT("/users/:user_id/role", adminHandler.SetRole)
+		admin.POST("/purchases/:purchase_id/refund", adminHandler.RefundPurchase)
+		admin.POST("/tokens/:jti/revoke", adminHandler.RevokeToken)
+		admin.GET("/products", productHandler.ListAllProducts)
+		admin.POST("/products", productHandler.CreateProduct)
+		admin.PUT("/products/:code", productHandler.UpdateProduct)
+		admin.GET("/promo-codes", promoHandler.ListPromoCodes)
+		admin.POST("/promo-codes", promoHandler.CreatePromoCode)
+		admin.PUT("/promo-codes/:code", promoHandler.UpdatePromoCode)
+		admin.GET("/promo-codes/:code/redemptions", promoHandler.GetRedemptions)
 	}
 
 	log.Printf("Server starting on port %s", cfg.Port)
@@ -81,3 +376,67 @@ func main() {
 		log.Fatal("Failed to start server:", err)
 	}
 }
+
+// expireIdempotencyKeys periodically removes idempotency keys past their TTL.
+func expireIdempotencyKeys(ctx context.Context, repo *repository.IdempotencyRepository) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := repo.DeleteExpired(); err != nil {
+				log.Printf("Failed to expire idempotency keys: %v", err)
+			}
+		}
+	}
+}
+
+// expireTopUps periodically expires top-ups left unpaid for longer than ttl.
+func expireTopUps(ctx context.Context, repo *repository.TopUpRepository, ttl time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if count, err := repo.ExpirePendingTopUps(ttl); err != nil {
+				log.Printf("Failed to expire top-ups: %v", err)
+			} else if count > 0 {
+				log.Printf("Expired %d unpaid top-ups", count)
+			}
+		}
+	}
+}
+
+// expireSessions periodically removes ended sessions with their refresh tokens,
+// used or expired password reset tokens and login challenges, and OpenID
+// logins that were never completed.
+func expireSessions(ctx context.Context, repo *repository.SessionRepository, resetRepo *repository.PasswordResetRepository, twoFactorRepo *repository.TwoFactorRepository, identityRepo *repository.IdentityRepository) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := repo.DeleteExpired(); err != nil {
+				log.Printf("Failed to expire sessions: %v", err)
+			}
+			if _, err := resetRepo.DeleteExpired(); err != nil {
+				log.Printf("Failed to expire password reset tokens: %v", err)
+			}
+			if _, err := twoFactorRepo.DeleteExpired(); err != nil {
+				log.Printf("Failed to expire login challenges: %v", err)
+			}
+			if _, err := identityRepo.DeleteExpired(); err != nil {
+				log.Printf("Failed to expire OpenID login states: %v", err)
+			}
+		}
+	}
+}